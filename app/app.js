@@ -108,10 +108,10 @@ function logout() {
   document.getElementById('video-section').style.display = 'none';
 }
 
-function setUploadButtonState(uploading, selector) {
+function setUploadButtonState(uploading, selector, label = 'Uploading...') {
   const uploadBtn = document.getElementById(selector);
   if (uploading) {
-    uploadBtn.textContent = 'Uploading...';
+    uploadBtn.textContent = label;
     uploadBtn.disabled = true;
     return;
   }
@@ -152,19 +152,56 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
-async function uploadVideoFile(videoID) {
-  const videoFile = document.getElementById('video-file').files[0];
-  if (!videoFile) return;
+async function createClip(videoID) {
+  const params = {};
+  const start = document.getElementById('clip-start').value.trim();
+  const end = document.getElementById('clip-end').value.trim();
+  if (start) params.start = start;
+  if (end) params.end = end;
+
+  uploadBtnSelector = 'create-clip-btn';
+  setUploadButtonState(true, uploadBtnSelector);
+
+  try {
+    const res = await fetch(`/api/videos/${videoID}/clip`, {
+      method: 'POST',
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(params),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to create clip. Error: ${data.error}`);
+    }
+
+    const clip = await res.json();
+    console.log('Clip queued!');
+    await getVideos();
+    viewVideo(clip);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+
+  setUploadButtonState(false, uploadBtnSelector);
+}
+
+async function uploadCaptions(videoID) {
+  const captionsFile = document.getElementById('captions-file').files[0];
+  const language = document.getElementById('captions-language').value.trim();
+  if (!captionsFile || !language) return;
 
   const formData = new FormData();
-  formData.append('video', videoFile);
+  formData.append('captions', captionsFile);
+  formData.append('label', document.getElementById('captions-label').value.trim());
 
-  uploadBtnSelector = 'upload-video-btn';
+  uploadBtnSelector = 'upload-captions-btn';
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
-      method: 'POST',
+    const res = await fetch(`/api/videos/${videoID}/captions/${encodeURIComponent(language)}`, {
+      method: 'PUT',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
@@ -172,10 +209,11 @@ async function uploadVideoFile(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload captions. Error: ${data.error}`);
     }
 
-    console.log('Video uploaded!');
+    await res.json();
+    console.log('Captions uploaded!');
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -184,6 +222,203 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+const progressStageLabels = {
+  upload: 'Uploading',
+  queued: 'Waiting to process',
+  processing: 'Processing',
+  storing: 'Saving',
+  ready: 'Ready',
+  failed: 'Failed',
+};
+
+function showVideoProgress(event) {
+  const container = document.getElementById('video-progress');
+  if (!event) {
+    container.style.display = 'none';
+    return;
+  }
+  container.style.display = 'block';
+
+  const bar = document.getElementById('video-progress-bar');
+  if (event.percent > 0) {
+    bar.value = event.percent;
+  } else {
+    // unknown progress shows as an indeterminate bar
+    bar.removeAttribute('value');
+  }
+
+  let label = progressStageLabels[event.stage] || event.stage;
+  if (event.step) label += ` (${event.step})`;
+  if (event.percent > 0) label += ` ${Math.floor(event.percent)}%`;
+  if (event.message) label += ` - ${event.message}`;
+  document.getElementById('video-progress-label').textContent = label;
+}
+
+// watchVideoProgress follows the server's progress stream for a video, call the returned
+// function to stop. EventSource can't send headers, so the stream is opened with a short-lived
+// progress token in the query string, and a new one is fetched whenever it has to reconnect.
+function watchVideoProgress(videoID) {
+  let source = null;
+  let stopped = false;
+
+  const connect = async () => {
+    const res = await fetch(`/api/videos/${videoID}/progress_token`, {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${localStorage.getItem('token')}` },
+    });
+    if (!res.ok || stopped) return;
+    const { token } = await res.json();
+
+    source = new EventSource(`/api/videos/${videoID}/progress?token=${encodeURIComponent(token)}`);
+    source.addEventListener('progress', (e) => {
+      const event = JSON.parse(e.data);
+      showVideoProgress(event);
+      if (event.stage === 'ready' || event.stage === 'failed') {
+        stopped = true;
+        source.close();
+      }
+    });
+    source.addEventListener('error', () => {
+      // the browser's own retry would reuse the expired token
+      source.close();
+      if (!stopped) setTimeout(connect, 2000);
+    });
+  };
+
+  connect().catch((err) => console.error('Progress stream failed:', err));
+  return () => {
+    stopped = true;
+    if (source) source.close();
+  };
+}
+
+async function uploadVideoFile(videoID) {
+  const videoFile = document.getElementById('video-file').files[0];
+  if (!videoFile) return;
+
+  const formData = new FormData();
+  formData.append('video', videoFile);
+
+  uploadBtnSelector = 'upload-video-btn';
+  setUploadButtonState(true, uploadBtnSelector);
+  showVideoProgress({ stage: 'upload', percent: 0 });
+  const stopWatching = watchVideoProgress(videoID);
+
+  try {
+    const uploadedDirectly = await uploadVideoMultipart(videoID, videoFile);
+    if (!uploadedDirectly) {
+      const res = await fetch(`/api/video_upload/${videoID}`, {
+        method: 'POST',
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+        },
+        body: formData,
+      });
+      if (!res.ok) {
+        const data = await res.json();
+        throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      }
+    }
+
+    console.log('Video uploaded!');
+    setUploadButtonState(true, uploadBtnSelector, 'Processing...');
+    await waitForProcessing(videoID);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+
+  stopWatching();
+  showVideoProgress(null);
+  setUploadButtonState(false, uploadBtnSelector);
+}
+
+// uploadVideoMultipart sends the file straight to the bucket in parts,
+// it returns false when the server's storage backend doesn't support it
+async function uploadVideoMultipart(videoID, videoFile) {
+  const authHeaders = {
+    Authorization: `Bearer ${localStorage.getItem('token')}`,
+    'Content-Type': 'application/json',
+  };
+
+  const initRes = await fetch(`/api/video_upload/${videoID}/multipart`, {
+    method: 'POST',
+    headers: authHeaders,
+    body: JSON.stringify({ content_type: videoFile.type, size: videoFile.size }),
+  });
+  if (initRes.status === 501) {
+    return false;
+  }
+  if (!initRes.ok) {
+    const data = await initRes.json();
+    throw new Error(`Failed to start video upload. Error: ${data.error}`);
+  }
+  const upload = await initRes.json();
+
+  try {
+    const parts = [];
+    for (const part of upload.parts) {
+      const start = (part.part_number - 1) * upload.part_size;
+      const res = await fetch(part.url, {
+        method: 'PUT',
+        body: videoFile.slice(start, start + upload.part_size),
+      });
+      if (!res.ok) {
+        throw new Error(`Failed to upload part ${part.part_number}.`);
+      }
+      parts.push({ part_number: part.part_number, etag: res.headers.get('ETag') });
+      // the parts go straight to the bucket, so the server can't report them
+      showVideoProgress({
+        stage: 'upload',
+        percent: (Math.min(start + upload.part_size, videoFile.size) / videoFile.size) * 100,
+      });
+    }
+
+    const completeRes = await fetch(
+      `/api/video_upload/${videoID}/multipart/${encodeURIComponent(upload.upload_id)}/complete`,
+      {
+        method: 'POST',
+        headers: authHeaders,
+        body: JSON.stringify({ parts }),
+      }
+    );
+    if (!completeRes.ok) {
+      const data = await completeRes.json();
+      throw new Error(`Failed to finish video upload. Error: ${data.error}`);
+    }
+  } catch (error) {
+    await fetch(`/api/video_upload/${videoID}/multipart/${encodeURIComponent(upload.upload_id)}`, {
+      method: 'DELETE',
+      headers: authHeaders,
+    });
+    throw error;
+  }
+  return true;
+}
+
+async function waitForProcessing(videoID) {
+  while (true) {
+    const res = await fetch(`/api/videos/${videoID}`, {
+      method: 'GET',
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    if (!res.ok) {
+      throw new Error('Failed to get video.');
+    }
+
+    const video = await res.json();
+    if (video.processing_status === 'failed') {
+      throw new Error(`Video processing failed. Error: ${video.processing_error}`);
+    }
+    if (video.processing_status !== 'queued' && video.processing_status !== 'processing') {
+      viewVideo(video);
+      return;
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -250,6 +485,76 @@ async function getVideo(videoID) {
 
 let currentVideo = null;
 
+let hlsPlayer = null;
+
+let storyboardCues = [];
+
+// parseStoryboard reads a WebVTT thumbnails track, each cue's text is a sprite URL with a #xywh fragment
+function parseStoryboard(text, trackURL) {
+  const toSeconds = (timestamp) =>
+    timestamp.split(':').reduce((total, part) => total * 60 + parseFloat(part), 0);
+
+  const cues = [];
+  for (const block of text.split(/\r?\n\r?\n/)) {
+    const lines = block.trim().split(/\r?\n/);
+    const timing = lines.findIndex((line) => line.includes('-->'));
+    if (timing === -1 || !lines[timing + 1]) continue;
+
+    const [start, end] = lines[timing].split('-->').map((t) => toSeconds(t.trim()));
+    const [image, fragment] = lines[timing + 1].split('#xywh=');
+    if (!fragment) continue;
+    const [x, y, w, h] = fragment.split(',').map(Number);
+    cues.push({ start, end, url: new URL(image, trackURL).href, x, y, w, h });
+  }
+  return cues;
+}
+
+async function loadStoryboard(video) {
+  storyboardCues = [];
+  document.getElementById('storyboard-preview').style.display = 'none';
+  if (!video.storyboard_url) return;
+
+  try {
+    const res = await fetch(video.storyboard_url);
+    if (!res.ok) return;
+    const trackURL = new URL(video.storyboard_url, window.location.href).href;
+    const cues = parseStoryboard(await res.text(), trackURL);
+    // the user may have opened another video while this loaded
+    if (currentVideo?.id === video.id) storyboardCues = cues;
+  } catch (error) {
+    console.log(`Couldn't load the storyboard: ${error.message}`);
+  }
+}
+
+// showStoryboardPreview shows the frame under the pointer while it's over the player's seek bar
+function showStoryboardPreview(event) {
+  const videoPlayer = document.getElementById('video-player');
+  const preview = document.getElementById('storyboard-preview');
+  const rect = videoPlayer.getBoundingClientRect();
+  // native controls differ between browsers, the seek bar is somewhere in the bottom strip
+  const overControls = event.clientY > rect.bottom - 48;
+  if (!storyboardCues.length || !overControls || !videoPlayer.duration) {
+    preview.style.display = 'none';
+    return;
+  }
+
+  const offset = Math.min(Math.max(event.clientX - rect.left, 0), rect.width);
+  const time = (offset / rect.width) * videoPlayer.duration;
+  const cue = storyboardCues.find((c) => time >= c.start && time < c.end) || storyboardCues.at(-1);
+
+  preview.style.display = 'block';
+  preview.style.width = `${cue.w}px`;
+  preview.style.height = `${cue.h}px`;
+  preview.style.backgroundImage = `url("${cue.url}")`;
+  preview.style.backgroundPosition = `-${cue.x}px -${cue.y}px`;
+  preview.style.left = `${Math.min(Math.max(offset - cue.w / 2, 0), rect.width - cue.w)}px`;
+}
+
+document.getElementById('video-player').addEventListener('mousemove', showStoryboardPreview);
+document.getElementById('video-player').addEventListener('mouseleave', () => {
+  document.getElementById('storyboard-preview').style.display = 'none';
+});
+
 function viewVideo(video) {
   currentVideo = video;
   document.getElementById('video-display').style.display = 'block';
@@ -261,19 +566,66 @@ function viewVideo(video) {
     thumbnailImg.style.display = 'none';
   } else {
     thumbnailImg.style.display = 'block';
+    const srcset = video.thumbnail_srcset || {};
+    thumbnailImg.srcset = srcset['image/webp'] || srcset['image/jpeg'] || '';
+    thumbnailImg.sizes = '(max-width: 640px) 100vw, 640px';
     thumbnailImg.src = video.thumbnail_url;
   }
 
   const videoPlayer = document.getElementById('video-player');
   if (videoPlayer) {
+    if (hlsPlayer) {
+      hlsPlayer.destroy();
+      hlsPlayer = null;
+    }
+    // reserve the right shape before the video loads, portrait phone footage included
+    // HLS carries its own subtitle renditions, the mp4 gets the tracks as <track> elements
+    videoPlayer.querySelectorAll('track').forEach((track) => track.remove());
+    const usesTracks = !video.playlist_url || !(videoPlayer.canPlayType('application/vnd.apple.mpegurl') || (window.Hls && Hls.isSupported()));
+    const captions = usesTracks ? video.captions || [] : [];
+    // tracks from another origin only load over CORS
+    if (captions.length) {
+      videoPlayer.crossOrigin = 'anonymous';
+    } else {
+      videoPlayer.removeAttribute('crossorigin');
+    }
+    for (const caption of captions) {
+      const track = document.createElement('track');
+      track.kind = 'subtitles';
+      track.srclang = caption.language;
+      track.label = caption.label;
+      track.src = caption.url;
+      videoPlayer.appendChild(track);
+    }
+
+    const knownRatio = video.aspect_ratio && video.aspect_ratio !== 'other';
+    videoPlayer.style.aspectRatio = knownRatio ? video.aspect_ratio.replace(':', ' / ') : '';
     if (!video.video_url) {
       videoPlayer.style.display = 'none';
+    } else if (video.playlist_url && videoPlayer.canPlayType('application/vnd.apple.mpegurl')) {
+      videoPlayer.style.display = 'block';
+      videoPlayer.src = video.playlist_url;
+      videoPlayer.load();
+    } else if (video.playlist_url && window.Hls && Hls.isSupported()) {
+      videoPlayer.style.display = 'block';
+      hlsPlayer = new Hls();
+      hlsPlayer.loadSource(video.playlist_url);
+      hlsPlayer.attachMedia(videoPlayer);
     } else {
       videoPlayer.style.display = 'block';
       videoPlayer.src = video.video_url;
       videoPlayer.load();
     }
   }
+  loadStoryboard(video);
+
+  const waveformImg = document.getElementById('waveform-image');
+  waveformImg.style.display = video.waveform_image_url ? 'block' : 'none';
+  waveformImg.src = video.waveform_image_url || '';
+
+  const audioLink = document.getElementById('audio-link');
+  audioLink.style.display = video.audio_url ? 'inline-block' : 'none';
+  audioLink.href = video.audio_url || '';
 }
 
 async function deleteVideo() {
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Audio rendition formats, the value is also the file extension
+const (
+	audioFormatAAC = "m4a"
+	audioFormatMP3 = "mp3"
+)
+
+const (
+	audioRenditionName = "audio"
+	// pcmSampleRate is what the waveform is computed from, 16kHz mono is also what speech models expect
+	pcmSampleRate = 16000
+)
+
+func isAudioFormat(format string) bool {
+	return format == audioFormatAAC || format == audioFormatMP3
+}
+
+// extractAudio writes the first audio track of filePath as an audio-only file, the processed
+// mp4 always carries AAC so the m4a rendition is a copy
+func extractAudio(ctx context.Context, tools *toolRunner, filePath, outputPath, format string) error {
+	args := []string{"-y", "-i", filePath, "-vn", "-map", "0:a:0"}
+	switch format {
+	case audioFormatAAC:
+		args = append(args, "-c:a", "copy", "-movflags", "faststart", "-f", "mp4")
+	case audioFormatMP3:
+		args = append(args, "-c:a", "libmp3lame", "-q:a", "4", "-f", "mp3")
+	default:
+		return fmt.Errorf("unknown audio format %q", format)
+	}
+	args = append(args, outputPath)
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("extracting audio from %v: %w", filePath, err)
+	}
+	return nil
+}
+
+// decodeAudioPCM writes the first audio track as raw 16-bit little endian mono samples at pcmSampleRate
+func decodeAudioPCM(ctx context.Context, tools *toolRunner, filePath, outputPath string) error {
+	args := []string{
+		"-y",
+		"-i", filePath,
+		"-vn",
+		"-map", "0:a:0",
+		"-ac", "1",
+		"-ar", fmt.Sprint(pcmSampleRate),
+		"-f", "s16le",
+		outputPath,
+	}
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("decoding audio from %v: %w", filePath, err)
+	}
+	return nil
+}
+
+// audioOutputs are the URLs of what storeAudio produced, nil for anything it didn't
+type audioOutputs struct {
+	audioURL         *string
+	waveformURL      *string
+	waveformImageURL *string
+}
+
+// storeAudio stores the audio rendition and the waveform of filePath under keyPrefix and transcribes it,
+// whichever are enabled. A failed transcription is logged rather than failing the rest.
+func (cfg *apiConfig) storeAudio(ctx context.Context, video database.Video, keyPrefix, filePath string) (audioOutputs, error) {
+	pcmPath := ""
+	if cfg.waveformEnabled || cfg.transcriber != nil {
+		cfg.progress.publish(video.ID, progressEvent{Stage: stageProcessing, Step: "decode-audio"})
+		var err error
+		pcmPath, err = cfg.decodePCM(ctx, filePath)
+		if err != nil {
+			return audioOutputs{}, err
+		}
+		defer os.Remove(pcmPath)
+	}
+
+	if cfg.transcriber != nil {
+		if err := cfg.storeTranscript(ctx, video, pcmPath); err != nil {
+			log.Printf("Couldn't transcribe video %s: %v", video.ID, err)
+		}
+	}
+	if cfg.audioFormat == "" && !cfg.waveformEnabled {
+		return audioOutputs{}, nil
+	}
+
+	outputs := audioOutputs{}
+	err := cfg.storeDerivedFiles(ctx, video, keyPrefix, func(outputDir string) error {
+		if cfg.audioFormat != "" {
+			name := audioRenditionName + "." + cfg.audioFormat
+			err := cfg.media.ExtractAudio(cfg.processingStep(ctx, video.ID, "audio", 0), filePath, filepath.Join(outputDir, name), cfg.audioFormat)
+			if err != nil {
+				return err
+			}
+			audioURL := cfg.objectURL(keyPrefix + name)
+			outputs.audioURL = &audioURL
+		}
+
+		if cfg.waveformEnabled {
+			err := writeWaveform(pcmPath, outputDir)
+			if err != nil {
+				return err
+			}
+			waveformURL := cfg.objectURL(keyPrefix + waveformData)
+			waveformImageURL := cfg.objectURL(keyPrefix + waveformImage)
+			outputs.waveformURL = &waveformURL
+			outputs.waveformImageURL = &waveformImageURL
+		}
+		return nil
+	})
+	if err != nil {
+		return audioOutputs{}, err
+	}
+	return outputs, nil
+}
+
+// decodePCM decodes the audio of filePath into a scratch file the caller removes
+func (cfg *apiConfig) decodePCM(ctx context.Context, filePath string) (string, error) {
+	pcmFile, err := os.CreateTemp("", "tubely-audio-*.pcm")
+	if err != nil {
+		return "", err
+	}
+	pcmFile.Close()
+
+	err = cfg.media.DecodeAudioPCM(ctx, filePath, pcmFile.Name())
+	if err != nil {
+		os.Remove(pcmFile.Name())
+		return "", err
+	}
+	return pcmFile.Name(), nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	captionUploadLimit = 2 << 20
+	captionPrefix      = "captions/"
+)
+
+// captionLanguagePattern accepts a BCP 47 language with an optional region, e.g. en, pt-BR or es-419
+var captionLanguagePattern = regexp.MustCompile(`^([a-zA-Z]{2,3})(?:[-_]([a-zA-Z]{2}|[0-9]{3}))?$`)
+
+// normalizeCaptionLanguage returns the canonical form of a language tag so en-us and en_US name the same track
+func normalizeCaptionLanguage(language string) (string, bool) {
+	match := captionLanguagePattern.FindStringSubmatch(language)
+	if match == nil {
+		return "", false
+	}
+	if match[2] == "" {
+		return strings.ToLower(match[1]), true
+	}
+	return strings.ToLower(match[1]) + "-" + strings.ToUpper(match[2]), true
+}
+
+var (
+	srtTimestampPattern = regexp.MustCompile(`^\s*(\d+):(\d{1,2}):(\d{1,2})(?:[,.](\d{1,3}))?\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})(?:[,.](\d{1,3}))?`)
+	// srtTagPattern matches the font tags and {\an8} style overrides SRT files pick up from editors,
+	// WebVTT keeps b, i and u so those are left alone
+	srtTagPattern = regexp.MustCompile(`(?i)</?font[^>]*>|\{\\[^}]*\}`)
+)
+
+// toWebVTT returns data as a WebVTT track, converting it from SRT unless it already is one
+func toWebVTT(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, rejectInvalid("Captions must be UTF-8 encoded")
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	if header, _, _ := strings.Cut(text, "\n"); strings.HasPrefix(header, "WEBVTT") {
+		if rest := header[len("WEBVTT"):]; rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+			return nil, rejectInvalid("Invalid WebVTT header")
+		}
+		return []byte(text), nil
+	}
+	return srtToVTT(text)
+}
+
+// srtToVTT converts SubRip cues, being lenient about the numbering and timestamp formats found in the wild
+func srtToVTT(text string) ([]byte, error) {
+	b := bytes.Buffer{}
+	b.WriteString("WEBVTT\n\n")
+
+	cues := 0
+	for _, block := range splitCueBlocks(text) {
+		timing := -1
+		for i, line := range block {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		// anything before the timing line is the cue number
+		if timing < 0 || timing > 1 {
+			continue
+		}
+
+		match := srtTimestampPattern.FindStringSubmatch(block[timing])
+		if match == nil {
+			return nil, rejectInvalid("Invalid SRT timestamp %q", block[timing])
+		}
+		start, end := srtSeconds(match[1:5]), srtSeconds(match[5:9])
+		if end < start {
+			return nil, rejectInvalid("SRT cue ends before it starts: %q", block[timing])
+		}
+
+		lines := []string{}
+		for _, line := range block[timing+1:] {
+			line = srtTagPattern.ReplaceAllString(line, "")
+			// the cue text can't contain the timing arrow
+			line = strings.ReplaceAll(line, "-->", "--&gt;")
+			if strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", vttTimestamp(start), vttTimestamp(end), strings.Join(lines, "\n"))
+		cues++
+	}
+
+	if cues == 0 {
+		return nil, rejectInvalid("No SRT cues found, captions must be SRT or WebVTT")
+	}
+	return b.Bytes(), nil
+}
+
+// splitCueBlocks splits text on blank lines, whitespace-only lines count as blank
+func splitCueBlocks(text string) [][]string {
+	blocks := [][]string{}
+	block := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = []string{}
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// srtSeconds reads hours, minutes, seconds and a fraction that may have fewer than 3 digits
+func srtSeconds(parts []string) float64 {
+	hours, _ := strconv.Atoi(parts[0])
+	minutes, _ := strconv.Atoi(parts[1])
+	seconds, _ := strconv.Atoi(parts[2])
+	millis := 0
+	if parts[3] != "" {
+		millis, _ = strconv.Atoi((parts[3] + "00")[:3])
+	}
+	return float64(hours*3600+minutes*60+seconds) + float64(millis)/1000
+}
+
+// storeCaption stores a WebVTT track and points the video's track for the language at it,
+// the object of the track it replaces is deleted
+func (cfg *apiConfig) storeCaption(ctx context.Context, videoID uuid.UUID, language, label string, autoGenerated bool, vtt []byte) (database.Caption, error) {
+	randomName := make([]byte, 8)
+	rand.Read(randomName)
+	key := fmt.Sprintf("%s%s/%s-%s.vtt", captionPrefix, videoID, language, hex.EncodeToString(randomName))
+
+	previous, err := cfg.db.GetCaption(videoID, language, autoGenerated)
+	if err != nil {
+		return database.Caption{}, err
+	}
+
+	err = cfg.db.CreateVideoObject(videoID, database.ObjectRef{Store: objectStoreName, Key: key})
+	if err != nil {
+		return database.Caption{}, fmt.Errorf("unable to record the caption track: %w", err)
+	}
+	err = cfg.store.Put(ctx, key, bytes.NewReader(vtt), "text/vtt")
+	if err != nil {
+		return database.Caption{}, fmt.Errorf("unable to store the caption track: %w", err)
+	}
+
+	caption, err := cfg.db.SaveCaption(database.SaveCaptionParams{
+		VideoID:       videoID,
+		Language:      language,
+		Label:         label,
+		AutoGenerated: autoGenerated,
+		ObjectKey:     key,
+		URL:           cfg.objectURL(key),
+	})
+	if err != nil {
+		return database.Caption{}, err
+	}
+
+	if previous != nil {
+		cfg.deleteCaptionObject(ctx, *previous)
+	}
+	return caption, nil
+}
+
+// deleteCaptionObject removes a track's object, a failure is left for the garbage collector
+func (cfg *apiConfig) deleteCaptionObject(ctx context.Context, caption database.Caption) {
+	ref := database.ObjectRef{Store: objectStoreName, Key: caption.ObjectKey}
+	if err := cfg.deleteObject(ctx, ref); err != nil {
+		log.Printf("Couldn't delete caption object %s: %v", caption.ObjectKey, err)
+		return
+	}
+	if err := cfg.db.DeleteVideoObjectsByRef(ref); err != nil {
+		log.Printf("Couldn't clear tracking rows for %s: %v", caption.ObjectKey, err)
+	}
+}
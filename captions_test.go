@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestToWebVTT(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "srt",
+			input: "\ufeff1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\n<font color=\"red\">world</font>\r\n\r\n2\r\n00:01:02,5 --> 00:01:04,250\r\n{\\an8}<i>Top</i> --> left\r\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\nworld\n\n00:01:02.500 --> 00:01:04.250\n<i>Top</i> --&gt; left\n\n",
+		},
+		{
+			name:  "srt without numbers and empty cues",
+			input: "0:00:03.1 --> 0:00:04.02\nNo index\n\n5\n00:00:05,000 --> 00:00:06,000\n   \n",
+			want:  "WEBVTT\n\n00:00:03.100 --> 00:00:04.020\nNo index\n\n",
+		},
+		{
+			name:  "webvtt passes through",
+			input: "WEBVTT - English\r\n\r\n00:01.000 --> 00:02.000\r\nHi\r\n",
+			want:  "WEBVTT - English\n\n00:01.000 --> 00:02.000\nHi\n",
+		},
+		{name: "bad webvtt header", input: "WEBVTTX\n\n", wantErr: true},
+		{name: "no cues", input: "just some text\n", wantErr: true},
+		{name: "bad timestamp", input: "1\nabc --> def\nHi\n", wantErr: true},
+		{name: "ends before start", input: "1\n00:00:05,000 --> 00:00:01,000\nHi\n", wantErr: true},
+		{name: "not utf-8", input: "1\n00:00:01,000 --> 00:00:02,000\nol\xe1\n", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := toWebVTT([]byte(tc.input))
+			if tc.wantErr {
+				if !isMediaRejection(err) {
+					t.Fatalf("err = %v, want a rejection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("toWebVTT() =\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCaptionLanguage(t *testing.T) {
+	tests := map[string]string{
+		"en":      "en",
+		"EN":      "en",
+		"pt_br":   "pt-BR",
+		"es-419":  "es-419",
+		"english": "",
+		"en-":     "",
+		"../en":   "",
+	}
+	for input, want := range tests {
+		got, ok := normalizeCaptionLanguage(input)
+		if got != want || ok != (want != "") {
+			t.Errorf("normalizeCaptionLanguage(%q) = %q, %v, want %q", input, got, ok, want)
+		}
+	}
+}
+
+func TestRewriteMasterPlaylist(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\n1080p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720\n720p/index.m3u8\n"
+	captions := []database.Caption{
+		{SaveCaptionParams: database.SaveCaptionParams{Language: "en", Label: "English"}},
+		{SaveCaptionParams: database.SaveCaptionParams{Language: "en-GB", Label: "English"}},
+	}
+
+	got := rewriteMasterPlaylist(master, captions)
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,URI="subs/en.m3u8"` + "\n" +
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English (en-GB)",LANGUAGE="en-GB",DEFAULT=NO,AUTOSELECT=YES,URI="subs/en-GB.m3u8"` + "\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,SUBTITLES=\"subs\"\n1080p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720,SUBTITLES=\"subs\"\n720p/index.m3u8\n"
+	if got != want {
+		t.Errorf("rewriteMasterPlaylist() =\n%s\nwant\n%s", got, want)
+	}
+
+	// rewriting again replaces the renditions rather than adding more, and no captions restores the original
+	if again := rewriteMasterPlaylist(got, captions); again != want {
+		t.Errorf("second rewrite =\n%s\nwant\n%s", again, want)
+	}
+	if cleared := rewriteMasterPlaylist(got, nil); cleared != master {
+		t.Errorf("rewrite without captions =\n%s\nwant\n%s", cleared, master)
+	}
+}
+
+// tsPacket builds a packet starting a PES with the given stream id and PTS
+func tsPacket(streamID byte, pts int64) []byte {
+	packet := make([]byte, 188)
+	copy(packet, []byte{0x47, 0x41, 0x00, 0x10, 0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05})
+	packet[13] = 0x21 | byte(pts>>29)&0x0e
+	packet[14] = byte(pts >> 22)
+	packet[15] = byte(pts>>14) | 0x01
+	packet[16] = byte(pts >> 7)
+	packet[17] = byte(pts<<1) | 0x01
+	return packet
+}
+
+func TestFirstTSTimestamp(t *testing.T) {
+	stream := append(tsPacket(0xE0, 1<<32+126000), tsPacket(0xC0, 120000)...)
+	// not audio or video, ignored
+	stream = append(stream, tsPacket(0xBD, 1000)...)
+
+	pts, ok, err := firstTSTimestamp(bytes.NewReader(stream))
+	if err != nil || !ok || pts != 120000 {
+		t.Errorf("firstTSTimestamp() = %d, %v, %v, want 120000", pts, ok, err)
+	}
+
+	if _, _, err := firstTSTimestamp(strings.NewReader(strings.Repeat("x", 188))); err == nil {
+		t.Error("no error for a stream without sync bytes")
+	}
+}
+
+func newCaptionRequest(t *testing.T, method, videoID, language, token, label, data string) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if label != "" {
+		form.WriteField("label", label)
+	}
+	if data != "" {
+		part, err := form.CreateFormFile("captions", "captions.srt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(data))
+	}
+	form.Close()
+
+	req := httptest.NewRequest(method, "/api/videos/"+videoID+"/captions/"+language, body)
+	req.SetPathValue("videoID", videoID)
+	req.SetPathValue("language", language)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestHandlerCaptions(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	video, token := newTestVideo(t, cfg)
+
+	// a processed video with a single rendition
+	hlsPrefix := "landscape/abc/hls/"
+	cfg.store.Put(ctx, hlsPrefix+hlsMasterPlaylist, strings.NewReader("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n360p/index.m3u8\n"), "")
+	cfg.store.Put(ctx, hlsPrefix+"360p/index.m3u8", strings.NewReader("#EXTM3U\n#EXTINF:6.0,\nsegment_000.ts\n#EXTINF:3.5,\nsegment_001.ts\n#EXT-X-ENDLIST\n"), "")
+	cfg.store.Put(ctx, hlsPrefix+"360p/segment_000.ts", bytes.NewReader(tsPacket(0xE0, 126000)), "")
+	playlistURL := cfg.objectURL(hlsPrefix + hlsMasterPlaylist)
+	video.PlaylistURL = &playlistURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	srt := "1\n00:00:01,000 --> 00:00:02,000\nHello\n"
+	w := httptest.NewRecorder()
+	cfg.handlerCaptionUpload(w, newCaptionRequest(t, http.MethodPut, video.ID.String(), "en_us", token, "English", srt))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	caption := database.Caption{}
+	json.NewDecoder(w.Body).Decode(&caption)
+	if caption.Language != "en-US" || caption.Label != "English" || caption.AutoGenerated {
+		t.Errorf("caption = %+v, want an uploaded en-US track labelled English", caption)
+	}
+	stored, err := cfg.getObjectText(ctx, strings.TrimPrefix(caption.URL, cfg.objectURL("")))
+	if err != nil || !strings.HasPrefix(stored, "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello") {
+		t.Errorf("stored track = %q, %v, want the converted WebVTT", stored, err)
+	}
+
+	master, _ := cfg.getObjectText(ctx, hlsPrefix+hlsMasterPlaylist)
+	if !strings.Contains(master, `URI="subs/en-US.m3u8"`) || !strings.Contains(master, `SUBTITLES="subs"`) {
+		t.Errorf("master playlist without the subtitle rendition:\n%s", master)
+	}
+	subs, _ := cfg.getObjectText(ctx, hlsPrefix+"subs/en-US.m3u8")
+	if !strings.Contains(subs, "#EXTINF:9.500,\nen-US.vtt") {
+		t.Errorf("subtitle playlist =\n%s\nwant one 9.5s segment", subs)
+	}
+	track, _ := cfg.getObjectText(ctx, hlsPrefix+"subs/en-US.vtt")
+	if !strings.HasPrefix(track, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000\n") {
+		t.Errorf("HLS track =\n%s\nwant a timestamp map of the first segment", track)
+	}
+
+	// replacing the track drops the old object
+	w = httptest.NewRecorder()
+	cfg.handlerCaptionUpload(w, newCaptionRequest(t, http.MethodPut, video.ID.String(), "en-US", token, "", "WEBVTT\n"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("replace status = %d: %s", w.Code, w.Body)
+	}
+	if _, err := cfg.store.Head(ctx, strings.TrimPrefix(caption.URL, cfg.objectURL(""))); err == nil {
+		t.Error("replaced track is still stored")
+	}
+
+	other, err := cfg.db.CreateUser(database.CreateUserParams{Email: "other@example.com", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := auth.MakeJWT(other.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantStatus int
+	}{
+		{"invalid captions", newCaptionRequest(t, http.MethodPut, video.ID.String(), "fr", token, "", "not captions"), http.StatusUnprocessableEntity},
+		{"invalid language", newCaptionRequest(t, http.MethodPut, video.ID.String(), "french", token, "", srt), http.StatusBadRequest},
+		{"missing file", newCaptionRequest(t, http.MethodPut, video.ID.String(), "fr", token, "French", ""), http.StatusBadRequest},
+		{"not the owner", newCaptionRequest(t, http.MethodPut, video.ID.String(), "fr", otherToken, "", srt), http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.handlerCaptionUpload(w, tc.req)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+		})
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerCaptionDelete(w, newCaptionRequest(t, http.MethodDelete, video.ID.String(), "en-US", token, "", ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+	captions, _ := cfg.db.GetCaptions(video.ID)
+	if len(captions) != 0 {
+		t.Errorf("captions after delete = %v", captions)
+	}
+	master, _ = cfg.getObjectText(ctx, hlsPrefix+hlsMasterPlaylist)
+	if strings.Contains(master, "SUBTITLES") {
+		t.Errorf("master playlist still has subtitles:\n%s", master)
+	}
+	if objects, _ := cfg.store.List(ctx, hlsPrefix+hlsSubtitlesDir); len(objects) != 0 {
+		t.Errorf("%d subtitle objects left after delete", len(objects))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// clipKeyframeTolerance is how far a clip may start from a keyframe and still be cut without re-encoding,
+	// the clip then starts on the keyframe
+	clipKeyframeTolerance = 0.05
+	clipMinDuration       = 0.5
+)
+
+// videoKeyframes lists the timestamps of the first video stream's keyframes from the packet index,
+// nothing has to be decoded
+func videoKeyframes(ctx context.Context, tools *toolRunner, filePath string) ([]float64, error) {
+	buf := bytes.Buffer{}
+	args := []string{
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0",
+		filePath,
+	}
+	err := tools.probe(ctx, args, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("listing keyframes of %v: %w", filePath, err)
+	}
+
+	keyframes := []float64{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		ptsTime, flags, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ",")
+		if !ok || !strings.Contains(flags, "K") {
+			continue
+		}
+		pts, err := strconv.ParseFloat(ptsTime, 64)
+		if err != nil {
+			// N/A for packets without a timestamp
+			continue
+		}
+		keyframes = append(keyframes, pts)
+	}
+	return keyframes, scanner.Err()
+}
+
+// cutClip writes start to end of filePath as an MP4. Stream copy is only frame accurate at keyframes,
+// elsewhere the clip is re-encoded.
+func cutClip(ctx context.Context, tools *toolRunner, filePath, outputPath string, start, end float64, streamCopy bool) error {
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-i", filePath,
+		"-t", strconv.FormatFloat(end-start, 'f', 3, 64),
+		"-map", "0:V:0",
+		"-map", "0:a:0?",
+	}
+	if streamCopy {
+		args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "medium", "-crf", "23", "-pix_fmt", "yuv420p", "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args, "-movflags", "faststart", "-f", "mp4", outputPath)
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cutting a clip from %v: %w", filePath, err)
+	}
+	return nil
+}
+
+// clipStreamCopyStart returns the keyframe a clip starting at start can be stream copied from
+func clipStreamCopyStart(keyframes []float64, start float64) (float64, bool) {
+	for _, keyframe := range keyframes {
+		if math.Abs(keyframe-start) <= clipKeyframeTolerance {
+			return keyframe, true
+		}
+	}
+	return 0, false
+}
+
+// cutClipFile cuts a clip of sourcePath into the spool directory and returns its path, the caller removes it
+func (cfg *apiConfig) cutClipFile(ctx context.Context, sourcePath string, start, end float64) (string, error) {
+	keyframes, err := cfg.media.Keyframes(ctx, sourcePath)
+	if err != nil {
+		return "", err
+	}
+	keyframe, streamCopy := clipStreamCopyStart(keyframes, start)
+	if streamCopy {
+		start = keyframe
+	}
+
+	clipPath := sourcePath + ".clip"
+	err = cfg.media.CutClip(ctx, sourcePath, clipPath, start, end, streamCopy)
+	if err != nil {
+		os.Remove(clipPath)
+		return "", err
+	}
+	return clipPath, nil
+}
+
+// parseClipTimestamp reads seconds ("90.5") or a clock time ("1:30.5", "00:01:30.500")
+func parseClipTimestamp(value string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	seconds := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) || (i > 0 && n >= 60) || (i < len(parts)-1 && n != math.Trunc(n)) {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseClipTimestamp(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    float64
+		wantErr bool
+	}{
+		{input: "90.5", want: 90.5},
+		{input: "1:30.5", want: 90.5},
+		{input: "01:01:30.250", want: 3690.25},
+		{input: "0", want: 0},
+		{input: "1:60", wantErr: true},
+		{input: "1.5:30", wantErr: true},
+		{input: "-3", wantErr: true},
+		{input: "NaN", wantErr: true},
+		{input: "1:2:3:4", wantErr: true},
+		{input: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClipTimestamp(tt.input)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseClipTimestamp(%q) = %v, %v, want %v (error %v)", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestClipRange(t *testing.T) {
+	ts := func(seconds float64) *clipTimestamp {
+		t := clipTimestamp(seconds)
+		return &t
+	}
+	tests := []struct {
+		name              string
+		start, end        *clipTimestamp
+		wantStart, wantTo float64
+		wantErr           error
+	}{
+		{name: "trim the start", start: ts(3), wantStart: 3, wantTo: 59.97},
+		{name: "trim the end", end: ts(50), wantStart: 0, wantTo: 50},
+		{name: "rounded end", start: ts(10), end: ts(60), wantStart: 10, wantTo: 59.97},
+		{name: "past the end", end: ts(75), wantErr: errClipPastEnd},
+		{name: "backwards", start: ts(20), end: ts(10), wantErr: errClipBackwards},
+		{name: "too short", start: ts(10), end: ts(10.2), wantErr: errClipTooShort},
+		{name: "whole video", wantErr: errClipWholeVideo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := clipRange(tt.start, tt.end, 59.97)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("clipRange() = %v, %v, %v, want %v", start, end, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || start != tt.wantStart || end != tt.wantTo {
+				t.Errorf("clipRange() = %v, %v, %v, want %v, %v", start, end, err, tt.wantStart, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestHandlerVideoClip(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		keyframes  []float64
+		wantStatus int
+		wantCut    string
+	}{
+		{name: "on a keyframe", body: `{"start": "0:02", "end": 8}`, keyframes: []float64{0, 2.002, 4}, wantStatus: http.StatusAccepted, wantCut: "clip-copy"},
+		{name: "between keyframes", body: `{"start": 3, "title": "Highlight"}`, keyframes: []float64{0, 2, 4}, wantStatus: http.StatusAccepted, wantCut: "clip-encode"},
+		{name: "past the end", body: `{"start": 3, "end": 30}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "bad timestamp", body: `{"start": "later"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			media := &fakeMediaProcessor{
+				keyframes: tt.keyframes,
+				probe: func(ctx context.Context, input string) (ffmpegData, error) {
+					return probeResult(1920, 1080, "10.0"), nil
+				},
+			}
+			cfg := newTestConfig(t, media)
+			parent, token := newTestVideo(t, cfg)
+
+			cfg.store.Put(ctx, "landscape/parent.mp4", bytes.NewReader(testMP4), "video/mp4")
+			videoURL := cfg.objectURL("landscape/parent.mp4")
+			duration := 10.0
+			parent.VideoURL = &videoURL
+			parent.DurationSeconds = &duration
+			if err := cfg.db.UpdateVideo(parent); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/videos/"+parent.ID.String()+"/clip", strings.NewReader(tt.body))
+			req.SetPathValue("videoID", parent.ID.String())
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			cfg.handlerVideoClip(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusAccepted {
+				return
+			}
+
+			resp := videoResponse{}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ParentVideoID == nil || *resp.ParentVideoID != parent.ID || resp.ID == parent.ID {
+				t.Fatalf("clip = %+v, want a new video with parent %s", resp.Video, parent.ID)
+			}
+
+			job, err := cfg.db.GetLatestJobForVideo(resp.ID)
+			if err != nil || job == nil || job.ClipStart == nil || job.ClipEnd == nil {
+				t.Fatalf("job = %+v, %v, want a queued clip job", job, err)
+			}
+			if job.SourceKey != "landscape/parent.mp4" || job.SourcePath != "" {
+				t.Fatalf("job source = %q, %q, want the parent's object", job.SourceKey, job.SourcePath)
+			}
+			if err := cfg.processVideoJob(ctx, *job); err != nil {
+				t.Fatalf("processVideoJob() error = %v", err)
+			}
+			// finishing the clip leaves the parent's file alone
+			cfg.removeJobSource(ctx, *job)
+			if _, err := cfg.store.Get(ctx, "landscape/parent.mp4"); err != nil {
+				t.Errorf("parent object after the clip job: %v", err)
+			}
+			if media.callCount(tt.wantCut) != 1 {
+				t.Errorf("calls = %v, want one %s", media.calls, tt.wantCut)
+			}
+
+			clip, err := cfg.db.GetVideo(resp.ID)
+			if err != nil || clip.VideoURL == nil || *clip.VideoURL == videoURL {
+				t.Errorf("clip video url = %v, %v, want a new object", clip.VideoURL, err)
+			}
+
+			// the parent can go without taking its clips along
+			if _, err := cfg.db.DeleteVideoAndQueueObjects(parent.ID, nil); err != nil {
+				t.Fatal(err)
+			}
+			clip, _ = cfg.db.GetVideo(resp.ID)
+			if clip.ID != resp.ID || clip.ParentVideoID != nil {
+				t.Errorf("clip after deleting its parent = %+v", clip)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const dashManifest = "manifest.mpd"
+
+// packageDASH encodes the same rendition ladder as HLS into fMP4 segments described by a single MPD
+func packageDASH(ctx context.Context, tools *toolRunner, filePath, outputDir string, width, height int, hasAudio bool) error {
+	renditions := renditionsFor(width, height)
+
+	args := []string{"-i", filePath}
+	args = append(args, renditionVideoArgs(renditions, height > width)...)
+
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		// one audio representation is shared by every video representation
+		args = append(args,
+			"-map", "0:a:0",
+			"-c:a", "aac",
+			"-b:a", renditions[0].audioBitrate,
+		)
+		adaptationSets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-f", "dash",
+		"-seg_duration", "6",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(outputDir, dashManifest),
+	)
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("packaging %v as DASH: %w", filePath, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, dashManifest)); err != nil {
+		return fmt.Errorf("DASH manifest missing after packaging: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type gcOptions struct {
+	gracePeriod time.Duration
+	dryRun      bool
+}
+
+type gcObject struct {
+	Store        string    `json:"store"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type gcReport struct {
+	DryRun      bool       `json:"dry_run"`
+	GracePeriod string     `json:"grace_period"`
+	Scanned     int        `json:"scanned"`
+	Referenced  int        `json:"referenced"`
+	TooRecent   int        `json:"too_recent"`
+	Orphaned    []gcObject `json:"orphaned"`
+	Deleted     int        `json:"deleted"`
+	Failed      int        `json:"failed"`
+}
+
+type objectRefSet struct {
+	keys     map[database.ObjectRef]bool
+	prefixes []database.ObjectRef
+}
+
+func (s *objectRefSet) add(ref database.ObjectRef) {
+	if ref.Prefix {
+		s.prefixes = append(s.prefixes, ref)
+		return
+	}
+	s.keys[ref] = true
+}
+
+func (s *objectRefSet) contains(ref database.ObjectRef) bool {
+	if s.keys[ref] {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if prefix.Store == ref.Store && strings.HasPrefix(ref.Key, prefix.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedObjects is every object a row in the videos, captions or watermarks table still points at,
+// along with the sources of jobs that haven't finished
+func (cfg *apiConfig) referencedObjects() (*objectRefSet, error) {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := &objectRefSet{keys: map[database.ObjectRef]bool{}}
+	for _, video := range videos {
+		for _, ref := range cfg.currentVideoRefs(video) {
+			referenced.add(ref)
+		}
+	}
+
+	captions, err := cfg.db.GetAllCaptions()
+	if err != nil {
+		return nil, err
+	}
+	for _, caption := range captions {
+		referenced.add(database.ObjectRef{Store: objectStoreName, Key: caption.ObjectKey})
+	}
+
+	watermarks, err := cfg.db.GetAllWatermarks()
+	if err != nil {
+		return nil, err
+	}
+	for _, watermark := range watermarks {
+		referenced.add(database.ObjectRef{Store: objectStoreName, Key: watermark.ImageKey})
+	}
+
+	// a job's source may wait in the store past the grace period while the job is queued or retried
+	sourceKeys, err := cfg.db.GetUnfinishedJobSourceKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range sourceKeys {
+		referenced.add(database.ObjectRef{Store: objectStoreName, Key: key})
+	}
+
+	// objects already queued for deletion are handled by runPendingDeletions
+	pending, err := cfg.db.GetPendingDeletionRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range pending {
+		referenced.add(ref)
+	}
+	return referenced, nil
+}
+
+func (cfg *apiConfig) collectGarbage(ctx context.Context, opts gcOptions) (gcReport, error) {
+	report := gcReport{
+		DryRun:      opts.dryRun,
+		GracePeriod: opts.gracePeriod.String(),
+		Orphaned:    []gcObject{},
+	}
+
+	referenced, err := cfg.referencedObjects()
+	if err != nil {
+		return gcReport{}, err
+	}
+
+	cutoff := time.Now().Add(-opts.gracePeriod)
+	for _, storeName := range []string{objectStoreName, assetStoreName} {
+		store, err := cfg.storeByName(storeName)
+		if err != nil {
+			return gcReport{}, err
+		}
+		objects, err := store.List(ctx, "")
+		if err != nil {
+			return gcReport{}, err
+		}
+
+		for _, obj := range objects {
+			report.Scanned++
+			ref := database.ObjectRef{Store: storeName, Key: obj.Key}
+			if referenced.contains(ref) {
+				report.Referenced++
+				continue
+			}
+			// uploads write the object before the row points at it, so leave fresh objects alone
+			if obj.LastModified.After(cutoff) {
+				report.TooRecent++
+				continue
+			}
+
+			report.Orphaned = append(report.Orphaned, gcObject{
+				Store:        storeName,
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			})
+			if opts.dryRun {
+				continue
+			}
+
+			if err := cfg.deleteObject(ctx, ref); err != nil {
+				report.Failed++
+				log.Printf("Couldn't garbage collect %s object %s: %v", storeName, obj.Key, err)
+				continue
+			}
+			if err := cfg.db.DeleteVideoObjectsByRef(ref); err != nil {
+				log.Printf("Couldn't clear tracking rows for %s: %v", obj.Key, err)
+			}
+			report.Deleted++
+		}
+	}
+
+	return report, nil
+}
+
+func (cfg *apiConfig) runGarbageCollector(ctx context.Context, interval time.Duration, opts gcOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := cfg.collectGarbage(ctx, opts)
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+			continue
+		}
+		for _, obj := range report.Orphaned {
+			log.Printf("Orphaned %s object %s (%d bytes, last modified %s)", obj.Store, obj.Key, obj.Size, obj.LastModified.Format(time.RFC3339))
+		}
+		log.Printf("Garbage collection scanned %d objects: %d orphaned, %d deleted, %d failed (dry run: %v)",
+			report.Scanned, len(report.Orphaned), report.Deleted, report.Failed, report.DryRun)
+	}
+}
+
+func (cfg *apiConfig) handlerAdminGC(w http.ResponseWriter, r *http.Request) {
+	if !cfg.isAdminRequest(r) {
+		respondWithError(w, http.StatusForbidden, "Admin access required", nil)
+		return
+	}
+
+	opts := cfg.gcOptions
+	if dryRun := r.URL.Query().Get("dry_run"); dryRun != "" {
+		opts.dryRun = dryRun == "true" || dryRun == "1"
+	}
+	if gracePeriod := r.URL.Query().Get("grace_period"); gracePeriod != "" {
+		d, err := time.ParseDuration(gracePeriod)
+		if err != nil || d < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid grace_period, expects a duration like 24h", err)
+			return
+		}
+		opts.gracePeriod = d
+	}
+
+	report, err := cfg.collectGarbage(r.Context(), opts)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't collect garbage", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// isAdminRequest allows everything in dev, otherwise an ApiKey matching ADMIN_API_KEY is required
+func (cfg *apiConfig) isAdminRequest(r *http.Request) bool {
+	if cfg.platform == "dev" {
+		return true
+	}
+	if cfg.adminAPIKey == "" {
+		return false
+	}
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminAPIKey)) == 1
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	video, _ := newTestVideo(t, cfg)
+
+	for _, key := range []string{"landscape/video.mp4", "landscape/video/hls/master.m3u8", "orphan.mp4", "uploads/queued", "uploads/done"} {
+		cfg.store.Put(ctx, key, bytes.NewReader([]byte("data")), "")
+	}
+	videoURL := cfg.objectURL("landscape/video.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	// a source waiting for its job is still needed, one whose job finished is not
+	if _, err := cfg.db.CreateJob(database.CreateJobParams{VideoID: video.ID, SourceKey: "uploads/queued", MediaType: "video/mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	done, err := cfg.db.CreateJob(database.CreateJobParams{VideoID: video.ID, SourceKey: "uploads/done", MediaType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.MarkJobReady(done.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	orphaned := func(report gcReport) []string {
+		keys := []string{}
+		for _, obj := range report.Orphaned {
+			keys = append(keys, obj.Key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	stored := func() int {
+		objects, err := cfg.store.List(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(objects)
+	}
+
+	// everything was just written, the grace period covers it
+	report, err := cfg.collectGarbage(ctx, gcOptions{gracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 5 || report.Referenced != 3 || report.TooRecent != 2 || len(report.Orphaned) != 0 {
+		t.Errorf("report = %+v, want the 2 orphans left alone as too recent", report)
+	}
+
+	report, err = cfg.collectGarbage(ctx, gcOptions{dryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := orphaned(report); len(got) != 2 || got[0] != "orphan.mp4" || got[1] != "uploads/done" || report.Deleted != 0 {
+		t.Errorf("dry run orphaned %v, deleted %d, want orphan.mp4 and uploads/done reported only", got, report.Deleted)
+	}
+	if stored() != 5 {
+		t.Error("dry run deleted objects")
+	}
+
+	report, err = cfg.collectGarbage(ctx, gcOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 2 || report.Failed != 0 || stored() != 3 {
+		t.Errorf("report = %+v with %d objects left, want the 2 orphans deleted", report, stored())
+	}
+	if _, err := cfg.store.Get(ctx, "uploads/queued"); err != nil {
+		t.Errorf("queued job's source: %v", err)
+	}
+}
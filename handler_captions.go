@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const captionLabelMaxLength = 100
+
+func (cfg *apiConfig) handlerCaptionsList(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, captions)
+}
+
+// handlerCaptionUpload adds or replaces the uploaded caption track of a language, SRT is converted to WebVTT
+func (cfg *apiConfig) handlerCaptionUpload(w http.ResponseWriter, r *http.Request) {
+	video, language, ok := cfg.captionRequestVideo(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, captionUploadLimit+1<<10)
+	if err := r.ParseMultipartForm(captionUploadLimit); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse the form, captions are limited to 2MB", err)
+		return
+	}
+
+	label := strings.TrimSpace(r.FormValue("label"))
+	if label == "" {
+		label = language
+	}
+	if len(label) > captionLabelMaxLength || strings.IndexFunc(label, unicode.IsControl) >= 0 {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Labels are at most %d characters on one line", captionLabelMaxLength), nil)
+		return
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, captionUploadLimit+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to read the captions file", err)
+		return
+	}
+	if len(data) > captionUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Captions file is too large", nil)
+		return
+	}
+
+	vtt, err := toWebVTT(data)
+	if err != nil {
+		respondWithRejection(w, "Unable to read the captions file", err)
+		return
+	}
+
+	caption, err := cfg.storeCaption(r.Context(), video.ID, language, label, false, vtt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store the captions", err)
+		return
+	}
+
+	if err := cfg.publishHLSSubtitles(r.Context(), video); err != nil {
+		log.Printf("Couldn't add subtitles to the HLS playlist of video %s: %v", video.ID, err)
+	}
+
+	respondWithJSON(w, http.StatusOK, caption)
+}
+
+func (cfg *apiConfig) handlerCaptionDelete(w http.ResponseWriter, r *http.Request) {
+	video, language, ok := cfg.captionRequestVideo(w, r)
+	if !ok {
+		return
+	}
+
+	caption, err := cfg.db.GetCaption(video.ID, language, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption == nil {
+		respondWithError(w, http.StatusNotFound, "No captions for this language", nil)
+		return
+	}
+
+	if err := cfg.db.DeleteCaption(caption.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions", err)
+		return
+	}
+	cfg.deleteCaptionObject(r.Context(), *caption)
+
+	if err := cfg.publishHLSSubtitles(r.Context(), video); err != nil {
+		log.Printf("Couldn't remove subtitles from the HLS playlist of video %s: %v", video.ID, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// captionRequestVideo authenticates a caption change and returns the video and the normalized language,
+// it has responded when ok is false
+func (cfg *apiConfig) captionRequestVideo(w http.ResponseWriter, r *http.Request) (database.Video, string, bool) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, "", false
+	}
+	language, ok := normalizeCaptionLanguage(r.PathValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid language, expects a tag like en or pt-BR", nil)
+		return database.Video{}, "", false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, "", false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, "", false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, "", false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, "", false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't change this video's captions", nil)
+		return database.Video{}, "", false
+	}
+	return video, language, true
+}
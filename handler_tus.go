@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// tus 1.0 resumable uploads, see https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusBasePath   = "/api/tus/"
+)
+
+var tusUploadLocks sync.Map
+
+// lockTusUpload serializes PATCH requests for one upload, a second client resuming
+// at the same time must not interleave writes with the first
+func lockTusUpload(id uuid.UUID) func() {
+	lock, _ := tusUploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported Tus-Resumable version, expects "+tusVersion, nil)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes the Upload-Metadata header: comma separated "key base64(value)" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			metadata[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata value for %q isn't base64: %w", parts[0], err)
+			}
+			metadata[parts[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("malformed metadata pair %q", pair)
+		}
+	}
+	return metadata, nil
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(videoUploadLimit, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	uploadLength, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || uploadLength <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length header must be a positive integer", err)
+		return
+	}
+	if uploadLength > videoUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload exceeds Tus-Max-Size", nil)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata header", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must include a valid video_id", err)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(metadata["filetype"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must include the filetype", err)
+		return
+	}
+	if !isSupportedVideoType(mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type, expects "+supportedVideoFormats, nil)
+		return
+	}
+
+	videoMetaData, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Could not find video metadata for that videoID", err)
+		return
+	}
+	if videoMetaData.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update video", nil)
+		return
+	}
+
+	spoolPath, err := cfg.spoolUpload(strings.NewReader(""))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+
+	upload, err := cfg.db.CreateTusUpload(database.CreateTusUploadParams{
+		VideoID:      videoID,
+		UserID:       userID,
+		UploadLength: uploadLength,
+		MediaType:    mediaType,
+		FilePath:     spoolPath,
+		ExpiresAt:    time.Now().Add(cfg.uploadExpiry),
+	})
+	if err != nil {
+		os.Remove(spoolPath)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", tusBasePath+upload.ID.String())
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusUploadForRequest loads the upload named in the path and checks that it belongs to the caller
+func (cfg *apiConfig) tusUploadForRequest(w http.ResponseWriter, r *http.Request) (*database.TusUpload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return nil, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return nil, false
+	}
+
+	upload, err := cfg.db.GetTusUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return nil, false
+	}
+	if upload == nil || upload.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return nil, false
+	}
+	if upload.CompletedAt == nil && time.Now().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload expired", nil)
+		return nil, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.tusUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Offset header must be a non-negative integer", err)
+		return
+	}
+
+	upload, ok := cfg.tusUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := lockTusUpload(upload.ID)
+	defer unlock()
+
+	// reload under the lock, a concurrent PATCH may have moved the offset
+	upload, err = cfg.db.GetTusUpload(upload.ID)
+	if err != nil || upload == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload.CompletedAt != nil {
+		respondWithError(w, http.StatusForbidden, "Upload already completed", nil)
+		return
+	}
+	if clientOffset != upload.UploadOffset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the server's offset", nil)
+		return
+	}
+
+	cfg.reportUploadBody(r, upload.VideoID, upload.UploadOffset, upload.UploadLength)
+	written, writeErr := appendTusChunk(upload.FilePath, upload.UploadOffset, r.Body, upload.UploadLength-upload.UploadOffset)
+	newOffset := upload.UploadOffset + written
+
+	// keep whatever made it to disk even if the client went away mid-chunk, that's the point of resuming
+	if err := cfg.db.UpdateTusUploadOffset(upload.ID, newOffset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	if writeErr != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write upload chunk", writeErr)
+		return
+	}
+
+	if newOffset == upload.UploadLength {
+		mediaType, err := cfg.validateSpooledVideo(r.Context(), upload.FilePath)
+		if err != nil {
+			if isMediaRejection(err) {
+				// a rejected upload can't be fixed by resuming it, drop it
+				os.Remove(upload.FilePath)
+				if err := cfg.db.DeleteTusUpload(upload.ID); err != nil {
+					log.Printf("Couldn't delete rejected tus upload %s: %v", upload.ID, err)
+				}
+				cfg.progress.publish(upload.VideoID, rejectedEvent(err))
+			}
+			respondWithRejection(w, "Unable to check the video file", err)
+			return
+		}
+
+		// a failure leaves the upload unfinished, the client's retry of this PATCH queues it again
+		_, err = cfg.db.CompleteTusUploadAndCreateJob(upload.ID, database.CreateJobParams{
+			VideoID:     upload.VideoID,
+			SourcePath:  upload.FilePath,
+			MediaType:   mediaType,
+			MaxAttempts: cfg.jobMaxAttempts,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to queue the video for processing", err)
+			return
+		}
+		cfg.jobQueued(upload.VideoID)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendTusChunk writes at most remaining bytes from body at offset, dropping anything
+// past offset left behind by an earlier request that died before its offset was saved
+func appendTusChunk(filePath string, offset int64, body io.Reader, remaining int64) (int64, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(file, io.LimitReader(body, remaining))
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+	return written, err
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.tusUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := lockTusUpload(upload.ID)
+	defer unlock()
+
+	// reload under the lock, the final PATCH may have queued the upload meanwhile
+	upload, err := cfg.db.GetTusUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload == nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+	if upload.CompletedAt != nil {
+		respondWithError(w, http.StatusForbidden, "Upload already completed", nil)
+		return
+	}
+
+	err = cfg.db.DeleteTusUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	os.Remove(upload.FilePath)
+	tusUploadLocks.Delete(upload.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireTusUploads drops expired uploads, unfinished ones take their partial file with them
+func (cfg *apiConfig) expireTusUploads() {
+	uploads, err := cfg.db.GetExpiredTusUploads(time.Now())
+	if err != nil {
+		log.Printf("Couldn't load expired tus uploads: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		unlock := lockTusUpload(upload.ID)
+		if upload.CompletedAt == nil {
+			// completed uploads belong to their processing job now
+			err := os.Remove(upload.FilePath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Couldn't remove expired upload file %s: %v", filepath.Base(upload.FilePath), err)
+			}
+		}
+		if err := cfg.db.DeleteTusUpload(upload.ID); err != nil {
+			log.Printf("Couldn't delete expired tus upload %s: %v", upload.ID, err)
+		}
+		unlock()
+		tusUploadLocks.Delete(upload.ID)
+	}
+}
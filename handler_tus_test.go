@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHandlerTus(t *testing.T) {
+	media := &fakeMediaProcessor{
+		probe: func(ctx context.Context, input string) (ffmpegData, error) {
+			return probeResult(1920, 1080, "10.0"), nil
+		},
+	}
+	cfg := newTestConfig(t, media)
+	cfg.uploadExpiry = time.Hour
+	video, token := newTestVideo(t, cfg)
+
+	tusRequest := func(method, path string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.SetPathValue("uploadID", strings.TrimPrefix(path, tusBasePath))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Authorization", "Bearer "+token)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		switch method {
+		case http.MethodPost:
+			cfg.handlerTusCreate(w, req)
+		case http.MethodHead:
+			cfg.handlerTusHead(w, req)
+		case http.MethodPatch:
+			cfg.handlerTusPatch(w, req)
+		case http.MethodDelete:
+			cfg.handlerTusDelete(w, req)
+		}
+		return w
+	}
+	create := func() string {
+		t.Helper()
+		metadata := "video_id " + base64.StdEncoding.EncodeToString([]byte(video.ID.String())) +
+			",filetype " + base64.StdEncoding.EncodeToString([]byte("video/mp4"))
+		w := tusRequest(http.MethodPost, tusBasePath, map[string]string{
+			"Upload-Length":   strconv.Itoa(len(testMP4)),
+			"Upload-Metadata": metadata,
+		}, nil)
+		if w.Code != http.StatusCreated || w.Header().Get("Upload-Offset") != "0" {
+			t.Fatalf("create status = %d, offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+		}
+		return w.Header().Get("Location")
+	}
+	patch := func(location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		return tusRequest(http.MethodPatch, location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, chunk)
+	}
+
+	if w := tusRequest(http.MethodPost, tusBasePath, map[string]string{"Upload-Length": "10"}, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("create without metadata status = %d, want 400", w.Code)
+	}
+
+	location := create()
+	half := len(testMP4) / 2
+	if w := patch(location, 0, testMP4[:half]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk status = %d, offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+
+	// a client that lost track of the offset is told where the server is
+	w := patch(location, 0, testMP4)
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("mismatched offset status = %d, offset %q, want 409 at %d", w.Code, w.Header().Get("Upload-Offset"), half)
+	}
+
+	// and resumes from what HEAD reports
+	w = tusRequest(http.MethodHead, location, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != strconv.Itoa(half) || w.Header().Get("Upload-Length") != strconv.Itoa(len(testMP4)) {
+		t.Fatalf("head status = %d, headers %v", w.Code, w.Header())
+	}
+	if w := patch(location, half, testMP4[half:]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(len(testMP4)) {
+		t.Fatalf("last chunk status = %d: %s", w.Code, w.Body)
+	}
+
+	// a retried final PATCH doesn't queue the upload again
+	if w := patch(location, len(testMP4), nil); w.Code != http.StatusForbidden {
+		t.Errorf("repeated final chunk status = %d, want 403", w.Code)
+	}
+	if w := tusRequest(http.MethodDelete, location, nil, nil); w.Code != http.StatusForbidden {
+		t.Errorf("delete after completing status = %d, want 403", w.Code)
+	}
+	job, err := cfg.db.ClaimNextJob(time.Now())
+	if err != nil || job == nil || job.VideoID != video.ID || job.MediaType != "video/mp4" {
+		t.Fatalf("job = %+v, %v, want the upload queued", job, err)
+	}
+	if data, err := os.ReadFile(job.SourcePath); err != nil || !bytes.Equal(data, testMP4) {
+		t.Errorf("queued source = %d bytes, %v, want the whole upload", len(data), err)
+	}
+	if job, err := cfg.db.ClaimNextJob(time.Now()); err != nil || job != nil {
+		t.Errorf("second job = %+v, %v, want exactly one", job, err)
+	}
+
+	// an unfinished upload can be dropped
+	location = create()
+	if w := patch(location, 0, testMP4[:half]); w.Code != http.StatusNoContent {
+		t.Fatalf("chunk status = %d: %s", w.Code, w.Body)
+	}
+	upload, _ := cfg.db.GetTusUpload(uuid.MustParse(strings.TrimPrefix(location, tusBasePath)))
+	if w := tusRequest(http.MethodDelete, location, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(upload.FilePath); !os.IsNotExist(err) {
+		t.Errorf("partial file after delete: %v", err)
+	}
+	if w := tusRequest(http.MethodHead, location, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("head after delete status = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	multipartMinPartSize = 16 << 20
+	multipartMaxParts    = 10000
+	multipartURLExpiry   = time.Hour
+)
+
+type multipartPart struct {
+	PartNumber int32  `json:"part_number"`
+	URL        string `json:"url,omitempty"`
+	ETag       string `json:"etag,omitempty"`
+}
+
+// multipartPartSize keeps every part above S3's 5 MiB minimum and under its 10,000 part cap
+func multipartPartSize(size int64) int64 {
+	partSize := int64(multipartMinPartSize)
+	for (size+partSize-1)/partSize > multipartMaxParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// multipartVideoForRequest authenticates the caller and checks they own the video in the path
+func (cfg *apiConfig) multipartVideoForRequest(w http.ResponseWriter, r *http.Request) (database.Video, storage.MultipartStore, bool) {
+	multipartStore, ok := cfg.store.(storage.MultipartStore)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads aren't supported by the configured storage backend", nil)
+		return database.Video{}, nil, false
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, nil, false
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, nil, false
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Could not find video metadata for that videoID", err)
+		return database.Video{}, nil, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update video", nil)
+		return database.Video{}, nil, false
+	}
+	return video, multipartStore, true
+}
+
+// multipartUploadForRequest loads the upload in the path and checks it belongs to the video
+func (cfg *apiConfig) multipartUploadForRequest(w http.ResponseWriter, r *http.Request, video database.Video) (*database.MultipartUpload, bool) {
+	upload, err := cfg.db.GetMultipartUpload(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return nil, false
+	}
+	if upload == nil || upload.VideoID != video.ID || upload.UserID != video.UserID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return nil, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerMultipartCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	type response struct {
+		UploadID string          `json:"upload_id"`
+		Key      string          `json:"key"`
+		PartSize int64           `json:"part_size"`
+		Parts    []multipartPart `json:"parts"`
+	}
+
+	video, multipartStore, ok := cfg.multipartVideoForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// browsers leave the type empty for files they don't recognise (mkv on most systems),
+	// the content is sniffed once the upload completes either way
+	mediaType := ""
+	if params.ContentType != "" {
+		mediaType, _, err = mime.ParseMediaType(params.ContentType)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to parse content_type", err)
+			return
+		}
+	}
+	if mediaType != "" && !isSupportedVideoType(mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type, expects "+supportedVideoFormats, nil)
+		return
+	}
+	if params.Size <= 0 || params.Size > videoUploadLimit {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d bytes", videoUploadLimit), nil)
+		return
+	}
+
+	randomName := make([]byte, 32)
+	rand.Read(randomName)
+	key := fmt.Sprintf("uploads/%s/%s", video.ID, base64.RawURLEncoding.EncodeToString(randomName))
+
+	uploadID, err := multipartStore.CreateMultipartUpload(r.Context(), key, mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start the upload", err)
+		return
+	}
+
+	err = cfg.db.CreateMultipartUpload(database.CreateMultipartUploadParams{
+		UploadID:  uploadID,
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		ObjectKey: key,
+		MediaType: mediaType,
+		Size:      params.Size,
+	})
+	if err != nil {
+		multipartStore.AbortMultipartUpload(r.Context(), key, uploadID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record the upload", err)
+		return
+	}
+
+	partSize := multipartPartSize(params.Size)
+	partCount := (params.Size + partSize - 1) / partSize
+	parts := make([]multipartPart, 0, partCount)
+	for i := int32(1); int64(i) <= partCount; i++ {
+		url, err := multipartStore.PresignUploadPart(r.Context(), key, uploadID, i, multipartURLExpiry)
+		if err != nil {
+			if err := multipartStore.AbortMultipartUpload(r.Context(), key, uploadID); err != nil {
+				// the row stays for abortStaleMultipartUploads to try again
+				log.Printf("Couldn't abort multipart upload %s: %v", uploadID, err)
+			} else if err := cfg.db.DeleteMultipartUpload(uploadID); err != nil {
+				log.Printf("Couldn't delete multipart upload %s: %v", uploadID, err)
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload parts", err)
+			return
+		}
+		parts = append(parts, multipartPart{PartNumber: i, URL: url})
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID: uploadID,
+		Key:      key,
+		PartSize: partSize,
+		Parts:    parts,
+	})
+}
+
+func (cfg *apiConfig) handlerMultipartComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Parts []multipartPart `json:"parts"`
+	}
+
+	video, multipartStore, ok := cfg.multipartVideoForRequest(w, r)
+	if !ok {
+		return
+	}
+	upload, ok := cfg.multipartUploadForRequest(w, r, video)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.Parts) == 0 {
+		respondWithError(w, http.StatusBadRequest, "parts must list the ETag of every uploaded part", nil)
+		return
+	}
+
+	sort.Slice(params.Parts, func(i, j int) bool {
+		return params.Parts[i].PartNumber < params.Parts[j].PartNumber
+	})
+	completed := make([]storage.CompletedPart, 0, len(params.Parts))
+	for _, part := range params.Parts {
+		if part.ETag == "" {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("part %d is missing its etag", part.PartNumber), nil)
+			return
+		}
+		completed = append(completed, storage.CompletedPart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	err = multipartStore.CompleteMultipartUpload(r.Context(), upload.ObjectKey, upload.UploadID, completed)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't complete the upload, check the part ETags", err)
+		return
+	}
+
+	// the upload ID is spent once the object is assembled, a failure from here on can't be retried
+	discard := func() {
+		cfg.discardCompletedMultipartUpload(r.Context(), *upload)
+	}
+
+	info, err := cfg.store.Head(r.Context(), upload.ObjectKey)
+	if err != nil {
+		discard()
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read the uploaded object", err)
+		return
+	}
+	if info.Size > videoUploadLimit {
+		discard()
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Uploaded video is too large", nil)
+		return
+	}
+
+	mediaType, err := cfg.validateStoredVideo(r.Context(), upload.ObjectKey)
+	if err != nil {
+		discard()
+		if isMediaRejection(err) {
+			cfg.progress.publish(video.ID, rejectedEvent(err))
+		}
+		respondWithRejection(w, "Unable to check the uploaded video", err)
+		return
+	}
+
+	job, err := cfg.enqueueVideoJob(database.CreateJobParams{
+		VideoID:   video.ID,
+		SourceKey: upload.ObjectKey,
+		MediaType: mediaType,
+	})
+	if err != nil {
+		discard()
+		respondWithError(w, http.StatusInternalServerError, "Unable to queue the video for processing", err)
+		return
+	}
+
+	if err := cfg.db.DeleteMultipartUpload(upload.UploadID); err != nil {
+		log.Printf("Couldn't clear completed multipart upload %s: %v", upload.UploadID, err)
+	}
+
+	respondWithJSON(w, http.StatusAccepted, newVideoResponse(video, &job))
+}
+
+func (cfg *apiConfig) handlerMultipartAbort(w http.ResponseWriter, r *http.Request) {
+	video, multipartStore, ok := cfg.multipartVideoForRequest(w, r)
+	if !ok {
+		return
+	}
+	upload, ok := cfg.multipartUploadForRequest(w, r, video)
+	if !ok {
+		return
+	}
+
+	err := multipartStore.AbortMultipartUpload(r.Context(), upload.ObjectKey, upload.UploadID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't abort the upload", err)
+		return
+	}
+	err = cfg.db.DeleteMultipartUpload(upload.UploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete the upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// abortStaleMultipartUploads cleans up direct uploads a client started and never finished
+func (cfg *apiConfig) abortStaleMultipartUploads(ctx context.Context, maxAge time.Duration) {
+	multipartStore, ok := cfg.store.(storage.MultipartStore)
+	if !ok {
+		return
+	}
+
+	uploads, err := cfg.db.GetMultipartUploadsCreatedBefore(time.Now().Add(-maxAge))
+	if err != nil {
+		log.Printf("Couldn't load stale multipart uploads: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		// an upload the store no longer knows was already completed or aborted, only the row is left
+		err := multipartStore.AbortMultipartUpload(ctx, upload.ObjectKey, upload.UploadID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Couldn't abort stale multipart upload %s: %v", upload.UploadID, err)
+			continue
+		}
+		if err := cfg.db.DeleteMultipartUpload(upload.UploadID); err != nil {
+			log.Printf("Couldn't delete stale multipart upload %s: %v", upload.UploadID, err)
+		}
+	}
+}
+
+// discardCompletedMultipartUpload removes an assembled object that won't be processed along with its row,
+// the garbage collector picks up an object that can't be deleted now
+func (cfg *apiConfig) discardCompletedMultipartUpload(ctx context.Context, upload database.MultipartUpload) {
+	err := cfg.deleteObject(ctx, database.ObjectRef{Store: objectStoreName, Key: upload.ObjectKey})
+	if err != nil {
+		log.Printf("Couldn't delete uploaded object %s: %v", upload.ObjectKey, err)
+	}
+	if err := cfg.db.DeleteMultipartUpload(upload.UploadID); err != nil {
+		log.Printf("Couldn't delete multipart upload %s: %v", upload.UploadID, err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// fakeMultipartStore assembles testMP4 on completion and knows only the uploads in open
+type fakeMultipartStore struct {
+	storage.ObjectStore
+	open       map[string]bool
+	created    int
+	abortErr   error
+	partErr    error
+	presignErr error
+}
+
+func (s *fakeMultipartStore) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	s.created++
+	uploadID := fmt.Sprintf("created-%d", s.created)
+	s.open[uploadID] = true
+	return uploadID, nil
+}
+
+func (s *fakeMultipartStore) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, expires time.Duration) (string, error) {
+	if s.partErr != nil {
+		return "", s.partErr
+	}
+	return fmt.Sprintf("http://objects.test/%s?uploadId=%s&partNumber=%d", key, uploadID, partNumber), nil
+}
+
+func (s *fakeMultipartStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []storage.CompletedPart) error {
+	if !s.open[uploadID] {
+		return storage.ErrNotFound
+	}
+	delete(s.open, uploadID)
+	return s.ObjectStore.Put(ctx, key, bytes.NewReader(testMP4), "video/mp4")
+}
+
+func (s *fakeMultipartStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	if s.abortErr != nil {
+		return s.abortErr
+	}
+	if !s.open[uploadID] {
+		return storage.ErrNotFound
+	}
+	delete(s.open, uploadID)
+	return nil
+}
+
+func (s *fakeMultipartStore) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if s.presignErr != nil {
+		return "", s.presignErr
+	}
+	return s.ObjectStore.PresignGet(ctx, key, expires)
+}
+
+func newTestMultipartUpload(t *testing.T, cfg *apiConfig, video database.Video, uploadID string) {
+	t.Helper()
+	err := cfg.db.CreateMultipartUpload(database.CreateMultipartUploadParams{
+		UploadID:  uploadID,
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		ObjectKey: "uploads/" + uploadID,
+		MediaType: "video/mp4",
+		Size:      int64(len(testMP4)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbortStaleMultipartUploads(t *testing.T) {
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	store := &fakeMultipartStore{ObjectStore: cfg.store, open: map[string]bool{"open": true}}
+	cfg.store = store
+	video, _ := newTestVideo(t, cfg)
+	newTestMultipartUpload(t, cfg, video, "open")
+	newTestMultipartUpload(t, cfg, video, "completed")
+
+	// a store that can't be reached keeps the rows for the next sweep
+	store.abortErr = errors.New("connection refused")
+	cfg.abortStaleMultipartUploads(context.Background(), -time.Minute)
+	if upload, _ := cfg.db.GetMultipartUpload("open"); upload == nil {
+		t.Fatal("row deleted although the abort failed")
+	}
+
+	// an upload the store no longer knows counts as aborted
+	store.abortErr = nil
+	cfg.abortStaleMultipartUploads(context.Background(), -time.Minute)
+	for _, uploadID := range []string{"open", "completed"} {
+		if upload, _ := cfg.db.GetMultipartUpload(uploadID); upload != nil {
+			t.Errorf("stale upload %s still recorded", uploadID)
+		}
+	}
+	if store.open["open"] {
+		t.Error("open upload wasn't aborted")
+	}
+}
+
+func TestHandlerMultipartCompleteCleansUp(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	store := &fakeMultipartStore{ObjectStore: cfg.store, open: map[string]bool{"upload-1": true}, presignErr: errors.New("signing failed")}
+	cfg.store = store
+	video, token := newTestVideo(t, cfg)
+	newTestMultipartUpload(t, cfg, video, "upload-1")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String()+"/multipart/upload-1/complete", strings.NewReader(`{"parts": [{"part_number": 1, "etag": "abc"}]}`))
+	req.SetPathValue("videoID", video.ID.String())
+	req.SetPathValue("uploadID", "upload-1")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerMultipartComplete(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", w.Code, w.Body)
+	}
+
+	if upload, _ := cfg.db.GetMultipartUpload("upload-1"); upload != nil {
+		t.Error("completed upload still recorded after failing to check it")
+	}
+	if _, err := cfg.store.Get(ctx, "uploads/upload-1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("assembled object left behind: %v", err)
+	}
+}
+
+func newMultipartRequest(t *testing.T, method string, video database.Video, token, uploadID, body string) *http.Request {
+	t.Helper()
+	path := "/api/video_upload/" + video.ID.String() + "/multipart"
+	if uploadID != "" {
+		path += "/" + uploadID
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetPathValue("videoID", video.ID.String())
+	req.SetPathValue("uploadID", uploadID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestHandlerMultipartCreate(t *testing.T) {
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	store := &fakeMultipartStore{ObjectStore: cfg.store, open: map[string]bool{}}
+	cfg.store = store
+	video, token := newTestVideo(t, cfg)
+	body := fmt.Sprintf(`{"content_type": "video/mp4", "size": %d}`, multipartMinPartSize*2+1)
+
+	w := httptest.NewRecorder()
+	cfg.handlerMultipartCreate(w, newMultipartRequest(t, http.MethodPost, video, token, "", body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	resp := struct {
+		UploadID string          `json:"upload_id"`
+		Parts    []multipartPart `json:"parts"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Parts) != 3 || resp.Parts[2].PartNumber != 3 || resp.Parts[2].URL == "" {
+		t.Errorf("parts = %+v, want 3 presigned parts", resp.Parts)
+	}
+	if upload, _ := cfg.db.GetMultipartUpload(resp.UploadID); upload == nil || !store.open[resp.UploadID] {
+		t.Errorf("upload %s = %+v, want it recorded and open", resp.UploadID, upload)
+	}
+
+	// an upload the client can't be given part URLs for is aborted straight away
+	store.partErr = errors.New("signing failed")
+	w = httptest.NewRecorder()
+	cfg.handlerMultipartCreate(w, newMultipartRequest(t, http.MethodPost, video, token, "", body))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", w.Code, w.Body)
+	}
+	if store.open["created-2"] {
+		t.Error("upload left open after failing to presign its parts")
+	}
+	if upload, _ := cfg.db.GetMultipartUpload("created-2"); upload != nil {
+		t.Error("upload still recorded after failing to presign its parts")
+	}
+}
+
+func TestHandlerMultipartComplete(t *testing.T) {
+	ctx := context.Background()
+	media := &fakeMediaProcessor{
+		probe: func(ctx context.Context, input string) (ffmpegData, error) {
+			return probeResult(1920, 1080, "10.0"), nil
+		},
+	}
+	cfg := newTestConfig(t, media)
+	store := &fakeMultipartStore{ObjectStore: cfg.store, open: map[string]bool{"upload-1": true}}
+	cfg.store = store
+	video, token := newTestVideo(t, cfg)
+	newTestMultipartUpload(t, cfg, video, "upload-1")
+
+	complete := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerMultipartComplete(w, newMultipartRequest(t, http.MethodPost, video, token, "upload-1", body))
+		return w
+	}
+
+	if w := complete(`{"parts": [{"part_number": 1}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("missing etag status = %d, want 400", w.Code)
+	}
+	if w := complete(`{"parts": [{"part_number": 2, "etag": "def"}, {"part_number": 1, "etag": "abc"}]}`); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	job, err := cfg.db.GetLatestJobForVideo(video.ID)
+	if err != nil || job == nil || job.SourceKey != "uploads/upload-1" || job.MediaType != "video/mp4" {
+		t.Fatalf("job = %+v, %v, want the assembled object queued", job, err)
+	}
+	if _, err := cfg.store.Get(ctx, job.SourceKey); err != nil {
+		t.Errorf("assembled object: %v", err)
+	}
+	if upload, _ := cfg.db.GetMultipartUpload("upload-1"); upload != nil {
+		t.Error("completed upload still recorded")
+	}
+	if w := complete(`{"parts": [{"part_number": 1, "etag": "abc"}]}`); w.Code != http.StatusNotFound {
+		t.Errorf("completing again status = %d, want 404", w.Code)
+	}
+}
+
+func TestHandlerMultipartAbort(t *testing.T) {
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	store := &fakeMultipartStore{ObjectStore: cfg.store, open: map[string]bool{"upload-1": true}}
+	cfg.store = store
+	video, token := newTestVideo(t, cfg)
+	newTestMultipartUpload(t, cfg, video, "upload-1")
+
+	abort := func() int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerMultipartAbort(w, newMultipartRequest(t, http.MethodDelete, video, token, "upload-1", ""))
+		return w.Code
+	}
+
+	store.abortErr = errors.New("connection refused")
+	if status := abort(); status != http.StatusInternalServerError {
+		t.Errorf("status with the store down = %d, want 500", status)
+	}
+	if upload, _ := cfg.db.GetMultipartUpload("upload-1"); upload == nil {
+		t.Fatal("upload forgotten although the abort failed")
+	}
+
+	store.abortErr = nil
+	if status := abort(); status != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", status)
+	}
+	if store.open["upload-1"] {
+		t.Error("upload still open in the store")
+	}
+	if upload, _ := cfg.db.GetMultipartUpload("upload-1"); upload != nil {
+		t.Error("aborted upload still recorded")
+	}
+	if status := abort(); status != http.StatusNotFound {
+		t.Errorf("aborting again status = %d, want 404", status)
+	}
+}
@@ -1,22 +1,17 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+const thumbnailUploadLimit = 20 << 20
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -40,24 +35,12 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	const maxMemory = 10 << 20
 	r.ParseMultipartForm(maxMemory)
 
-	imageFile, header, err := r.FormFile("thumbnail")
+	imageFile, _, err := r.FormFile("thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable parse form file", err)
 		return
 	}
 
-	contentType := header.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
-	// ignoring the map to the original mediatype formatting (if it contained spaces or caps)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse mediaType from request header", err)
-		return
-	}
-	if (mediaType != "image/jpeg") && (mediaType != "image/png") {
-		respondWithError(w, http.StatusBadRequest, "Invalid Media type, expects png or jpeg", nil)
-		return
-	}
-
 	videoMetaData, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Video data not found", err)
@@ -71,49 +54,41 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
 
-	fileExtension := strings.Replace(mediaType, "image/", "", 1)
-
-	randomName := make([]byte, 32)
-	rand.Read(randomName)
-
-	randomVideoURL := base64.RawURLEncoding.EncodeToString(randomName)
-
-	fullFileName := fmt.Sprintf("%s.%s", randomVideoURL, fileExtension)
-	ImageFilePath := filepath.Join(cfg.assetsRoot, fullFileName)
-
-	fileReference, err := os.Create(ImageFilePath)
+	imageData, err := io.ReadAll(io.LimitReader(imageFile, thumbnailUploadLimit+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error writing the image file", err)
+		respondWithError(w, http.StatusBadRequest, "Unable to read the image file", err)
 		return
 	}
-	_, err = io.Copy(fileReference, imageFile)
-	// ignoring the returned amount of bytes copied
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error writing the image file", err)
+	if len(imageData) > thumbnailUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", nil)
 		return
 	}
 
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, fullFileName)
-
-	videoParam := database.CreateVideoParams{
-		Title:       videoMetaData.Title,
-		Description: videoMetaData.Description,
-		UserID:      videoMetaData.UserID,
+	// the declared Content-Type is only a hint, the bytes decide
+	if _, err := sniffImageType(imageData); err != nil {
+		respondWithRejection(w, "Unable to check the image file", err)
+		return
+	}
+	img, err := decodeThumbnail(imageData)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Invalid image: %v", err), err)
+		return
 	}
 
-	updatedVideo := database.Video{
-		ID:                videoMetaData.ID,
-		CreatedAt:         videoMetaData.CreatedAt,
-		UpdatedAt:         time.Now(),
-		ThumbnailURL:      &thumbnailURL,
-		VideoURL:          videoMetaData.VideoURL,
-		CreateVideoParams: videoParam,
+	thumbnailURL, thumbnailSrcset, err := cfg.storeThumbnail(r.Context(), videoID, img)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error writing the image file", err)
+		return
 	}
-	err = cfg.db.UpdateVideo(updatedVideo)
+
+	videoMetaData.ThumbnailURL = &thumbnailURL
+	videoMetaData.ThumbnailSrcset = thumbnailSrcset
+	videoMetaData.UpdatedAt = time.Now()
+	err = cfg.db.UpdateVideo(videoMetaData)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to update the video with new thumbnail url in database", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, updatedVideo)
+	respondWithJSON(w, http.StatusOK, videoMetaData)
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// newTestConfig wires an apiConfig to a throwaway database, an in-memory store and the given media processor
+func newTestConfig(t *testing.T, media MediaProcessor) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+
+	spoolDir := filepath.Join(dir, "spool")
+	if err := os.Mkdir(spoolDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{
+		db:             db,
+		jwtSecret:      "test-secret",
+		objectBaseURL:  "http://objects.test",
+		store:          storage.NewMemoryStore("http://objects.test"),
+		assetStore:     storage.NewMemoryStore("http://assets.test"),
+		spoolDir:       spoolDir,
+		jobMaxAttempts: 3,
+		jobWake:        make(chan struct{}, 1),
+		mediaLimits:    mediaLimits{maxDuration: 2 * time.Hour, maxDimension: 4096},
+		media:          media,
+		progress:       newProgressHub(),
+	}
+}
+
+// newTestVideo creates a user owning one video and returns the video with a token for that user
+func newTestVideo(t *testing.T, cfg *apiConfig) (database.Video, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "test@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Test", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("creating video: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("making token: %v", err)
+	}
+	return video, token
+}
+
+// testMP4 is enough of an MP4 for content sniffing, the fake processor never reads past it
+var testMP4 = append([]byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomavc1"), make([]byte, 64)...)
+
+func newUploadRequest(t *testing.T, ctx context.Context, video database.Video, token string, data []byte) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("video", "upload.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), body).WithContext(ctx)
+	req.SetPathValue("videoID", video.ID.String())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestHandlerUploadVideo(t *testing.T) {
+	unsupportedCodec := probeResult(1920, 1080, "10.0")
+	unsupportedCodec.Streams[0].CodecName = "mpeg2video"
+
+	tests := []struct {
+		name       string
+		data       []byte
+		probe      ffmpegData
+		probeErr   error
+		delay      time.Duration
+		timeout    time.Duration
+		wantStatus int
+		wantProbes int
+	}{
+		{
+			name:       "valid upload is queued",
+			data:       testMP4,
+			probe:      probeResult(1920, 1080, "10.0"),
+			wantStatus: http.StatusAccepted,
+			wantProbes: 1,
+		},
+		{
+			name:       "corrupt file",
+			data:       testMP4,
+			probeErr:   os.ErrInvalid,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantProbes: 1,
+		},
+		{
+			name:       "resolution over the limit",
+			data:       testMP4,
+			probe:      probeResult(7680, 4320, "10.0"),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantProbes: 1,
+		},
+		{
+			name:       "too long",
+			data:       testMP4,
+			probe:      probeResult(1920, 1080, "36000.0"),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantProbes: 1,
+		},
+		{
+			name:       "unsupported codec",
+			data:       testMP4,
+			probe:      unsupportedCodec,
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantProbes: 1,
+		},
+		{
+			name:       "not a video",
+			data:       []byte("just some text, definitely not a video file"),
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantProbes: 0,
+		},
+		{
+			name:       "probe times out",
+			data:       testMP4,
+			probe:      probeResult(1920, 1080, "10.0"),
+			delay:      time.Minute,
+			timeout:    20 * time.Millisecond,
+			wantStatus: http.StatusInternalServerError,
+			wantProbes: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			media := &fakeMediaProcessor{
+				delay: tt.delay,
+				probe: func(ctx context.Context, input string) (ffmpegData, error) {
+					return tt.probe, tt.probeErr
+				},
+			}
+			cfg := newTestConfig(t, media)
+			video, token := newTestVideo(t, cfg)
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, newUploadRequest(t, ctx, video, token, tt.data))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if probes := media.callCount("probe"); probes != tt.wantProbes {
+				t.Errorf("probed %d times, want %d", probes, tt.wantProbes)
+			}
+
+			job, err := cfg.db.GetLatestJobForVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantJobs := 0
+			if tt.wantStatus == http.StatusAccepted {
+				wantJobs = 1
+			}
+			if (job != nil) != (wantJobs == 1) {
+				t.Errorf("queued job = %v, want one queued: %v", job, wantJobs == 1)
+			}
+
+			// rejected uploads must not leave spooled files behind
+			spooled, _ := os.ReadDir(cfg.spoolDir)
+			if len(spooled) != wantJobs {
+				t.Errorf("%d files left in the spool directory, want %d", len(spooled), wantJobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var (
+	errClipPastEnd    = errors.New("clip ends after the video")
+	errClipBackwards  = errors.New("clip ends before it starts")
+	errClipTooShort   = errors.New("clip is too short")
+	errClipWholeVideo = errors.New("clip is the whole video")
+)
+
+// clipTimestamp is a JSON number of seconds or a string parseClipTimestamp reads
+type clipTimestamp float64
+
+func (t *clipTimestamp) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = string(data)
+	}
+	seconds, err := parseClipTimestamp(value)
+	if err != nil {
+		return err
+	}
+	*t = clipTimestamp(seconds)
+	return nil
+}
+
+// handlerVideoClip creates a new video from part of an existing one, the clip is cut and processed in the background
+func (cfg *apiConfig) handlerVideoClip(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start *clipTimestamp `json:"start"`
+		End   *clipTimestamp `json:"end"`
+		Title string         `json:"title"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters, start and end are seconds or timestamps like 1:30.5", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't clip this video", nil)
+		return
+	}
+	if video.VideoURL == nil || video.DurationSeconds == nil {
+		respondWithError(w, http.StatusConflict, "The video hasn't been processed yet", nil)
+		return
+	}
+
+	start, end, err := clipRange(params.Start, params.End, *video.DurationSeconds)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, clipRangeMessage(err, *video.DurationSeconds), err)
+		return
+	}
+
+	// a clip is cut from the clean copy when there is one, so it can be watermarked like any upload
+	sourceURL := *video.VideoURL
+	if video.UnwatermarkedURL != nil {
+		sourceURL = *video.UnwatermarkedURL
+	}
+	ref, ok := cfg.objectRefFromURL(sourceURL)
+	if !ok || ref.Store != objectStoreName {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find the video's file", nil)
+		return
+	}
+
+	title := params.Title
+	if title == "" {
+		title = video.Title + " (clip)"
+	}
+	clip, err := cfg.db.CreateClipVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: video.Description,
+		UserID:      userID,
+	}, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create the clip", err)
+		return
+	}
+
+	// the worker reads the parent's file itself and leaves it in place
+	job, err := cfg.enqueueVideoJob(database.CreateJobParams{
+		VideoID:   clip.ID,
+		SourceKey: ref.Key,
+		MediaType: "video/mp4",
+		ClipStart: &start,
+		ClipEnd:   &end,
+
+		SourceWatermarked: video.Watermarked && video.UnwatermarkedURL == nil,
+	})
+	if err != nil {
+		// the clip has no files yet, only its row needs to go
+		if _, err := cfg.db.DeleteVideoAndQueueObjects(clip.ID, nil); err != nil {
+			log.Printf("Couldn't remove clip %s after failing to queue it: %v", clip.ID, err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to queue the clip for processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, newVideoResponse(clip, &job))
+}
+
+// clipRange checks a requested clip against the video's duration, start defaults to the beginning and end to the end
+func clipRange(start, end *clipTimestamp, duration float64) (float64, float64, error) {
+	from, to := 0.0, duration
+	if start != nil {
+		from = float64(*start)
+	}
+	if end != nil {
+		to = float64(*end)
+	}
+
+	// players round the duration they show, an end just past it means the end
+	if to > duration && to-duration < 1 {
+		to = duration
+	}
+	if to > duration {
+		return 0, 0, errClipPastEnd
+	}
+	if to <= from {
+		return 0, 0, errClipBackwards
+	}
+	if to-from < clipMinDuration {
+		return 0, 0, errClipTooShort
+	}
+	if from == 0 && to == duration {
+		return 0, 0, errClipWholeVideo
+	}
+	return from, to, nil
+}
+
+// clipRangeMessage tells the user what's wrong with the clip clipRange refused
+func clipRangeMessage(err error, duration float64) string {
+	switch {
+	case errors.Is(err, errClipPastEnd):
+		return fmt.Sprintf("The clip ends after the video does, at %s", strconv.FormatFloat(duration, 'f', -1, 64))
+	case errors.Is(err, errClipBackwards):
+		return "The clip has to end after it starts"
+	case errors.Is(err, errClipTooShort):
+		return fmt.Sprintf("Clips are at least %gs long", clipMinDuration)
+	case errors.Is(err, errClipWholeVideo):
+		return "The clip is the whole video"
+	default:
+		return "Invalid clip range"
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
@@ -9,6 +10,23 @@ import (
 	"github.com/google/uuid"
 )
 
+// videoResponse adds the state of the latest processing job and, where it's looked up, the caption tracks to a video
+type videoResponse struct {
+	database.Video
+	ProcessingStatus *database.JobStatus `json:"processing_status"`
+	ProcessingError  *string             `json:"processing_error"`
+	Captions         []database.Caption  `json:"captions,omitempty"`
+}
+
+func newVideoResponse(video database.Video, job *database.Job) videoResponse {
+	resp := videoResponse{Video: video}
+	if job != nil {
+		resp.ProcessingStatus = &job.Status
+		resp.ProcessingError = job.Error
+	}
+	return resp
+}
+
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		database.CreateVideoParams
@@ -72,12 +90,24 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	objectRefs, err := cfg.videoObjectRefs(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find the video's stored files", err)
+		return
+	}
+
+	pending, err := cfg.db.DeleteVideoAndQueueObjects(videoID, objectRefs)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
 
+	// the row is gone at this point, anything that fails here is retried by runPendingDeletions
+	failed := cfg.deletePendingObjects(r.Context(), pending)
+	if failed > 0 {
+		log.Printf("%d stored files of video %s queued for retry", failed, videoID)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -95,7 +125,21 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	job, err := cfg.db.GetLatestJobForVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video processing status", err)
+		return
+	}
+
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video captions", err)
+		return
+	}
+
+	resp := newVideoResponse(video, job)
+	resp.Captions = captions
+	respondWithJSON(w, http.StatusOK, resp)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// progressKeepAlive is how often an idle stream gets a comment so proxies don't close it
+	progressKeepAlive = 15 * time.Second
+	// progressTokenExpiry only has to cover opening the stream, it's checked when connecting
+	progressTokenExpiry = time.Minute
+)
+
+// handlerVideoProgressToken issues a token for watching one video's progress. EventSource can't set
+// headers, so browsers pass it in the query string where the access token would end up in logs.
+func (cfg *apiConfig) handlerVideoProgressToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if _, ok := cfg.progressVideo(w, videoID, userID); !ok {
+		return
+	}
+
+	expiresAt := time.Now().UTC().Add(progressTokenExpiry)
+	progressToken, err := auth.MakeProgressToken(userID, videoID, cfg.jwtSecret, progressTokenExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create a progress token", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{Token: progressToken, ExpiresAt: expiresAt})
+}
+
+// progressVideo checks the video exists and belongs to userID
+func (cfg *apiConfig) progressVideo(w http.ResponseWriter, videoID, userID uuid.UUID) (database.Video, bool) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't watch this video's progress", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// handlerVideoProgress streams a video's upload and processing progress as Server-Sent Events
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	var userID uuid.UUID
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		userID, err = auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+	} else {
+		// browsers pass a progress token from handlerVideoProgressToken, never the access token
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err = auth.ValidateProgressToken(token, cfg.jwtSecret, videoID)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate the progress token", err)
+			return
+		}
+	}
+
+	if _, ok := cfg.progressVideo(w, videoID, userID); !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming isn't supported", nil)
+		return
+	}
+
+	// subscribe before reading the job so nothing published in between is missed
+	latest, events, unsubscribe := cfg.progress.subscribe(videoID)
+	defer unsubscribe()
+	if latest == nil {
+		job, err := cfg.db.GetLatestJobForVideo(videoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get processing status", err)
+			return
+		}
+		latest = jobProgressEvent(job)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// nginx buffers responses by default, which would hold events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event progressEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if latest != nil {
+		if err := send(*latest); err != nil || latest.final() {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(progressKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := send(event); err != nil || event.final() {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// jobProgressEvent describes a job's state for clients connecting when nothing is being published,
+// e.g. the job is waiting for a worker or ran in another process
+func jobProgressEvent(job *database.Job) *progressEvent {
+	if job == nil {
+		return nil
+	}
+	switch job.Status {
+	case database.JobStatusQueued:
+		return &progressEvent{Stage: stageQueued}
+	case database.JobStatusProcessing:
+		return &progressEvent{Stage: stageProcessing}
+	case database.JobStatusReady:
+		return &progressEvent{Stage: stageReady, Percent: 100}
+	case database.JobStatusFailed:
+		event := &progressEvent{Stage: stageFailed}
+		if job.Error != nil {
+			event.Message = *job.Error
+		}
+		return event
+	}
+	return nil
+}
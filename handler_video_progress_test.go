@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func TestProgressHub(t *testing.T) {
+	hub := newProgressHub()
+	videoID := uuid.New()
+
+	hub.publish(videoID, progressEvent{Stage: stageUpload, Percent: 40})
+	latest, events, unsubscribe := hub.subscribe(videoID)
+	defer unsubscribe()
+	if latest == nil || latest.Percent != 40 {
+		t.Fatalf("latest = %v, want the 40%% upload event", latest)
+	}
+
+	// a subscriber that never reads still only holds the newest events
+	for i := 0; i < 100; i++ {
+		hub.publish(videoID, progressEvent{Stage: stageProcessing, Percent: float64(i)})
+	}
+	var last progressEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	if last.Percent != 99 {
+		t.Errorf("last event = %v, want the 99%% processing event", last)
+	}
+
+	hub.publish(videoID, progressEvent{Stage: stageReady})
+	if latest, _, unsubscribe := hub.subscribe(videoID); latest != nil {
+		unsubscribe()
+		t.Errorf("latest = %v after the video settled, want none", latest)
+	}
+}
+
+func TestFFmpegProgressWriter(t *testing.T) {
+	var reported []time.Duration
+	w := &ffmpegProgressWriter{report: func(done time.Duration) {
+		reported = append(reported, done)
+	}}
+
+	w.Write([]byte("frame=0\nout_time_us=N/A\nprogress=continue\nframe=30\nout_ti"))
+	w.Write([]byte("me_us=1500000\nout_time=00:00:01.500000\nprogress=end\n"))
+
+	if len(reported) != 1 || reported[0] != 1500*time.Millisecond {
+		t.Errorf("reported %v, want [1.5s]", reported)
+	}
+}
+
+func TestHandlerVideoProgress(t *testing.T) {
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	video, token := newTestVideo(t, cfg)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("POST /api/videos/{videoID}/progress_token", cfg.handlerVideoProgressToken)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	progressURL := srv.URL + "/api/videos/" + video.ID.String() + "/progress"
+
+	req, _ := http.NewRequest(http.MethodPost, progressURL+"_token", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := struct {
+		Token string `json:"token"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&issued)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || issued.Token == "" {
+		t.Fatalf("progress token status = %d, want a token", resp.StatusCode)
+	}
+
+	otherVideo, _ := auth.MakeProgressToken(video.UserID, uuid.New(), cfg.jwtSecret, time.Minute)
+	expired, _ := auth.MakeProgressToken(video.UserID, video.ID, cfg.jwtSecret, -time.Minute)
+	for name, query := range map[string]string{
+		"no token":                  "",
+		"the access token":          "?token=" + token,
+		"another video's token":     "?token=" + otherVideo,
+		"an expired progress token": "?token=" + expired,
+	} {
+		resp, err := http.Get(progressURL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status with %s = %d, want %d", name, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	// a progress token is no access token
+	if _, err := auth.ValidateJWT(issued.Token, cfg.jwtSecret); err == nil {
+		t.Error("progress token accepted as an access token")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, progressURL+"?token="+issued.Token, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %q, want text/event-stream", ct)
+	}
+
+	// the headers are flushed once the handler is subscribed, so these all reach the stream
+	cfg.progress.publish(video.ID, progressEvent{Stage: stageProcessing, Step: "hls", Percent: 50})
+	cfg.progress.publish(video.ID, progressEvent{Stage: stageReady, Percent: 100})
+
+	stages := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		event := progressEvent{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("bad event %q: %v", data, err)
+		}
+		stages = append(stages, event.Stage)
+	}
+
+	// the stream ends by itself after the final event
+	if strings.Join(stages, ",") != "processing,ready" {
+		t.Errorf("stages = %v, want [processing ready]", stages)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) watermarkRequestUser(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func (cfg *apiConfig) handlerWatermarkGet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.watermarkRequestUser(w, r)
+	if !ok {
+		return
+	}
+
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark == nil {
+		respondWithError(w, http.StatusNotFound, "You haven't set a watermark", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, watermark)
+}
+
+// handlerWatermarkSave sets the logo burned into the user's videos from now on. Fields that are left out
+// keep their current value, or the server's defaults for a first watermark, which also needs an image.
+func (cfg *apiConfig) handlerWatermarkSave(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.watermarkRequestUser(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, watermarkUploadLimit+1<<10)
+	if err := r.ParseMultipartForm(watermarkUploadLimit); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse the form, watermark images are limited to 5MB", err)
+		return
+	}
+
+	current, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+
+	settings := defaultWatermarkSettings
+	if current != nil {
+		settings = watermarkSettings{
+			position:     current.Position,
+			opacity:      current.Opacity,
+			margin:       current.Margin,
+			scale:        current.Scale,
+			keepOriginal: current.KeepOriginal,
+		}
+	} else if cfg.watermark != nil {
+		settings = cfg.watermark.watermarkSettings
+	}
+	if err := readWatermarkSettings(r, &settings); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	imageKey := ""
+	file, _, err := r.FormFile("image")
+	if err == nil {
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, watermarkUploadLimit+1))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to read the image file", err)
+			return
+		}
+		if len(data) > watermarkUploadLimit {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Watermark image is too large", nil)
+			return
+		}
+		img, err := decodeWatermarkImage(data)
+		if isMediaRejection(err) {
+			respondWithRejection(w, "Unable to check the image file", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Invalid image: %v", err), err)
+			return
+		}
+		imageKey, err = cfg.storeWatermarkImage(r.Context(), userID, img)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error writing the image file", err)
+			return
+		}
+	} else if current != nil {
+		imageKey = current.ImageKey
+	} else {
+		respondWithError(w, http.StatusBadRequest, "An image is needed for a new watermark", err)
+		return
+	}
+
+	watermark, err := cfg.db.SaveWatermark(database.SaveWatermarkParams{
+		UserID:       userID,
+		ImageKey:     imageKey,
+		ImageURL:     cfg.objectURL(imageKey),
+		Position:     settings.position,
+		Opacity:      settings.opacity,
+		Margin:       settings.margin,
+		Scale:        settings.scale,
+		KeepOriginal: settings.keepOriginal,
+	})
+	if err != nil {
+		if current == nil || imageKey != current.ImageKey {
+			cfg.deleteWatermarkImage(r.Context(), imageKey)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save watermark", err)
+		return
+	}
+	if current != nil && imageKey != current.ImageKey {
+		cfg.deleteWatermarkImage(r.Context(), current.ImageKey)
+	}
+
+	respondWithJSON(w, http.StatusOK, watermark)
+}
+
+// handlerWatermarkDelete goes back to the server's watermark, if any, for videos processed from now on
+func (cfg *apiConfig) handlerWatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.watermarkRequestUser(w, r)
+	if !ok {
+		return
+	}
+
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark == nil {
+		respondWithError(w, http.StatusNotFound, "You haven't set a watermark", nil)
+		return
+	}
+
+	if err := cfg.db.DeleteWatermark(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete watermark", err)
+		return
+	}
+	cfg.deleteWatermarkImage(r.Context(), watermark.ImageKey)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readWatermarkSettings overrides settings with the form fields that were sent and validates the result
+func readWatermarkSettings(r *http.Request, settings *watermarkSettings) error {
+	if position := strings.TrimSpace(r.FormValue("position")); position != "" {
+		settings.position = position
+	}
+	if value := r.FormValue("opacity"); value != "" {
+		opacity, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("opacity must be a number")
+		}
+		settings.opacity = opacity
+	}
+	if value := r.FormValue("margin"); value != "" {
+		margin, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("margin must be a whole number of pixels")
+		}
+		settings.margin = margin
+	}
+	if value := r.FormValue("scale"); value != "" {
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("scale must be a number")
+		}
+		settings.scale = scale
+	}
+	if value := r.FormValue("keep_original"); value != "" {
+		keepOriginal, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("keep_original must be true or false")
+		}
+		settings.keepOriginal = keepOriginal
+	}
+	return settings.validate()
+}
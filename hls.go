@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const hlsMasterPlaylist = "master.m3u8"
+
+// transcodeToHLS writes one variant playlist per rendition into outputDir/<name>/ plus a master playlist
+func transcodeToHLS(ctx context.Context, tools *toolRunner, filePath, outputDir string, width, height int, hasAudio bool) error {
+	renditions := renditionsFor(width, height)
+
+	for _, r := range renditions {
+		if err := os.MkdirAll(filepath.Join(outputDir, r.name), 0755); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"-i", filePath}
+	args = append(args, renditionVideoArgs(renditions, height > width)...)
+
+	streamMap := []string{}
+	for i, r := range renditions {
+		entry := fmt.Sprintf("v:%d,name:%s", i, r.name)
+		if hasAudio {
+			args = append(args,
+				"-map", "0:a:0",
+				fmt.Sprintf("-c:a:%d", i), "aac",
+				fmt.Sprintf("-b:a:%d", i), r.audioBitrate,
+			)
+			entry = fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.name)
+		}
+		streamMap = append(streamMap, entry)
+	}
+
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_filename", filepath.Join(outputDir, "%v", "segment_%03d.ts"),
+		"-master_pl_name", hlsMasterPlaylist,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outputDir, "%v", "index.m3u8"),
+	)
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("transcoding %v to HLS: %w", filePath, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, hlsMasterPlaylist)); err != nil {
+		return fmt.Errorf("HLS master playlist missing after transcoding: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	hlsSubtitlesDir   = "subs/"
+	hlsSubtitlesGroup = "subs"
+	// tsProbeBytes is how much of the first segment is read looking for its earliest timestamp
+	tsProbeBytes = 256 << 10
+)
+
+var streamInfSubtitlesPattern = regexp.MustCompile(`,SUBTITLES="[^"]*"`)
+
+// playbackCaptions picks the track players get per language, an uploaded track wins over an auto-generated one
+func playbackCaptions(captions []database.Caption) []database.Caption {
+	picked := []database.Caption{}
+	seen := map[string]bool{}
+	for _, caption := range captions {
+		if !caption.AutoGenerated && !seen[caption.Language] {
+			seen[caption.Language] = true
+			picked = append(picked, caption)
+		}
+	}
+	for _, caption := range captions {
+		if caption.AutoGenerated && !seen[caption.Language] {
+			seen[caption.Language] = true
+			picked = append(picked, caption)
+		}
+	}
+	return picked
+}
+
+// rewriteMasterPlaylist replaces the subtitle renditions of an HLS master playlist with one per caption,
+// each variant stream is pointed at the group when there are any
+func rewriteMasterPlaylist(master string, captions []database.Caption) string {
+	lines := []string{}
+	mediaAdded := false
+	for _, line := range strings.Split(strings.TrimRight(master, "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:") && strings.Contains(line, "TYPE=SUBTITLES") {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !mediaAdded {
+				lines = append(lines, subtitleMediaLines(captions)...)
+				mediaAdded = true
+			}
+			line = streamInfSubtitlesPattern.ReplaceAllString(line, "")
+			if len(captions) > 0 {
+				line += fmt.Sprintf(`,SUBTITLES="%s"`, hlsSubtitlesGroup)
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func subtitleMediaLines(captions []database.Caption) []string {
+	lines := []string{}
+	names := map[string]bool{}
+	for _, caption := range captions {
+		// names are quoted strings and have to be unique within the group
+		name := strings.ReplaceAll(caption.Label, `"`, "'")
+		if names[name] {
+			name = fmt.Sprintf("%s (%s)", name, caption.Language)
+		}
+		names[name] = true
+
+		lines = append(lines, fmt.Sprintf(
+			`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="%s",NAME="%s",LANGUAGE="%s",DEFAULT=NO,AUTOSELECT=YES,URI="%s%s.m3u8"`,
+			hlsSubtitlesGroup, name, caption.Language, hlsSubtitlesDir, caption.Language))
+	}
+	return lines
+}
+
+// subtitlePlaylist is a media playlist holding the whole track as a single segment
+func subtitlePlaylist(trackName string, duration float64) string {
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+		int(math.Ceil(duration)), duration, trackName)
+}
+
+// withTimestampMap adds the header that lines the cues up with the MPEG-TS timestamps of the segments,
+// without it players assume the video starts at timestamp 0 and ffmpeg's segments don't
+func withTimestampMap(vtt []byte, pts int64) []byte {
+	header, rest, _ := bytes.Cut(vtt, []byte("\n"))
+	b := bytes.Buffer{}
+	b.Write(header)
+	fmt.Fprintf(&b, "\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", pts)
+	b.Write(rest)
+	return b.Bytes()
+}
+
+// firstTSTimestamp returns the earliest presentation timestamp of the audio and video packets
+// at the start of an MPEG-TS stream
+func firstTSTimestamp(r io.Reader) (int64, bool, error) {
+	reader := bufio.NewReader(io.LimitReader(r, tsProbeBytes))
+	packet := make([]byte, 188)
+	first, found := int64(0), false
+	for {
+		_, err := io.ReadFull(reader, packet)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return first, found, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if packet[0] != 0x47 {
+			return 0, false, errors.New("not an MPEG-TS stream")
+		}
+
+		// only packets starting a PES carry its header
+		if packet[1]&0x40 == 0 {
+			continue
+		}
+		payload := packet[4:]
+		switch packet[3] >> 4 & 0x3 {
+		case 0x2:
+			continue
+		case 0x3:
+			if int(payload[0])+1 >= len(payload) {
+				continue
+			}
+			payload = payload[int(payload[0])+1:]
+		}
+
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			continue
+		}
+		// audio and video stream ids
+		if streamID := payload[3]; streamID < 0xC0 || streamID > 0xEF {
+			continue
+		}
+		if payload[7]&0x80 == 0 {
+			continue
+		}
+		p := payload[9:14]
+		pts := int64(p[0]>>1&0x7)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+		if !found || pts < first {
+			first, found = pts, true
+		}
+	}
+}
+
+// publishHLSSubtitles writes the video's caption tracks into its HLS output and updates the master playlist
+// to match, tracks that are gone are removed
+func (cfg *apiConfig) publishHLSSubtitles(ctx context.Context, video database.Video) error {
+	if video.PlaylistURL == nil {
+		return nil
+	}
+	ref, ok := cfg.objectRefFromURL(*video.PlaylistURL)
+	if !ok || ref.Store != objectStoreName {
+		return fmt.Errorf("playlist %s isn't in the object store", *video.PlaylistURL)
+	}
+	hlsPrefix := strings.TrimSuffix(ref.Key, hlsMasterPlaylist)
+
+	captions, err := cfg.db.GetCaptions(video.ID)
+	if err != nil {
+		return err
+	}
+	captions = playbackCaptions(captions)
+
+	master, err := cfg.getObjectText(ctx, ref.Key)
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	if len(captions) > 0 {
+		pts, duration, err := cfg.hlsTimeline(ctx, hlsPrefix, master)
+		if err != nil {
+			return err
+		}
+
+		for _, caption := range captions {
+			vtt, err := cfg.getObjectText(ctx, caption.ObjectKey)
+			if err != nil {
+				return err
+			}
+			trackName := caption.Language + ".vtt"
+			playlistName := caption.Language + ".m3u8"
+
+			err = cfg.store.Put(ctx, hlsPrefix+hlsSubtitlesDir+trackName, bytes.NewReader(withTimestampMap([]byte(vtt), pts)), "text/vtt")
+			if err != nil {
+				return err
+			}
+			err = cfg.store.Put(ctx, hlsPrefix+hlsSubtitlesDir+playlistName, strings.NewReader(subtitlePlaylist(trackName, duration)), storage.ContentTypeForKey(playlistName))
+			if err != nil {
+				return err
+			}
+			written[hlsPrefix+hlsSubtitlesDir+trackName] = true
+			written[hlsPrefix+hlsSubtitlesDir+playlistName] = true
+		}
+	}
+
+	if rewritten := rewriteMasterPlaylist(master, captions); rewritten != master {
+		err = cfg.store.Put(ctx, ref.Key, strings.NewReader(rewritten), storage.ContentTypeForKey(ref.Key))
+		if err != nil {
+			return err
+		}
+	}
+
+	stale, err := cfg.store.List(ctx, hlsPrefix+hlsSubtitlesDir)
+	if err != nil {
+		return err
+	}
+	for _, obj := range stale {
+		if written[obj.Key] {
+			continue
+		}
+		if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hlsTimeline reads the first variant stream of a master playlist for the timestamp its first segment
+// starts at and the total duration of its segments
+func (cfg *apiConfig) hlsTimeline(ctx context.Context, hlsPrefix, master string) (int64, float64, error) {
+	variant := firstPlaylistURI(master)
+	if variant == "" {
+		return 0, 0, errors.New("no variant streams in the master playlist")
+	}
+	variantKey := hlsPrefix + variant
+	media, err := cfg.getObjectText(ctx, variantKey)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	duration := 0.0
+	for _, line := range strings.Split(media, "\n") {
+		if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+			seconds, _, _ := strings.Cut(value, ",")
+			d, err := strconv.ParseFloat(strings.TrimSpace(seconds), 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid segment duration in %s: %w", variantKey, err)
+			}
+			duration += d
+		}
+	}
+	segment := firstPlaylistURI(media)
+	if segment == "" || duration <= 0 {
+		return 0, 0, fmt.Errorf("no segments in %s", variantKey)
+	}
+
+	body, err := cfg.store.Get(ctx, path.Join(path.Dir(variantKey), segment))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer body.Close()
+	pts, ok, err := firstTSTimestamp(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("no timestamps in the first segment of %s", variantKey)
+	}
+	return pts, duration, nil
+}
+
+// firstPlaylistURI returns the first line of a playlist that isn't a tag or a comment
+func firstPlaylistURI(playlist string) string {
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+func (cfg *apiConfig) getObjectText(ctx context.Context, key string) (string, error) {
+	body, err := cfg.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
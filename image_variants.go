@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailWidths are the responsive sizes every thumbnail is re-encoded into
+var thumbnailWidths = []int{320, 640, 1280}
+
+const (
+	thumbnailMaxPixels   = 50_000_000
+	thumbnailJPEGQuality = 85
+)
+
+type imageVariant struct {
+	width     int
+	mediaType string
+	data      []byte
+}
+
+// decodeThumbnail checks the dimensions before decoding so a tiny file claiming to be
+// a gigapixel image can't exhaust memory, EXIF orientation is applied to the pixels
+func decodeThumbnail(data []byte) (image.Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not a supported image: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("image dimensions %dx%d are out of range", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s image: %w", format, err)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// thumbnailVariants re-encodes img at every configured width it can fill without upscaling,
+// once as JPEG and once as WebP. Re-encoding also drops any EXIF or other metadata.
+func thumbnailVariants(ctx context.Context, media MediaProcessor, img image.Image) ([]imageVariant, error) {
+	sourceWidth := img.Bounds().Dx()
+	widths := []int{}
+	for _, width := range thumbnailWidths {
+		if width <= sourceWidth {
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) == 0 {
+		widths = append(widths, sourceWidth)
+	}
+
+	variants := []imageVariant{}
+	for _, width := range widths {
+		resized := resizeToWidth(img, width)
+
+		jpegData := bytes.Buffer{}
+		err := jpeg.Encode(&jpegData, resized, &jpeg.Options{Quality: thumbnailJPEGQuality})
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, imageVariant{width: width, mediaType: "image/jpeg", data: jpegData.Bytes()})
+
+		webpData, err := media.EncodeWebP(ctx, resized)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, imageVariant{width: width, mediaType: "image/webp", data: webpData})
+	}
+	return variants, nil
+}
+
+func resizeToWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width {
+		return img
+	}
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// encodeWebP pipes a lossless PNG through ffmpeg, the standard library has no WebP encoder
+func encodeWebP(ctx context.Context, tools *toolRunner, img image.Image) ([]byte, error) {
+	pngData := bytes.Buffer{}
+	if err := png.Encode(&pngData, img); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-f", "png_pipe", "-i", "pipe:0", "-c:v", "libwebp", "-quality", "80", "-f", "webp", "pipe:1"}
+	out := bytes.Buffer{}
+
+	err := tools.ffmpeg(ctx, args, &pngData, &out)
+	if err != nil {
+		return nil, fmt.Errorf("encoding WebP: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// jpegOrientation reads the EXIF orientation tag (1-8) from a JPEG, 1 means upright
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || pos+2+length > len(data) {
+			// start of scan, metadata segments are all before it
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			orientation, err := exifOrientation(segment[6:])
+			if err != nil {
+				return 1
+			}
+			return orientation
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 0, errors.New("short TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errors.New("unknown TIFF byte order")
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0, errors.New("IFD0 out of range")
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 0, errors.New("invalid orientation")
+			}
+			return orientation, nil
+		}
+	}
+	return 1, nil
+}
+
+// applyOrientation turns the stored pixels upright for EXIF orientations 2-8
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -18,6 +18,9 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "tubely-access"
+	// TokenTypeProgress only lets its holder watch one video's progress, it's short-lived
+	// because it travels in a URL
+	TokenTypeProgress TokenType = "tubely-progress"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -84,6 +87,51 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 	return id, nil
 }
 
+func MakeProgressToken(
+	userID uuid.UUID,
+	videoID uuid.UUID,
+	tokenSecret string,
+	expiresIn time.Duration,
+) (string, error) {
+	signingKey := []byte(tokenSecret)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeProgress),
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		Subject:   userID.String(),
+		Audience:  jwt.ClaimStrings{videoID.String()},
+	})
+	return token.SignedString(signingKey)
+}
+
+// ValidateProgressToken returns the user a progress token was issued to, it must be for videoID
+func ValidateProgressToken(tokenString, tokenSecret string, videoID uuid.UUID) (uuid.UUID, error) {
+	claimsStruct := jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithIssuer(string(TokenTypeProgress)),
+		jwt.WithAudience(videoID.String()),
+	)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if claimsStruct.ExpiresAt == nil {
+		return uuid.Nil, errors.New("progress token doesn't expire")
+	}
+
+	userIDString, err := token.Claims.GetSubject()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	id, err := uuid.Parse(userIDString)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+	return id, nil
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Caption is a WebVTT subtitle track of a video. A video has at most one uploaded
+// and one auto-generated track per language.
+type Caption struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	SaveCaptionParams
+}
+
+type SaveCaptionParams struct {
+	VideoID       uuid.UUID `json:"video_id"`
+	Language      string    `json:"language"`
+	Label         string    `json:"label"`
+	AutoGenerated bool      `json:"auto_generated"`
+	ObjectKey     string    `json:"-"`
+	URL           string    `json:"url"`
+}
+
+const captionColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		auto_generated,
+		object_key,
+		url`
+
+func scanCaption(row rowScanner) (Caption, error) {
+	var caption Caption
+	err := row.Scan(
+		&caption.ID,
+		&caption.CreatedAt,
+		&caption.UpdatedAt,
+		&caption.VideoID,
+		&caption.Language,
+		&caption.Label,
+		&caption.AutoGenerated,
+		&caption.ObjectKey,
+		&caption.URL,
+	)
+	return caption, err
+}
+
+// SaveCaption adds a track, or replaces the video's track of the same language and kind
+func (c Client) SaveCaption(params SaveCaptionParams) (Caption, error) {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO captions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		auto_generated,
+		object_key,
+		url
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (video_id, language, auto_generated) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		label = excluded.label,
+		object_key = excluded.object_key,
+		url = excluded.url
+	`
+	_, err := c.db.Exec(
+		query,
+		uuid.New(),
+		now,
+		now,
+		params.VideoID,
+		params.Language,
+		params.Label,
+		params.AutoGenerated,
+		params.ObjectKey,
+		params.URL,
+	)
+	if err != nil {
+		return Caption{}, err
+	}
+
+	caption, err := c.GetCaption(params.VideoID, params.Language, params.AutoGenerated)
+	if err != nil {
+		return Caption{}, err
+	}
+	if caption == nil {
+		return Caption{}, errors.New("caption missing after save")
+	}
+	return *caption, nil
+}
+
+// GetCaption returns nil when the video has no such track
+func (c Client) GetCaption(videoID uuid.UUID, language string, autoGenerated bool) (*Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM captions
+	WHERE video_id = ? AND language = ? AND auto_generated = ?
+	`
+	caption, err := scanCaption(c.db.QueryRow(query, videoID, language, autoGenerated))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &caption, nil
+}
+
+// GetCaptions lists a video's tracks, uploaded ones before auto-generated ones of the same language
+func (c Client) GetCaptions(videoID uuid.UUID) ([]Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM captions
+	WHERE video_id = ?
+	ORDER BY language, auto_generated
+	`
+	return c.queryCaptions(query, videoID)
+}
+
+func (c Client) GetAllCaptions() ([]Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM captions
+	`
+	return c.queryCaptions(query)
+}
+
+func (c Client) queryCaptions(query string, args ...any) ([]Caption, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []Caption{}
+	for rows.Next() {
+		caption, err := scanCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+func (c Client) DeleteCaption(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM captions WHERE id = ?", id)
+	return err
+}
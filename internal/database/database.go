@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -12,6 +13,15 @@ type Client struct {
 }
 
 func NewClient(pathToDB string) (Client, error) {
+	// the job workers write concurrently with request handlers, wait on locks instead of failing
+	if !strings.Contains(pathToDB, "_busy_timeout") {
+		separator := "?"
+		if strings.Contains(pathToDB, "?") {
+			separator = "&"
+		}
+		pathToDB += separator + "_busy_timeout=5000"
+	}
+
 	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
 		return Client{}, err
@@ -72,6 +82,213 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	videoObjectTable := `
+	CREATE TABLE IF NOT EXISTS video_objects (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		store TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoObjectTable)
+	if err != nil {
+		return err
+	}
+
+	pendingDeletionTable := `
+	CREATE TABLE IF NOT EXISTS pending_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		store TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(pendingDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		source_path TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		error TEXT,
+		next_run_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS jobs_status_next_run_at ON jobs(status, next_run_at);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+
+	tusUploadTable := `
+	CREATE TABLE IF NOT EXISTS tus_uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		upload_length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		media_type TEXT NOT NULL,
+		file_path TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(tusUploadTable)
+	if err != nil {
+		return err
+	}
+
+	multipartUploadTable := `
+	CREATE TABLE IF NOT EXISTS multipart_uploads (
+		upload_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(multipartUploadTable)
+	if err != nil {
+		return err
+	}
+
+	captionTable := `
+	CREATE TABLE IF NOT EXISTS captions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL,
+		auto_generated BOOLEAN NOT NULL DEFAULT FALSE,
+		object_key TEXT NOT NULL,
+		url TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS captions_video_language ON captions(video_id, language, auto_generated);
+	`
+	_, err = c.db.Exec(captionTable)
+	if err != nil {
+		return err
+	}
+
+	watermarkTable := `
+	CREATE TABLE IF NOT EXISTS watermarks (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		image_key TEXT NOT NULL,
+		image_url TEXT NOT NULL,
+		position TEXT NOT NULL,
+		opacity REAL NOT NULL,
+		margin INTEGER NOT NULL,
+		scale REAL NOT NULL,
+		keep_original BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(watermarkTable)
+	if err != nil {
+		return err
+	}
+
+	// columns added after the tables above were first created
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"videos", "playlist_url", "TEXT"},
+		{"videos", "dash_manifest_url", "TEXT"},
+		{"videos", "thumbnail_srcset", "TEXT"},
+		{"videos", "original_url", "TEXT"},
+		{"videos", "storyboard_url", "TEXT"},
+		{"videos", "audio_url", "TEXT"},
+		{"videos", "waveform_url", "TEXT"},
+		{"videos", "waveform_image_url", "TEXT"},
+		{"videos", "duration_seconds", "REAL"},
+		{"videos", "width", "INTEGER"},
+		{"videos", "height", "INTEGER"},
+		{"videos", "frame_rate", "REAL"},
+		{"videos", "bitrate", "INTEGER"},
+		{"videos", "video_codec", "TEXT"},
+		{"videos", "audio_codec", "TEXT"},
+		{"videos", "rotation", "INTEGER"},
+		{"videos", "file_size", "INTEGER"},
+		{"videos", "aspect_ratio", "TEXT"},
+		{"videos", "parent_video_id", "TEXT"},
+		{"videos", "watermarked", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"videos", "unwatermarked_url", "TEXT"},
+		{"video_objects", "is_prefix", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"pending_deletions", "is_prefix", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"jobs", "source_key", "TEXT NOT NULL DEFAULT ''"},
+		{"jobs", "clip_start", "REAL"},
+		{"jobs", "clip_end", "REAL"},
+		{"jobs", "source_watermarked", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+	for _, col := range columns {
+		if err := c.addColumnIfMissing(col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -79,9 +296,30 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM watermarks"); err != nil {
+		return fmt.Errorf("failed to reset table watermarks: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM multipart_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table multipart_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM tus_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table tus_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_objects"); err != nil {
+		return fmt.Errorf("failed to reset table video_objects: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM pending_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table pending_deletions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM captions"); err != nil {
+		return fmt.Errorf("failed to reset table captions: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued     JobStatus = "queued"
+	JobStatusProcessing JobStatus = "processing"
+	JobStatusReady      JobStatus = "ready"
+	JobStatusFailed     JobStatus = "failed"
+)
+
+type Job struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    JobStatus `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     *string   `json:"error"`
+	NextRunAt time.Time `json:"next_run_at"`
+	CreateJobParams
+}
+
+// CreateJobParams names the uploaded source either as a local SourcePath
+// or as a SourceKey in the object store that the worker downloads first.
+// A clip job sets ClipStart and ClipEnd, in seconds, to process only that part of the source,
+// and SourceWatermarked when the source already carries a watermark.
+type CreateJobParams struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	SourcePath  string    `json:"source_path"`
+	SourceKey   string    `json:"source_key"`
+	MediaType   string    `json:"media_type"`
+	MaxAttempts int       `json:"max_attempts"`
+	ClipStart   *float64  `json:"clip_start,omitempty"`
+	ClipEnd     *float64  `json:"clip_end,omitempty"`
+	// SourceWatermarked keeps processing from burning in a second watermark
+	SourceWatermarked bool `json:"source_watermarked,omitempty"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		status,
+		source_path,
+		source_key,
+		media_type,
+		attempts,
+		max_attempts,
+		error,
+		next_run_at,
+		clip_start,
+		clip_end,
+		source_watermarked`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.Status,
+		&job.SourcePath,
+		&job.SourceKey,
+		&job.MediaType,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.Error,
+		&job.NextRunAt,
+		&job.ClipStart,
+		&job.ClipEnd,
+		&job.SourceWatermarked,
+	)
+	return job, err
+}
+
+// execer is a *sql.DB or a *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id, err := createJob(c.db, params)
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func createJob(db execer, params CreateJobParams) (uuid.UUID, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		status,
+		source_path,
+		source_key,
+		media_type,
+		attempts,
+		max_attempts,
+		next_run_at,
+		clip_start,
+		clip_end,
+		source_watermarked
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?)
+	`
+	_, err := db.Exec(
+		query,
+		id,
+		now,
+		now,
+		params.VideoID,
+		JobStatusQueued,
+		params.SourcePath,
+		params.SourceKey,
+		params.MediaType,
+		params.MaxAttempts,
+		now,
+		params.ClipStart,
+		params.ClipEnd,
+		params.SourceWatermarked,
+	)
+	return id, err
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	return scanJob(c.db.QueryRow(query, id))
+}
+
+// GetLatestJobForVideo returns nil when the video has never been queued for processing
+func (c Client) GetLatestJobForVideo(videoID uuid.UUID) (*Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	job, err := scanJob(c.db.QueryRow(query, videoID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ClaimNextJob atomically moves the oldest due job to processing, it returns nil when nothing is due
+func (c Client) ClaimNextJob(now time.Time) (*Job, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		updated_at = ?
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = ? AND next_run_at <= ?
+		ORDER BY next_run_at ASC
+		LIMIT 1
+	)
+	RETURNING` + jobColumns
+	job, err := scanJob(c.db.QueryRow(query, JobStatusProcessing, now.UTC(), JobStatusQueued, now.UTC()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (c Client) MarkJobReady(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = NULL,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusReady, time.Now().UTC(), id)
+	return err
+}
+
+func (c Client) MarkJobFailed(id uuid.UUID, errMsg string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, errMsg, time.Now().UTC(), id)
+	return err
+}
+
+// RetryJob puts a job back in the queue, it won't be claimed again before nextRunAt
+func (c Client) RetryJob(id uuid.UUID, errMsg string, nextRunAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = ?,
+		next_run_at = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, errMsg, nextRunAt.UTC(), time.Now().UTC(), id)
+	return err
+}
+
+// RequeueInterruptedJobs resets jobs left in processing by a crash or restart
+func (c Client) RequeueInterruptedJobs() (int64, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		updated_at = ?
+	WHERE status = ?
+	`
+	result, err := c.db.Exec(query, JobStatusQueued, time.Now().UTC(), JobStatusProcessing)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetUnfinishedJobSourceKeys lists the object store sources of jobs that are queued or processing
+func (c Client) GetUnfinishedJobSourceKeys() ([]string, error) {
+	query := `
+	SELECT source_key
+	FROM jobs
+	WHERE status IN (?, ?) AND source_key != ''
+	`
+	rows, err := c.db.Query(query, JobStatusQueued, JobStatusProcessing)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
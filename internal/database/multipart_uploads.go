@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type MultipartUpload struct {
+	CreatedAt time.Time `json:"created_at"`
+	CreateMultipartUploadParams
+}
+
+type CreateMultipartUploadParams struct {
+	UploadID  string    `json:"upload_id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	ObjectKey string    `json:"object_key"`
+	MediaType string    `json:"media_type"`
+	Size      int64     `json:"size"`
+}
+
+const multipartUploadColumns = `
+		upload_id,
+		created_at,
+		video_id,
+		user_id,
+		object_key,
+		media_type,
+		size`
+
+func scanMultipartUpload(row rowScanner) (MultipartUpload, error) {
+	var upload MultipartUpload
+	err := row.Scan(
+		&upload.UploadID,
+		&upload.CreatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.ObjectKey,
+		&upload.MediaType,
+		&upload.Size,
+	)
+	return upload, err
+}
+
+func (c Client) CreateMultipartUpload(params CreateMultipartUploadParams) error {
+	query := `
+	INSERT INTO multipart_uploads (
+		upload_id,
+		created_at,
+		video_id,
+		user_id,
+		object_key,
+		media_type,
+		size
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		params.UploadID,
+		time.Now().UTC(),
+		params.VideoID,
+		params.UserID,
+		params.ObjectKey,
+		params.MediaType,
+		params.Size,
+	)
+	return err
+}
+
+// GetMultipartUpload returns nil when there is no upload with that id
+func (c Client) GetMultipartUpload(uploadID string) (*MultipartUpload, error) {
+	query := `
+	SELECT` + multipartUploadColumns + `
+	FROM multipart_uploads
+	WHERE upload_id = ?
+	`
+	upload, err := scanMultipartUpload(c.db.QueryRow(query, uploadID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (c Client) DeleteMultipartUpload(uploadID string) error {
+	_, err := c.db.Exec("DELETE FROM multipart_uploads WHERE upload_id = ?", uploadID)
+	return err
+}
+
+func (c Client) GetMultipartUploadsCreatedBefore(cutoff time.Time) ([]MultipartUpload, error) {
+	query := `
+	SELECT` + multipartUploadColumns + `
+	FROM multipart_uploads
+	WHERE created_at <= ?
+	`
+	rows, err := c.db.Query(query, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []MultipartUpload{}
+	for rows.Next() {
+		upload, err := scanMultipartUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
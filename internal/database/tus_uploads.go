@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type TusUpload struct {
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	UploadOffset int64      `json:"upload_offset"`
+	CompletedAt  *time.Time `json:"completed_at"`
+	CreateTusUploadParams
+}
+
+type CreateTusUploadParams struct {
+	VideoID      uuid.UUID `json:"video_id"`
+	UserID       uuid.UUID `json:"user_id"`
+	UploadLength int64     `json:"upload_length"`
+	MediaType    string    `json:"media_type"`
+	FilePath     string    `json:"file_path"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+const tusUploadColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		media_type,
+		file_path,
+		expires_at,
+		completed_at`
+
+func scanTusUpload(row rowScanner) (TusUpload, error) {
+	var upload TusUpload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.UploadLength,
+		&upload.UploadOffset,
+		&upload.MediaType,
+		&upload.FilePath,
+		&upload.ExpiresAt,
+		&upload.CompletedAt,
+	)
+	return upload, err
+}
+
+func (c Client) CreateTusUpload(params CreateTusUploadParams) (TusUpload, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO tus_uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		media_type,
+		file_path,
+		expires_at
+	) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		id,
+		now,
+		now,
+		params.VideoID,
+		params.UserID,
+		params.UploadLength,
+		params.MediaType,
+		params.FilePath,
+		params.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return TusUpload{}, err
+	}
+
+	upload, err := c.GetTusUpload(id)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	return *upload, nil
+}
+
+// GetTusUpload returns nil when there is no upload with that id
+func (c Client) GetTusUpload(id uuid.UUID) (*TusUpload, error) {
+	query := `
+	SELECT` + tusUploadColumns + `
+	FROM tus_uploads
+	WHERE id = ?
+	`
+	upload, err := scanTusUpload(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (c Client) UpdateTusUploadOffset(id uuid.UUID, offset int64) error {
+	query := `
+	UPDATE tus_uploads
+	SET
+		upload_offset = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, time.Now().UTC(), id)
+	return err
+}
+
+// CompleteTusUploadAndCreateJob marks the upload complete and queues its processing job in one
+// transaction, so a PATCH retried after a failure can't queue the same upload twice
+func (c Client) CompleteTusUploadAndCreateJob(id uuid.UUID, params CreateJobParams) (Job, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Job{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	query := `
+	UPDATE tus_uploads
+	SET
+		completed_at = ?,
+		updated_at = ?
+	WHERE id = ? AND completed_at IS NULL
+	`
+	result, err := tx.Exec(query, now, now, id)
+	if err != nil {
+		return Job{}, err
+	}
+	completed, err := result.RowsAffected()
+	if err != nil {
+		return Job{}, err
+	}
+	if completed == 0 {
+		return Job{}, errors.New("upload is already complete or gone")
+	}
+
+	jobID, err := createJob(tx, params)
+	if err != nil {
+		return Job{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(jobID)
+}
+
+func (c Client) DeleteTusUpload(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM tus_uploads WHERE id = ?", id)
+	return err
+}
+
+// GetExpiredTusUploads lists unfinished uploads past their expiry
+func (c Client) GetExpiredTusUploads(now time.Time) ([]TusUpload, error) {
+	query := `
+	SELECT` + tusUploadColumns + `
+	FROM tus_uploads
+	WHERE expires_at <= ?
+	`
+	rows, err := c.db.Query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []TusUpload{}
+	for rows.Next() {
+		upload, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
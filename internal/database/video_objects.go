@@ -0,0 +1,200 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ObjectRef points at a stored object, Store names the object store it lives in.
+// With Prefix set, Key covers every object stored under it.
+type ObjectRef struct {
+	Store  string `json:"store"`
+	Key    string `json:"key"`
+	Prefix bool   `json:"prefix"`
+}
+
+type VideoObject struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ObjectRef
+}
+
+type PendingDeletion struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Attempts      int       `json:"attempts"`
+	LastError     *string   `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	ObjectRef
+}
+
+func (c Client) CreateVideoObject(videoID uuid.UUID, ref ObjectRef) error {
+	query := `
+	INSERT INTO video_objects (
+		id,
+		video_id,
+		store,
+		object_key,
+		is_prefix,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, uuid.New(), videoID, ref.Store, ref.Key, ref.Prefix)
+	return err
+}
+
+func (c Client) GetVideoObjects(videoID uuid.UUID) ([]VideoObject, error) {
+	query := `
+	SELECT id, video_id, store, object_key, is_prefix, created_at
+	FROM video_objects
+	WHERE video_id = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := []VideoObject{}
+	for rows.Next() {
+		var obj VideoObject
+		if err := rows.Scan(&obj.ID, &obj.VideoID, &obj.Store, &obj.Key, &obj.Prefix, &obj.CreatedAt); err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
+
+// DeleteVideoAndQueueObjects removes the video row and queues every object that belonged to it for
+// deletion in one transaction, so a crash between the two can't leave objects nobody knows about.
+func (c Client) DeleteVideoAndQueueObjects(videoID uuid.UUID, refs []ObjectRef) ([]PendingDeletion, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM videos WHERE id = ?", videoID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM video_objects WHERE video_id = ?", videoID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM captions WHERE video_id = ?", videoID); err != nil {
+		return nil, err
+	}
+	// clips outlive the video they were cut from
+	if _, err := tx.Exec("UPDATE videos SET parent_video_id = NULL WHERE parent_video_id = ?", videoID); err != nil {
+		return nil, err
+	}
+
+	query := `
+	INSERT INTO pending_deletions (
+		id,
+		created_at,
+		store,
+		object_key,
+		is_prefix,
+		attempts,
+		next_attempt_at
+	) VALUES (?, ?, ?, ?, ?, 0, ?)
+	`
+	now := time.Now().UTC()
+	pending := []PendingDeletion{}
+	for _, ref := range refs {
+		deletion := PendingDeletion{
+			ID:            uuid.New(),
+			CreatedAt:     now,
+			NextAttemptAt: now,
+			ObjectRef:     ref,
+		}
+		if _, err := tx.Exec(query, deletion.ID, deletion.CreatedAt, ref.Store, ref.Key, ref.Prefix, deletion.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		pending = append(pending, deletion)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (c Client) GetDuePendingDeletions(now time.Time, limit int) ([]PendingDeletion, error) {
+	query := `
+	SELECT id, created_at, store, object_key, is_prefix, attempts, last_error, next_attempt_at
+	FROM pending_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at ASC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []PendingDeletion{}
+	for rows.Next() {
+		var deletion PendingDeletion
+		if err := rows.Scan(
+			&deletion.ID,
+			&deletion.CreatedAt,
+			&deletion.Store,
+			&deletion.Key,
+			&deletion.Prefix,
+			&deletion.Attempts,
+			&deletion.LastError,
+			&deletion.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		pending = append(pending, deletion)
+	}
+	return pending, rows.Err()
+}
+
+func (c Client) MarkPendingDeletionFailed(id uuid.UUID, lastError string, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE pending_deletions
+	SET
+		attempts = attempts + 1,
+		last_error = ?,
+		next_attempt_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, lastError, nextAttemptAt.UTC(), id)
+	return err
+}
+
+func (c Client) DeletePendingDeletion(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM pending_deletions WHERE id = ?", id)
+	return err
+}
+
+func (c Client) DeleteVideoObjectsByRef(ref ObjectRef) error {
+	_, err := c.db.Exec("DELETE FROM video_objects WHERE store = ? AND object_key = ? AND is_prefix = ?", ref.Store, ref.Key, ref.Prefix)
+	return err
+}
+
+func (c Client) GetPendingDeletionRefs() ([]ObjectRef, error) {
+	rows, err := c.db.Query("SELECT store, object_key, is_prefix FROM pending_deletions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []ObjectRef{}
+	for rows.Next() {
+		var ref ObjectRef
+		if err := rows.Scan(&ref.Store, &ref.Key, &ref.Prefix); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
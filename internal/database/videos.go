@@ -2,19 +2,84 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID               uuid.UUID `json:"id"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	ThumbnailURL     *string   `json:"thumbnail_url"`
+	ThumbnailSrcset  Srcset    `json:"thumbnail_srcset"`
+	VideoURL         *string   `json:"video_url"`
+	PlaylistURL      *string   `json:"playlist_url"`
+	DashManifestURL  *string   `json:"dash_manifest_url"`
+	OriginalURL      *string   `json:"original_url"`
+	StoryboardURL    *string   `json:"storyboard_url"`
+	AudioURL         *string   `json:"audio_url"`
+	WaveformURL      *string   `json:"waveform_url"`
+	WaveformImageURL *string   `json:"waveform_image_url"`
+	// ParentVideoID is the video a clip was cut from
+	ParentVideoID *uuid.UUID `json:"parent_video_id"`
+	// Watermarked is set when a logo is burned into the video, UnwatermarkedURL is the clean copy if one was kept
+	Watermarked      bool    `json:"watermarked"`
+	UnwatermarkedURL *string `json:"unwatermarked_url"`
 	CreateVideoParams
+	VideoMetadata
+}
+
+// VideoMetadata describes the processed video file, it's all nil until processing finishes
+type VideoMetadata struct {
+	DurationSeconds *float64 `json:"duration_seconds"`
+	Width           *int     `json:"width"`
+	Height          *int     `json:"height"`
+	FrameRate       *float64 `json:"frame_rate"`
+	// Bitrate is the overall bitrate in bits per second
+	Bitrate    *int64  `json:"bitrate"`
+	VideoCodec *string `json:"video_codec"`
+	AudioCodec *string `json:"audio_codec"`
+	// Rotation is the clockwise rotation in degrees players apply to the coded frames
+	Rotation *int   `json:"rotation"`
+	FileSize *int64 `json:"file_size"`
+	// AspectRatio is the displayed shape: 16:9, 9:16, 4:3, 3:4, 1:1, 21:9, 4:5 or other
+	AspectRatio *string `json:"aspect_ratio"`
+}
+
+// Srcset maps an image media type to a srcset attribute value ("url 320w, url 640w"),
+// it's stored as a JSON object
+type Srcset map[string]string
+
+func (s *Srcset) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unsupported srcset column type %T", src)
+	}
+	return json.Unmarshal(data, s)
+}
+
+func (s Srcset) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
 }
 
 type CreateVideoParams struct {
@@ -23,23 +88,80 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// videoColumns is shared by every query that scans a full Video, keep it in sync with scanVideo
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_srcset,
 		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+		playlist_url,
+		dash_manifest_url,
+		original_url,
+		storyboard_url,
+		audio_url,
+		waveform_url,
+		waveform_image_url,
+		duration_seconds,
+		width,
+		height,
+		frame_rate,
+		bitrate,
+		video_codec,
+		audio_codec,
+		rotation,
+		file_size,
+		aspect_ratio,
+		parent_video_id,
+		watermarked,
+		unwatermarked_url,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailSrcset,
+		&video.VideoURL,
+		&video.PlaylistURL,
+		&video.DashManifestURL,
+		&video.OriginalURL,
+		&video.StoryboardURL,
+		&video.AudioURL,
+		&video.WaveformURL,
+		&video.WaveformImageURL,
+		&video.DurationSeconds,
+		&video.Width,
+		&video.Height,
+		&video.FrameRate,
+		&video.Bitrate,
+		&video.VideoCodec,
+		&video.AudioCodec,
+		&video.Rotation,
+		&video.FileSize,
+		&video.AspectRatio,
+		&video.ParentVideoID,
+		&video.Watermarked,
+		&video.UnwatermarkedURL,
+		&video.UserID,
+	)
+	return video, err
+}
 
-	rows, err := c.db.Query(query, userID)
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,26 +169,44 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, userID)
+}
+
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	`
+	return c.queryVideos(query)
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+	return c.createVideo(params, nil)
+}
+
+// CreateClipVideo creates a video cut from parentID, it has no file until its clip job finishes
+func (c Client) CreateClipVideo(params CreateVideoParams, parentID uuid.UUID) (Video, error) {
+	return c.createVideo(params, &parentID)
+}
+
+func (c Client) createVideo(params CreateVideoParams, parentID *uuid.UUID) (Video, error) {
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,10 +215,11 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		parent_video_id,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, parentID, params.UserID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +229,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -128,7 +252,27 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_srcset = ?,
 		video_url = ?,
+		playlist_url = ?,
+		dash_manifest_url = ?,
+		original_url = ?,
+		storyboard_url = ?,
+		audio_url = ?,
+		waveform_url = ?,
+		waveform_image_url = ?,
+		duration_seconds = ?,
+		width = ?,
+		height = ?,
+		frame_rate = ?,
+		bitrate = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		rotation = ?,
+		file_size = ?,
+		aspect_ratio = ?,
+		watermarked = ?,
+		unwatermarked_url = ?,
 		user_id = ?
 	WHERE id = ?
 	`
@@ -138,7 +282,27 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailSrcset,
 		&video.VideoURL,
+		&video.PlaylistURL,
+		&video.DashManifestURL,
+		&video.OriginalURL,
+		&video.StoryboardURL,
+		&video.AudioURL,
+		&video.WaveformURL,
+		&video.WaveformImageURL,
+		video.DurationSeconds,
+		video.Width,
+		video.Height,
+		video.FrameRate,
+		video.Bitrate,
+		video.VideoCodec,
+		video.AudioCodec,
+		video.Rotation,
+		video.FileSize,
+		video.AspectRatio,
+		video.Watermarked,
+		video.UnwatermarkedURL,
 		video.UserID,
 		video.ID,
 	)
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Watermark is a user's logo overlay, it replaces the server-wide one for their videos
+type Watermark struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	SaveWatermarkParams
+}
+
+type SaveWatermarkParams struct {
+	UserID   uuid.UUID `json:"user_id"`
+	ImageKey string    `json:"-"`
+	ImageURL string    `json:"image_url"`
+	Position string    `json:"position"`
+	Opacity  float64   `json:"opacity"`
+	// Margin is in pixels of the processed video
+	Margin int `json:"margin"`
+	// Scale is the logo's width as a fraction of the video's
+	Scale        float64 `json:"scale"`
+	KeepOriginal bool    `json:"keep_original"`
+}
+
+const watermarkColumns = `
+		user_id,
+		created_at,
+		updated_at,
+		image_key,
+		image_url,
+		position,
+		opacity,
+		margin,
+		scale,
+		keep_original`
+
+func scanWatermark(row rowScanner) (Watermark, error) {
+	var watermark Watermark
+	err := row.Scan(
+		&watermark.UserID,
+		&watermark.CreatedAt,
+		&watermark.UpdatedAt,
+		&watermark.ImageKey,
+		&watermark.ImageURL,
+		&watermark.Position,
+		&watermark.Opacity,
+		&watermark.Margin,
+		&watermark.Scale,
+		&watermark.KeepOriginal,
+	)
+	return watermark, err
+}
+
+// SaveWatermark sets the user's watermark, replacing any they had
+func (c Client) SaveWatermark(params SaveWatermarkParams) (Watermark, error) {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO watermarks (
+		user_id,
+		created_at,
+		updated_at,
+		image_key,
+		image_url,
+		position,
+		opacity,
+		margin,
+		scale,
+		keep_original
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (user_id) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		image_key = excluded.image_key,
+		image_url = excluded.image_url,
+		position = excluded.position,
+		opacity = excluded.opacity,
+		margin = excluded.margin,
+		scale = excluded.scale,
+		keep_original = excluded.keep_original
+	`
+	_, err := c.db.Exec(
+		query,
+		params.UserID,
+		now,
+		now,
+		params.ImageKey,
+		params.ImageURL,
+		params.Position,
+		params.Opacity,
+		params.Margin,
+		params.Scale,
+		params.KeepOriginal,
+	)
+	if err != nil {
+		return Watermark{}, err
+	}
+
+	watermark, err := c.GetWatermark(params.UserID)
+	if err != nil {
+		return Watermark{}, err
+	}
+	if watermark == nil {
+		return Watermark{}, errors.New("watermark missing after save")
+	}
+	return *watermark, nil
+}
+
+// GetWatermark returns nil when the user hasn't set one
+func (c Client) GetWatermark(userID uuid.UUID) (*Watermark, error) {
+	query := `
+	SELECT` + watermarkColumns + `
+	FROM watermarks
+	WHERE user_id = ?
+	`
+	watermark, err := scanWatermark(c.db.QueryRow(query, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &watermark, nil
+}
+
+func (c Client) GetAllWatermarks() ([]Watermark, error) {
+	query := `
+	SELECT` + watermarkColumns + `
+	FROM watermarks
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watermarks := []Watermark{}
+	for rows.Next() {
+		watermark, err := scanWatermark(rows)
+		if err != nil {
+			return nil, err
+		}
+		watermarks = append(watermarks, watermark)
+	}
+	return watermarks, rows.Err()
+}
+
+func (c Client) DeleteWatermark(userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM watermarks WHERE user_id = ?", userID)
+	return err
+}
@@ -0,0 +1,153 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrNotMP4      = errors.New("mp4: not an ISO base media file")
+	ErrNoMoov      = errors.New("mp4: no moov box")
+	ErrUnsupported = errors.New("mp4: unsupported file layout")
+)
+
+// maxMoovSize bounds how much of a file is read into memory, a moov box describing
+// hours of video is still only tens of megabytes
+const maxMoovSize = 256 << 20
+
+// boxHeader locates a box in the file, Offset is where its header starts
+type boxHeader struct {
+	Type       string
+	Offset     int64
+	Size       int64
+	HeaderSize int64
+}
+
+func (h boxHeader) end() int64 {
+	return h.Offset + h.Size
+}
+
+// readBoxHeader reads the header of the box starting at offset in a file of fileSize bytes
+func readBoxHeader(r io.ReaderAt, offset, fileSize int64) (boxHeader, error) {
+	buf := make([]byte, 16)
+	if _, err := r.ReadAt(buf[:8], offset); err != nil {
+		return boxHeader{}, fmt.Errorf("mp4: reading box header at %d: %w", offset, err)
+	}
+	h := boxHeader{
+		Type:       string(buf[4:8]),
+		Offset:     offset,
+		Size:       int64(binary.BigEndian.Uint32(buf[0:4])),
+		HeaderSize: 8,
+	}
+
+	switch h.Size {
+	case 0:
+		// the box runs to the end of the file
+		h.Size = fileSize - offset
+	case 1:
+		if _, err := r.ReadAt(buf[8:16], offset+8); err != nil {
+			return boxHeader{}, fmt.Errorf("mp4: reading box size at %d: %w", offset, err)
+		}
+		largeSize := binary.BigEndian.Uint64(buf[8:16])
+		if largeSize > uint64(fileSize) {
+			return boxHeader{}, fmt.Errorf("mp4: %q box at %d runs past the end of the file", h.Type, offset)
+		}
+		h.Size = int64(largeSize)
+		h.HeaderSize = 16
+	}
+
+	if h.Size < h.HeaderSize || h.end() > fileSize {
+		return boxHeader{}, fmt.Errorf("mp4: %q box at %d has an invalid size %d", h.Type, offset, h.Size)
+	}
+	return h, nil
+}
+
+// topLevelBoxes lists the boxes making up the file
+func topLevelBoxes(r io.ReaderAt, fileSize int64) ([]boxHeader, error) {
+	boxes := []boxHeader{}
+	for offset := int64(0); offset < fileSize; {
+		if fileSize-offset < 8 {
+			// trailing padding some muxers leave behind
+			break
+		}
+		h, err := readBoxHeader(r, offset, fileSize)
+		if err != nil {
+			if len(boxes) == 0 {
+				return nil, ErrNotMP4
+			}
+			return nil, err
+		}
+		if len(boxes) == 0 && !isTopLevelType(h.Type) {
+			return nil, ErrNotMP4
+		}
+		boxes = append(boxes, h)
+		offset = h.end()
+	}
+	if len(boxes) == 0 {
+		return nil, ErrNotMP4
+	}
+	return boxes, nil
+}
+
+// isTopLevelType recognises the boxes a file may start with, QuickTime files predating ftyp included
+func isTopLevelType(boxType string) bool {
+	switch boxType {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "pnot", "styp":
+		return true
+	}
+	return false
+}
+
+// readBox loads a whole box into memory
+func readBox(r io.ReaderAt, h boxHeader) ([]byte, error) {
+	if h.Size > maxMoovSize {
+		return nil, fmt.Errorf("%w: %q box is %d bytes", ErrUnsupported, h.Type, h.Size)
+	}
+	data := make([]byte, h.Size)
+	if _, err := r.ReadAt(data, h.Offset); err != nil {
+		return nil, fmt.Errorf("mp4: reading %q box: %w", h.Type, err)
+	}
+	return data, nil
+}
+
+// walkBoxes calls fn for every box in data, body is the box content after its header
+// and aliases data so changes to it are visible to the caller
+func walkBoxes(data []byte, fn func(boxType string, body []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return fmt.Errorf("mp4: %d stray bytes after the last box", len(data))
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return fmt.Errorf("mp4: truncated %q box header", boxType)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return fmt.Errorf("mp4: %q box has an invalid size %d", boxType, size)
+		}
+
+		if err := fn(boxType, data[headerSize:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// fullBox splits a full box body into its version and the content after the version and flags
+func fullBox(body []byte) (byte, []byte, error) {
+	if len(body) < 4 {
+		return 0, nil, errors.New("mp4: truncated full box")
+	}
+	return body[0], body[4:], nil
+}
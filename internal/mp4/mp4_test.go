@@ -0,0 +1,322 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], boxType)
+	return append(out, body...)
+}
+
+func fullBoxPayload(version byte, fields ...any) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{version, 0, 0, 0})
+	for _, field := range fields {
+		binary.Write(buf, binary.BigEndian, field)
+	}
+	return buf.Bytes()
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// identity and 90° clockwise tkhd matrices
+var (
+	identityMatrix = []int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000}
+	rotate90Matrix = []int32{0, 0x10000, 0, -0x10000, 0, 0, 0, 0, 0x40000000}
+)
+
+func tkhd(trackID uint32, matrix []int32, width, height uint32) []byte {
+	return box("tkhd", fullBoxPayload(0,
+		uint32(0), uint32(0), trackID, uint32(0), uint32(0),
+		uint64(0), uint16(0), uint16(0), uint16(0), uint16(0),
+		matrix, width<<16, height<<16,
+	))
+}
+
+func mdhd(timescale, duration uint32) []byte {
+	return box("mdhd", fullBoxPayload(0, uint32(0), uint32(0), timescale, duration, uint32(0)))
+}
+
+func hdlr(handler string) []byte {
+	return box("hdlr", fullBoxPayload(0, uint32(0), []byte(handler), zeros(12), []byte("\x00")))
+}
+
+func stbl(sampleEntry []byte, samples uint32, offsetBox []byte) []byte {
+	return box("stbl",
+		box("stsd", fullBoxPayload(0, uint32(1)), sampleEntry),
+		box("stts", fullBoxPayload(0, uint32(1), samples, uint32(1000))),
+		offsetBox,
+	)
+}
+
+func stco(offsets ...uint32) []byte {
+	return box("stco", fullBoxPayload(0, uint32(len(offsets)), offsets))
+}
+
+func co64(offsets ...uint64) []byte {
+	return box("co64", fullBoxPayload(0, uint32(len(offsets)), offsets))
+}
+
+func avc1(width, height uint16, profile byte) []byte {
+	entry := &bytes.Buffer{}
+	entry.Write(zeros(6))
+	binary.Write(entry, binary.BigEndian, uint16(1))
+	entry.Write(zeros(16))
+	binary.Write(entry, binary.BigEndian, width)
+	binary.Write(entry, binary.BigEndian, height)
+	entry.Write(zeros(50))
+	entry.Write(box("avcC", []byte{1, profile, 0, 31}))
+	entry.Write(box("pasp", []byte{0, 0, 0, 1, 0, 0, 0, 1}))
+	return box("avc1", entry.Bytes())
+}
+
+func mp4a(objectType byte) []byte {
+	entry := &bytes.Buffer{}
+	entry.Write(zeros(6))
+	binary.Write(entry, binary.BigEndian, uint16(1))
+	entry.Write(zeros(8))
+	binary.Write(entry, binary.BigEndian, uint16(2))
+	binary.Write(entry, binary.BigEndian, uint16(16))
+	entry.Write(zeros(4))
+	binary.Write(entry, binary.BigEndian, uint32(48000)<<16)
+	// ES_Descriptor(ES_ID 1, no flags) holding a DecoderConfigDescriptor
+	esds := []byte{0x03, 0x08, 0x00, 0x01, 0x00, 0x04, 0x03, objectType, 0x15, 0x00}
+	entry.Write(box("esds", fullBoxPayload(0), esds))
+	return box("mp4a", entry.Bytes())
+}
+
+func videoTrak(matrix []int32, offsetBox []byte) []byte {
+	return box("trak",
+		tkhd(1, matrix, 1920, 1080),
+		box("mdia",
+			mdhd(30000, 300000),
+			hdlr("vide"),
+			box("minf", stbl(avc1(1920, 1080, 100), 300, offsetBox)),
+		),
+	)
+}
+
+func audioTrak(offsetBox []byte) []byte {
+	return box("trak",
+		tkhd(2, identityMatrix, 0, 0),
+		box("mdia",
+			mdhd(48000, 480000),
+			hdlr("soun"),
+			box("minf", stbl(mp4a(0x40), 469, offsetBox)),
+		),
+	)
+}
+
+func mvhd(timescale, duration uint32) []byte {
+	return box("mvhd", fullBoxPayload(0, uint32(0), uint32(0), timescale, duration, zeros(80)))
+}
+
+var ftyp = box("ftyp", []byte("isom"), []byte{0, 0, 2, 0}, []byte("isomiso2avc1mp41"))
+
+// buildFile lays out ftyp, mdat and moov (in that order unless moovFirst) with the chunk
+// offset tables pointing at the two markers inside mdat
+func buildFile(t *testing.T, moovFirst, largeOffsets bool, matrix []int32) ([]byte, []byte, []byte) {
+	t.Helper()
+	videoChunk := []byte("VIDEO-CHUNK")
+	audioChunk := []byte("AUDIO-CHUNK")
+	mdatPayload := append(append(append([]byte{}, videoChunk...), zeros(32)...), audioChunk...)
+	mdat := box("mdat", mdatPayload)
+
+	moovFor := func(videoOffset, audioOffset uint64) []byte {
+		videoOffsets, audioOffsets := stco(uint32(videoOffset)), stco(uint32(audioOffset))
+		if largeOffsets {
+			videoOffsets, audioOffsets = co64(videoOffset), co64(audioOffset)
+		}
+		return box("moov", mvhd(1000, 10000), videoTrak(matrix, videoOffsets), audioTrak(audioOffsets))
+	}
+
+	// sizes don't depend on the offset values, build once to measure
+	moovSize := uint64(len(moovFor(0, 0)))
+	mdatStart := uint64(len(ftyp))
+	if moovFirst {
+		mdatStart += moovSize
+	}
+	videoOffset := mdatStart + 8
+	audioOffset := videoOffset + uint64(len(videoChunk)) + 32
+	moov := moovFor(videoOffset, audioOffset)
+
+	if moovFirst {
+		return bytes.Join([][]byte{ftyp, moov, mdat}, nil), videoChunk, audioChunk
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil), videoChunk, audioChunk
+}
+
+func TestProbe(t *testing.T) {
+	file, _, _ := buildFile(t, false, false, rotate90Matrix)
+
+	info, err := Probe(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+
+	if info.MajorBrand != "isom" {
+		t.Errorf("MajorBrand = %q, want isom", info.MajorBrand)
+	}
+	if info.Duration != 10*time.Second {
+		t.Errorf("Duration = %v, want 10s", info.Duration)
+	}
+	if info.FastStart {
+		t.Errorf("FastStart = true for a file with moov after mdat")
+	}
+	if len(info.Tracks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(info.Tracks))
+	}
+
+	video := info.Tracks[0]
+	if video.Handler != "vide" || video.Codec != "avc1" {
+		t.Errorf("video track is %s/%s, want vide/avc1", video.Handler, video.Codec)
+	}
+	if video.Width != 1920 || video.Height != 1080 {
+		t.Errorf("video size = %dx%d, want 1920x1080", video.Width, video.Height)
+	}
+	if video.Rotation != 90 {
+		t.Errorf("Rotation = %d, want 90", video.Rotation)
+	}
+	if video.AVCProfile != 100 {
+		t.Errorf("AVCProfile = %d, want 100", video.AVCProfile)
+	}
+	if video.PixelAspect != [2]uint32{1, 1} {
+		t.Errorf("PixelAspect = %v, want [1 1]", video.PixelAspect)
+	}
+	if video.Samples != 300 || video.Duration != 10*time.Second {
+		t.Errorf("video has %d samples over %v, want 300 over 10s", video.Samples, video.Duration)
+	}
+
+	audio := info.Tracks[1]
+	if audio.Handler != "soun" || audio.Codec != "mp4a" || audio.ObjectType != 0x40 {
+		t.Errorf("audio track is %s/%s object type %#x, want soun/mp4a 0x40", audio.Handler, audio.Codec, audio.ObjectType)
+	}
+	if audio.Channels != 2 || audio.SampleRate != 48000 {
+		t.Errorf("audio is %d channels at %d Hz, want 2 at 48000", audio.Channels, audio.SampleRate)
+	}
+	if audio.Rotation != 0 {
+		t.Errorf("audio Rotation = %d, want 0", audio.Rotation)
+	}
+}
+
+func TestProbeFastStart(t *testing.T) {
+	file, _, _ := buildFile(t, true, false, identityMatrix)
+
+	info, err := Probe(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+	if !info.FastStart {
+		t.Errorf("FastStart = false for a file with moov before mdat")
+	}
+	if info.Tracks[0].Rotation != 0 {
+		t.Errorf("Rotation = %d, want 0", info.Tracks[0].Rotation)
+	}
+}
+
+func TestProbeRejects(t *testing.T) {
+	file, _, _ := buildFile(t, false, false, identityMatrix)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{name: "not mp4", data: []byte("this is a plain text file, nothing to see"), want: ErrNotMP4},
+		{name: "empty", data: []byte{}, want: ErrNotMP4},
+		{name: "no moov", data: bytes.Join([][]byte{ftyp, box("mdat", zeros(16))}, nil), want: ErrNoMoov},
+		{name: "truncated", data: file[:len(file)-10]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Probe(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err == nil {
+				t.Fatalf("Probe() succeeded, want an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Probe() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	for _, largeOffsets := range []bool{false, true} {
+		name := "stco"
+		if largeOffsets {
+			name = "co64"
+		}
+		t.Run(name, func(t *testing.T) {
+			file, videoChunk, audioChunk := buildFile(t, false, largeOffsets, identityMatrix)
+
+			out := &bytes.Buffer{}
+			err := Relocate(bytes.NewReader(file), int64(len(file)), out)
+			if err != nil {
+				t.Fatalf("Relocate() error = %v", err)
+			}
+			relocated := out.Bytes()
+			if len(relocated) != len(file) {
+				t.Fatalf("relocated file is %d bytes, want %d", len(relocated), len(file))
+			}
+
+			info, err := Probe(bytes.NewReader(relocated), int64(len(relocated)))
+			if err != nil {
+				t.Fatalf("Probe() of relocated file error = %v", err)
+			}
+			if !info.FastStart {
+				t.Errorf("relocated file isn't faststart")
+			}
+
+			boxes, err := topLevelBoxes(bytes.NewReader(relocated), int64(len(relocated)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotOrder := []string{}
+			for _, h := range boxes {
+				gotOrder = append(gotOrder, h.Type)
+			}
+			if want := []string{"ftyp", "moov", "mdat"}; !slices.Equal(gotOrder, want) {
+				t.Errorf("box order = %v, want %v", gotOrder, want)
+			}
+
+			moov, err := readBox(bytes.NewReader(relocated), boxes[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			offsets := []uint64{}
+			rewriteChunkOffsets(moov[8:], func(offset uint64) (uint64, error) {
+				offsets = append(offsets, offset)
+				return offset, nil
+			})
+			if len(offsets) != 2 {
+				t.Fatalf("found %d chunk offsets, want 2", len(offsets))
+			}
+			for i, chunk := range [][]byte{videoChunk, audioChunk} {
+				start := offsets[i]
+				if !bytes.Equal(relocated[start:start+uint64(len(chunk))], chunk) {
+					t.Errorf("chunk offset %d points at %q, want %q", start, relocated[start:start+uint64(len(chunk))], chunk)
+				}
+			}
+		})
+	}
+}
+
+func TestRelocateNoMoov(t *testing.T) {
+	file := bytes.Join([][]byte{ftyp, box("mdat", zeros(16))}, nil)
+	err := Relocate(bytes.NewReader(file), int64(len(file)), &bytes.Buffer{})
+	if !errors.Is(err, ErrNoMoov) {
+		t.Errorf("Relocate() error = %v, want %v", err, ErrNoMoov)
+	}
+}
@@ -0,0 +1,382 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+type Info struct {
+	MajorBrand       string
+	CompatibleBrands []string
+	Duration         time.Duration
+	Size             int64
+	// FastStart is set when moov comes before the media data, so playback can start mid-download
+	FastStart bool
+	// Fragmented files carry their samples in moof boxes rather than the moov sample tables
+	Fragmented bool
+	Tracks     []Track
+}
+
+type Track struct {
+	ID uint32
+	// Handler is the track kind, "vide" and "soun" for video and audio
+	Handler string
+	// Codec is the sample entry type, e.g. avc1, hvc1 or mp4a
+	Codec    string
+	Duration time.Duration
+	// Samples is the number of samples (frames for video) in the track
+	Samples uint32
+
+	// video tracks
+	Width, Height int
+	// PixelAspect is the pasp box's horizontal and vertical spacing, zero when absent
+	PixelAspect [2]uint32
+	// Rotation is the clockwise rotation in degrees the tkhd matrix asks players to apply
+	Rotation int
+	// AVCProfile is the profile_idc from avcC, zero for other codecs
+	AVCProfile byte
+
+	// audio tracks
+	Channels   int
+	SampleRate int
+	// ObjectType is the esds objectTypeIndication, it tells AAC (0x40) from MP3 (0x6B) in mp4a entries
+	ObjectType byte
+}
+
+// Probe reads the structure of an MP4 or QuickTime file without decoding any media
+func Probe(r io.ReaderAt, size int64) (*Info, error) {
+	boxes, err := topLevelBoxes(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Size: size}
+	moovIndex, mdatIndex := -1, -1
+	for i, h := range boxes {
+		switch h.Type {
+		case "ftyp":
+			data, err := readBox(r, h)
+			if err != nil {
+				return nil, err
+			}
+			parseFtyp(info, data[h.HeaderSize:])
+		case "moov":
+			if moovIndex == -1 {
+				moovIndex = i
+			}
+		case "mdat":
+			if mdatIndex == -1 {
+				mdatIndex = i
+			}
+		case "moof":
+			info.Fragmented = true
+		}
+	}
+	if moovIndex == -1 {
+		return nil, ErrNoMoov
+	}
+	info.FastStart = mdatIndex == -1 || moovIndex < mdatIndex
+
+	moov, err := readBox(r, boxes[moovIndex])
+	if err != nil {
+		return nil, err
+	}
+	if err := parseMoov(info, moov[boxes[moovIndex].HeaderSize:]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func parseFtyp(info *Info, body []byte) {
+	if len(body) < 8 {
+		return
+	}
+	info.MajorBrand = string(body[0:4])
+	for i := 8; i+4 <= len(body); i += 4 {
+		info.CompatibleBrands = append(info.CompatibleBrands, string(body[i:i+4]))
+	}
+}
+
+func parseMoov(info *Info, body []byte) error {
+	return walkBoxes(body, func(boxType string, body []byte) error {
+		switch boxType {
+		case "mvhd":
+			timescale, duration, err := parseMediaHeader(body)
+			if err != nil {
+				return fmt.Errorf("mp4: mvhd: %w", err)
+			}
+			info.Duration = scaleDuration(duration, timescale)
+		case "mvex":
+			info.Fragmented = true
+		case "cmov":
+			return fmt.Errorf("%w: compressed moov", ErrUnsupported)
+		case "trak":
+			track := Track{}
+			if err := parseTrak(&track, body); err != nil {
+				return err
+			}
+			info.Tracks = append(info.Tracks, track)
+		}
+		return nil
+	})
+}
+
+// parseMediaHeader reads the timescale and duration, mvhd and mdhd share the layout up to there
+func parseMediaHeader(body []byte) (uint32, uint64, error) {
+	version, content, err := fullBox(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if version == 1 {
+		if len(content) < 28 {
+			return 0, 0, errors.New("truncated header")
+		}
+		return binary.BigEndian.Uint32(content[16:]), binary.BigEndian.Uint64(content[20:]), nil
+	}
+	if len(content) < 16 {
+		return 0, 0, errors.New("truncated header")
+	}
+	return binary.BigEndian.Uint32(content[8:]), uint64(binary.BigEndian.Uint32(content[12:])), nil
+}
+
+func scaleDuration(duration uint64, timescale uint32) time.Duration {
+	if timescale == 0 || duration == math.MaxUint32 || duration == math.MaxUint64 {
+		// all ones means unknown
+		return 0
+	}
+	seconds := float64(duration) / float64(timescale)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func parseTrak(track *Track, body []byte) error {
+	return walkBoxes(body, func(boxType string, body []byte) error {
+		switch boxType {
+		case "tkhd":
+			return parseTkhd(track, body)
+		case "mdia":
+			return walkBoxes(body, func(boxType string, body []byte) error {
+				switch boxType {
+				case "mdhd":
+					timescale, duration, err := parseMediaHeader(body)
+					if err != nil {
+						return fmt.Errorf("mp4: mdhd: %w", err)
+					}
+					track.Duration = scaleDuration(duration, timescale)
+				case "hdlr":
+					_, content, err := fullBox(body)
+					if err != nil || len(content) < 8 {
+						return errors.New("mp4: truncated hdlr box")
+					}
+					track.Handler = string(content[4:8])
+				case "minf":
+					return walkBoxes(body, func(boxType string, body []byte) error {
+						if boxType != "stbl" {
+							return nil
+						}
+						return parseStbl(track, body)
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func parseTkhd(track *Track, body []byte) error {
+	version, content, err := fullBox(body)
+	if err != nil {
+		return fmt.Errorf("mp4: tkhd: %w", err)
+	}
+	// creation and modification time, track ID, reserved, duration
+	headerLen := 20
+	idOffset := 8
+	if version == 1 {
+		headerLen = 32
+		idOffset = 16
+	}
+	// reserved(8) layer(2) alternate_group(2) volume(2) reserved(2) matrix(36) width(4) height(4)
+	if len(content) < headerLen+60 {
+		return errors.New("mp4: truncated tkhd box")
+	}
+	track.ID = binary.BigEndian.Uint32(content[idOffset:])
+
+	matrix := content[headerLen+16:]
+	a := int32(binary.BigEndian.Uint32(matrix[0:]))
+	b := int32(binary.BigEndian.Uint32(matrix[4:]))
+	track.Rotation = matrixRotation(a, b)
+	return nil
+}
+
+// matrixRotation turns the first row of a tkhd matrix into a clockwise rotation
+func matrixRotation(a, b int32) int {
+	degrees := math.Atan2(float64(b), float64(a)) * 180 / math.Pi
+	rotation := int(math.Round(degrees/90)) * 90
+	return (rotation%360 + 360) % 360
+}
+
+func parseStbl(track *Track, body []byte) error {
+	return walkBoxes(body, func(boxType string, body []byte) error {
+		switch boxType {
+		case "stsd":
+			_, content, err := fullBox(body)
+			if err != nil || len(content) < 4 {
+				return errors.New("mp4: truncated stsd box")
+			}
+			parsed := false
+			return walkBoxes(content[4:], func(entryType string, entry []byte) error {
+				// only the first sample entry describes the track
+				if parsed {
+					return nil
+				}
+				parsed = true
+				track.Codec = entryType
+				return parseSampleEntry(track, entry)
+			})
+		case "stts":
+			_, content, err := fullBox(body)
+			if err != nil || len(content) < 4 {
+				return errors.New("mp4: truncated stts box")
+			}
+			count := int(binary.BigEndian.Uint32(content))
+			if len(content) < 4+count*8 {
+				return errors.New("mp4: truncated stts box")
+			}
+			track.Samples = 0
+			for i := 0; i < count; i++ {
+				track.Samples += binary.BigEndian.Uint32(content[4+i*8:])
+			}
+		}
+		return nil
+	})
+}
+
+func parseSampleEntry(track *Track, entry []byte) error {
+	switch track.Handler {
+	case "vide":
+		// reserved(6) data_reference_index(2) pre_defined/reserved(16) width(2) height(2) ... 78 bytes in all
+		if len(entry) < 78 {
+			return errors.New("mp4: truncated visual sample entry")
+		}
+		track.Width = int(binary.BigEndian.Uint16(entry[24:]))
+		track.Height = int(binary.BigEndian.Uint16(entry[26:]))
+		return walkBoxes(entry[78:], func(boxType string, body []byte) error {
+			switch boxType {
+			case "avcC":
+				if len(body) >= 2 {
+					track.AVCProfile = body[1]
+				}
+			case "pasp":
+				if len(body) >= 8 {
+					track.PixelAspect = [2]uint32{binary.BigEndian.Uint32(body[0:]), binary.BigEndian.Uint32(body[4:])}
+				}
+			}
+			return nil
+		})
+	case "soun":
+		// reserved(6) data_reference_index(2) version(2) revision(2) vendor(4)
+		// channels(2) sample_size(2) compression_id(2) packet_size(2) sample_rate(4)
+		if len(entry) < 28 {
+			return errors.New("mp4: truncated audio sample entry")
+		}
+		track.Channels = int(binary.BigEndian.Uint16(entry[16:]))
+		track.SampleRate = int(binary.BigEndian.Uint16(entry[24:]))
+
+		childrenAt := 28
+		switch binary.BigEndian.Uint16(entry[8:]) {
+		case 1:
+			// QuickTime sound description v1 adds four 32-bit fields
+			childrenAt += 16
+		case 2:
+			childrenAt += 36
+		}
+		if len(entry) < childrenAt {
+			return errors.New("mp4: truncated audio sample entry")
+		}
+		// QuickTime nests esds inside a wave box, anything we can't read just leaves ObjectType unset
+		walkBoxes(entry[childrenAt:], func(boxType string, body []byte) error {
+			switch boxType {
+			case "esds":
+				track.ObjectType = esdsObjectType(body)
+			case "wave":
+				walkBoxes(body, func(boxType string, body []byte) error {
+					if boxType == "esds" {
+						track.ObjectType = esdsObjectType(body)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// esdsObjectType digs the objectTypeIndication out of an ES_Descriptor
+func esdsObjectType(body []byte) byte {
+	_, data, err := fullBox(body)
+	if err != nil {
+		return 0
+	}
+
+	tag, data := readDescriptor(data)
+	if tag != 0x03 || len(data) < 3 {
+		return 0
+	}
+	flags := data[2]
+	data = data[3:]
+	if flags&0x80 != 0 {
+		// dependsOn_ES_ID
+		data = skipBytes(data, 2)
+	}
+	if flags&0x40 != 0 {
+		// URL
+		if len(data) == 0 {
+			return 0
+		}
+		data = skipBytes(data, 1+int(data[0]))
+	}
+	if flags&0x20 != 0 {
+		// OCR_ES_Id
+		data = skipBytes(data, 2)
+	}
+
+	tag, data = readDescriptor(data)
+	if tag != 0x04 || len(data) < 1 {
+		return 0
+	}
+	return data[0]
+}
+
+// readDescriptor returns the tag and content of an MPEG-4 descriptor, sizes use 7 bits per byte
+func readDescriptor(data []byte) (byte, []byte) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	tag := data[0]
+	size := 0
+	i := 1
+	for ; i < len(data) && i <= 4; i++ {
+		size = size<<7 | int(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			break
+		}
+	}
+	start := i + 1
+	if start > len(data) {
+		return 0, nil
+	}
+	end := min(start+size, len(data))
+	return tag, data[start:end]
+}
+
+func skipBytes(data []byte, n int) []byte {
+	if n > len(data) {
+		return nil
+	}
+	return data[n:]
+}
@@ -0,0 +1,133 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Relocate writes a copy of the file with moov moved up front, right after ftyp, and the
+// chunk offsets in every stco/co64 table rewritten to match. This is what ffmpeg's
+// -movflags faststart does, without touching the media data.
+func Relocate(r io.ReaderAt, size int64, w io.Writer) error {
+	boxes, err := topLevelBoxes(r, size)
+	if err != nil {
+		return err
+	}
+
+	moovIndex := -1
+	for i, h := range boxes {
+		if h.Type == "moov" {
+			if moovIndex != -1 {
+				return fmt.Errorf("%w: more than one moov box", ErrUnsupported)
+			}
+			moovIndex = i
+		}
+		if h.Type == "moof" {
+			return fmt.Errorf("%w: fragmented file", ErrUnsupported)
+		}
+	}
+	if moovIndex == -1 {
+		return ErrNoMoov
+	}
+
+	order := make([]int, 0, len(boxes))
+	if boxes[0].Type == "ftyp" {
+		order = append(order, 0)
+	}
+	order = append(order, moovIndex)
+	for i := range boxes {
+		if i != moovIndex && !(i == 0 && boxes[0].Type == "ftyp") {
+			order = append(order, i)
+		}
+	}
+
+	newOffsets := make([]int64, len(boxes))
+	offset := int64(0)
+	for _, i := range order {
+		newOffsets[i] = offset
+		offset += boxes[i].Size
+	}
+
+	moovHeader := boxes[moovIndex]
+	moov, err := readBox(r, moovHeader)
+	if err != nil {
+		return err
+	}
+
+	// a chunk keeps its place within whichever top-level box holds it (mdat in practice)
+	translate := func(old uint64) (uint64, error) {
+		for i, h := range boxes {
+			if old >= uint64(h.Offset) && old < uint64(h.end()) {
+				return old - uint64(h.Offset) + uint64(newOffsets[i]), nil
+			}
+		}
+		return 0, fmt.Errorf("mp4: chunk offset %d is outside the file", old)
+	}
+	err = rewriteChunkOffsets(moov[moovHeader.HeaderSize:], translate)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range order {
+		if i == moovIndex {
+			if _, err := w.Write(moov); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(r, boxes[i].Offset, boxes[i].Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteChunkOffsets updates every stco and co64 table inside moov in place
+func rewriteChunkOffsets(moov []byte, translate func(uint64) (uint64, error)) error {
+	return walkBoxes(moov, func(boxType string, body []byte) error {
+		switch boxType {
+		case "trak", "mdia", "minf", "stbl":
+			return rewriteChunkOffsets(body, translate)
+		case "cmov":
+			return fmt.Errorf("%w: compressed moov", ErrUnsupported)
+		case "stco", "co64":
+			_, content, err := fullBox(body)
+			if err != nil || len(content) < 4 {
+				return fmt.Errorf("mp4: truncated %s box", boxType)
+			}
+			count := int(binary.BigEndian.Uint32(content))
+			width := 4
+			if boxType == "co64" {
+				width = 8
+			}
+			entries := content[4:]
+			if len(entries) < count*width {
+				return fmt.Errorf("mp4: truncated %s box", boxType)
+			}
+
+			for i := 0; i < count; i++ {
+				entry := entries[i*width:]
+				if boxType == "co64" {
+					updated, err := translate(binary.BigEndian.Uint64(entry))
+					if err != nil {
+						return err
+					}
+					binary.BigEndian.PutUint64(entry, updated)
+					continue
+				}
+				updated, err := translate(uint64(binary.BigEndian.Uint32(entry)))
+				if err != nil {
+					return err
+				}
+				if updated > math.MaxUint32 {
+					// growing stco into co64 would change the size of moov itself
+					return fmt.Errorf("%w: chunk offset no longer fits in stco", ErrUnsupported)
+				}
+				binary.BigEndian.PutUint32(entry, uint32(updated))
+			}
+		}
+		return nil
+	})
+}
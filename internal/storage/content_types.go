@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"path"
+	"strings"
+)
+
+// objectContentTypes are the types of the files Tubely stores. They're kept here rather than read from
+// the host's mime.types, which minimal images lack and which disagree between distributions.
+var objectContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+	".m4s":  "video/iso.segment",
+	".mpd":  "application/dash+xml",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".vtt":  "text/vtt",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".json": "application/json",
+}
+
+// ContentTypeForKey returns the type of an object by its key's extension, application/octet-stream if unknown
+func ContentTypeForKey(key string) string {
+	if contentType, ok := objectContentTypes[strings.ToLower(path.Ext(key))]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectStores(t *testing.T) {
+	localStore, err := NewLocalStore(t.TempDir(), "http://localhost/objects")
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		store ObjectStore
+	}{
+		{
+			name:  "local",
+			store: localStore,
+		},
+		{
+			name:  "memory",
+			store: NewMemoryStore("http://localhost/objects"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := tt.store
+
+			if err := store.Put(ctx, "landscape/abc.mp4", strings.NewReader("video"), "video/mp4"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if err := store.Put(ctx, "portrait/def.mp4", strings.NewReader("other"), "video/mp4"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			body, err := store.Get(ctx, "landscape/abc.mp4")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if string(data) != "video" {
+				t.Errorf("got: %q; want: %q", data, "video")
+			}
+
+			info, err := store.Head(ctx, "landscape/abc.mp4")
+			if err != nil {
+				t.Fatalf("Head: %v", err)
+			}
+			if info.Size != 5 || info.ContentType != "video/mp4" {
+				t.Errorf("unexpected object info: %+v", info)
+			}
+
+			objects, err := store.List(ctx, "landscape/")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if len(objects) != 1 || objects[0].Key != "landscape/abc.mp4" {
+				t.Errorf("unexpected listing: %+v", objects)
+			}
+
+			url, err := store.PresignGet(ctx, "landscape/abc.mp4", time.Minute)
+			if err != nil {
+				t.Fatalf("PresignGet: %v", err)
+			}
+			if url != "http://localhost/objects/landscape/abc.mp4" {
+				t.Errorf("got: %v; want: %v", url, "http://localhost/objects/landscape/abc.mp4")
+			}
+
+			if err := store.Delete(ctx, "landscape/abc.mp4"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.Head(ctx, "landscape/abc.mp4"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got: %v; want: %v", err, ErrNotFound)
+			}
+			if _, err := store.Get(ctx, "landscape/abc.mp4"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got: %v; want: %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestLocalStoreRejectsTraversal(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://localhost/objects")
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	for _, key := range []string{"", "../escape", "a/../../escape", "/abs"} {
+		if err := store.Put(context.Background(), key, strings.NewReader("x"), "text/plain"); err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestLocalStoreContentTypes(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir(), "http://localhost/objects")
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	// none of these depend on the host's mime.types
+	keys := map[string]string{
+		"hls/master.m3u8":         "application/vnd.apple.mpegurl",
+		"dash/manifest.mpd":       "application/dash+xml",
+		"dash/720p/segment_1.m4s": "video/iso.segment",
+		"captions/en.VTT":         "text/vtt",
+		"landscape/abc.mp4":       "video/mp4",
+	}
+	for key, want := range keys {
+		if err := store.Put(ctx, key, strings.NewReader("x"), "application/octet-stream"); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+		info, err := store.Head(ctx, key)
+		if err != nil {
+			t.Fatalf("Head(%s): %v", key, err)
+		}
+		if info.ContentType != want {
+			t.Errorf("content type of %s = %q, want %q", key, info.ContentType, want)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -24,7 +26,36 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	storageBackend   string
+	objectBaseURL    string
+	store            storage.ObjectStore
+	assetStore       storage.ObjectStore
+	adminAPIKey      string
+	gcOptions        gcOptions
+	hlsEnabled       bool
+	dashEnabled      bool
+	spoolDir         string
+	jobMaxAttempts   int
+	jobTimeout       time.Duration
+	jobWake          chan struct{}
+	uploadExpiry     time.Duration
+	mediaLimits      mediaLimits
+	archiveOriginals bool
+	media            MediaProcessor
+	progress         *progressHub
+
+	// storyboardInterval is the time between seek bar preview frames, zero turns storyboards off
+	storyboardInterval time.Duration
+	// audioFormat is the audio-only rendition to produce, empty for none
+	audioFormat     string
+	waveformEnabled bool
+	// transcriber generates captions from the audio, nil when transcription is off
+	transcriber Transcriber
+	// watermark is burned into videos of users without their own, nil for none
+	watermark *watermarkConfig
+
+	autoThumbnailEnabled   bool
+	autoThumbnailTimestamp string
 }
 
 type thumbnail struct {
@@ -65,44 +96,192 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = storageBackendS3
+	}
+
+	gcInterval, err := getEnvDuration("GC_INTERVAL", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gcGracePeriod, err := getEnvDuration("GC_GRACE_PERIOD", 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gcDryRun, err := getEnvBool("GC_DRY_RUN", false)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	hlsEnabled, err := getEnvBool("HLS_ENABLED", true)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	dashEnabled, err := getEnvBool("DASH_ENABLED", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	spoolDir := os.Getenv("UPLOAD_SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = filepath.Join(os.TempDir(), "tubely-spool")
+	}
+	err = os.MkdirAll(spoolDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create upload spool directory: %v", err)
+	}
+
+	videoWorkers, err := getEnvInt("VIDEO_WORKERS", 2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobMaxAttempts, err := getEnvInt("JOB_MAX_ATTEMPTS", 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uploadExpiry, err := getEnvDuration("UPLOAD_EXPIRY", 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxVideoDuration, err := getEnvDuration("MAX_VIDEO_DURATION", 2*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxVideoDimension, err := getEnvInt("MAX_VIDEO_DIMENSION", 4096)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	archiveOriginals, err := getEnvBool("ARCHIVE_ORIGINALS", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	probeTimeout, err := getEnvDuration("FFPROBE_TIMEOUT", 30*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ffmpegTimeout, err := getEnvDuration("FFMPEG_TIMEOUT", 30*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ffmpegMaxProcesses, err := getEnvInt("FFMPEG_MAX_PROCESSES", runtime.NumCPU())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ffprobeMaxProcesses, err := getEnvInt("FFPROBE_MAX_PROCESSES", runtime.NumCPU())
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobTimeout, err := getEnvDuration("VIDEO_JOB_TIMEOUT", 2*time.Hour)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	storyboardInterval, err := getEnvDuration("STORYBOARD_INTERVAL", 5*time.Second)
 	if err != nil {
-		log.Fatal("Unable to load default AWS config")
+		log.Fatal(err)
+	}
+
+	audioFormat := os.Getenv("AUDIO_RENDITION")
+	if audioFormat != "" && !isAudioFormat(audioFormat) {
+		log.Fatalf("AUDIO_RENDITION must be %q, %q or empty", audioFormatAAC, audioFormatMP3)
+	}
+	waveformEnabled, err := getEnvBool("WAVEFORM_ENABLED", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tools := newToolRunner(toolLimits{
+		probeTimeout:   probeTimeout,
+		processTimeout: ffmpegTimeout,
+		maxProcesses:   ffmpegMaxProcesses,
+		maxProbes:      ffprobeMaxProcesses,
+	})
+
+	var transcriber Transcriber
+	switch os.Getenv("TRANSCRIBER") {
+	case "":
+	case transcriberWhisper:
+		whisper := whisperTranscriber{
+			tools:    tools,
+			binary:   os.Getenv("WHISPER_BINARY"),
+			model:    os.Getenv("WHISPER_MODEL"),
+			language: os.Getenv("WHISPER_LANGUAGE"),
+		}
+		if whisper.binary == "" {
+			whisper.binary = "whisper-cli"
+		}
+		if whisper.model == "" {
+			log.Fatal("WHISPER_MODEL must be set when TRANSCRIBER is whisper")
+		}
+		if whisper.language == "" {
+			whisper.language = "auto"
+		}
+		transcriber = whisper
+	default:
+		log.Fatalf("TRANSCRIBER must be %q or empty", transcriberWhisper)
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
+	var watermark *watermarkConfig
+	if imagePath := os.Getenv("WATERMARK_IMAGE"); imagePath != "" {
+		watermark, err = watermarkFromEnv(imagePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	autoThumbnailEnabled, err := getEnvBool("AUTO_THUMBNAIL_ENABLED", true)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+		db:             db,
+		jwtSecret:      jwtSecret,
+		platform:       platform,
+		filepathRoot:   filepathRoot,
+		assetsRoot:     assetsRoot,
+		port:           port,
+		storageBackend: storageBackend,
+		adminAPIKey:    os.Getenv("ADMIN_API_KEY"),
+		gcOptions: gcOptions{
+			gracePeriod: gcGracePeriod,
+			dryRun:      gcDryRun,
+		},
+		hlsEnabled:     hlsEnabled,
+		dashEnabled:    dashEnabled,
+		spoolDir:       spoolDir,
+		jobMaxAttempts: jobMaxAttempts,
+		jobTimeout:     jobTimeout,
+		jobWake:        make(chan struct{}, 1),
+		uploadExpiry:   uploadExpiry,
+		mediaLimits: mediaLimits{
+			maxDuration:  maxVideoDuration,
+			maxDimension: maxVideoDimension,
+		},
+		archiveOriginals: archiveOriginals,
+		media:            ffmpegProcessor{tools: tools},
+		progress:         newProgressHub(),
+
+		storyboardInterval: storyboardInterval,
+		audioFormat:        audioFormat,
+		waveformEnabled:    waveformEnabled,
+		transcriber:        transcriber,
+		watermark:          watermark,
+
+		autoThumbnailEnabled:   autoThumbnailEnabled,
+		autoThumbnailTimestamp: os.Getenv("AUTO_THUMBNAIL_TIMESTAMP"),
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -110,6 +289,22 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = cfg.configureStorage()
+	if err != nil {
+		log.Fatalf("Couldn't configure object storage: %v", err)
+	}
+
+	err = cfg.startVideoWorkers(context.Background(), videoWorkers)
+	if err != nil {
+		log.Fatalf("Couldn't start video workers: %v", err)
+	}
+
+	go cfg.runPendingDeletions(context.Background(), time.Minute)
+	go cfg.runUploadExpiry(context.Background(), 10*time.Minute)
+	if gcInterval > 0 {
+		go cfg.runGarbageCollector(context.Background(), gcInterval, cfg.gcOptions)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -117,6 +312,10 @@ func main() {
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
+	if cfg.storageBackend != storageBackendS3 {
+		mux.HandleFunc("GET /objects/{key...}", cfg.handlerObjectGet)
+	}
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
@@ -126,11 +325,30 @@ func main() {
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart", cfg.handlerMultipartCreate)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart/{uploadID}/complete", cfg.handlerMultipartComplete)
+	mux.HandleFunc("DELETE /api/video_upload/{videoID}/multipart/{uploadID}", cfg.handlerMultipartAbort)
+	mux.HandleFunc("OPTIONS /api/tus/", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/tus/", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/tus/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/tus/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/tus/{uploadID}", cfg.handlerTusDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("POST /api/videos/{videoID}/progress_token", cfg.handlerVideoProgressToken)
+	mux.HandleFunc("POST /api/videos/{videoID}/clip", cfg.handlerVideoClip)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions", cfg.handlerCaptionsList)
+	mux.HandleFunc("PUT /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionUpload)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionDelete)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/watermark", cfg.handlerWatermarkGet)
+	mux.HandleFunc("PUT /api/watermark", cfg.handlerWatermarkSave)
+	mux.HandleFunc("DELETE /api/watermark", cfg.handlerWatermarkDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/gc", cfg.handlerAdminGC)
+	mux.HandleFunc("POST /admin/migrate_thumbnails", cfg.handlerAdminMigrateThumbnails)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
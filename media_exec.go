@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stderrTailSize is how much of a tool's stderr is kept for error reports, ffmpeg
+// prints its reason for failing last
+const stderrTailSize = 4096
+
+// toolLimits bounds the external processes the media pipeline starts
+type toolLimits struct {
+	probeTimeout   time.Duration
+	processTimeout time.Duration
+	maxProcesses   int
+	maxProbes      int
+}
+
+// toolRunner runs ffmpeg and ffprobe under the limits, every process holds a slot while it runs.
+// Probes have slots of their own so upload checks don't queue behind long encodes.
+type toolRunner struct {
+	limits     toolLimits
+	slots      chan struct{}
+	probeSlots chan struct{}
+}
+
+func newToolRunner(limits toolLimits) *toolRunner {
+	return &toolRunner{
+		limits:     limits,
+		slots:      make(chan struct{}, max(limits.maxProcesses, 1)),
+		probeSlots: make(chan struct{}, max(limits.maxProbes, 1)),
+	}
+}
+
+// toolError reports a failed run with the tail of what the tool printed to stderr
+type toolError struct {
+	Tool     string
+	Args     []string
+	ExitCode int
+	Elapsed  time.Duration
+	Stderr   string
+	Err      error
+}
+
+func (e *toolError) Error() string {
+	msg := fmt.Sprintf("%s failed after %s", e.Tool, e.Elapsed.Round(time.Millisecond))
+	if e.ExitCode > 0 {
+		msg = fmt.Sprintf("%s exited with status %d after %s", e.Tool, e.ExitCode, e.Elapsed.Round(time.Millisecond))
+	}
+	msg += ": " + e.Err.Error()
+	if e.Stderr != "" {
+		msg += "\n" + e.Stderr
+	}
+	return msg
+}
+
+func (e *toolError) Unwrap() error {
+	return e.Err
+}
+
+// probe runs ffprobe under the probe timeout
+func (t *toolRunner) probe(ctx context.Context, args []string, stdout io.Writer) error {
+	return t.runInSlot(ctx, t.probeSlots, t.limits.probeTimeout, "ffprobe", args, nil, stdout)
+}
+
+// ffmpeg runs ffmpeg under the processing timeout
+func (t *toolRunner) ffmpeg(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	if report := ffmpegProgressFrom(ctx); report != nil && stdout == nil {
+		// -progress is a global option, it has to come before the inputs
+		args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+		stdout = &ffmpegProgressWriter{report: report}
+	}
+	return t.run(ctx, t.limits.processTimeout, "ffmpeg", args, stdin, stdout)
+}
+
+func (t *toolRunner) run(ctx context.Context, timeout time.Duration, tool string, args []string, stdin io.Reader, stdout io.Writer) error {
+	return t.runInSlot(ctx, t.slots, timeout, tool, args, stdin, stdout)
+}
+
+func (t *toolRunner) runInSlot(ctx context.Context, slots chan struct{}, timeout time.Duration, tool string, args []string, stdin io.Reader, stdout io.Writer) error {
+	// waiting for a slot counts against the caller's deadline but not the tool's own timeout
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting to run %s: %w", tool, ctx.Err())
+	}
+	defer func() { <-slots }()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stderr := &tailBuffer{limit: stderrTailSize}
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// a killed ffmpeg can leave children holding the pipes open, don't wait on them forever
+	cmd.WaitDelay = 5 * time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	toolErr := &toolError{
+		Tool:    tool,
+		Args:    args,
+		Elapsed: time.Since(start),
+		Stderr:  strings.TrimSpace(stderr.String()),
+		Err:     err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		toolErr.ExitCode = exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		// killed for running too long or because nobody wants the result any more
+		toolErr.Err = ctx.Err()
+	}
+	return toolErr
+}
+
+// tailBuffer keeps the last limit bytes written to it
+type tailBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "..." + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+// ffmpegProgressWriter parses the key=value lines ffmpeg's -progress option writes
+type ffmpegProgressWriter struct {
+	report  func(done time.Duration)
+	partial []byte
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i == -1 {
+			break
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(string(w.partial[:i])), "=")
+		w.partial = w.partial[i+1:]
+
+		// out_time_ms is in microseconds too, older builds only write that one
+		if key != "out_time_us" && key != "out_time_ms" {
+			continue
+		}
+		micros, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || micros < 0 {
+			// N/A until the first frame is written
+			continue
+		}
+		w.report(time.Duration(micros) * time.Microsecond)
+	}
+	return len(p), nil
+}
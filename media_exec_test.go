@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToolRunnerRun(t *testing.T) {
+	tools := newToolRunner(toolLimits{maxProcesses: 1})
+
+	err := tools.run(context.Background(), time.Second, "sh", []string{"-c", "echo 'moov atom not found' >&2; exit 1"}, nil, nil)
+	var toolErr *toolError
+	if !errors.As(err, &toolErr) {
+		t.Fatalf("error = %v, want a *toolError", err)
+	}
+	if toolErr.ExitCode != 1 || toolErr.Stderr != "moov atom not found" {
+		t.Errorf("exit code %d, stderr %q, want 1 and the message", toolErr.ExitCode, toolErr.Stderr)
+	}
+	if !strings.Contains(err.Error(), "moov atom not found") {
+		t.Errorf("error %q doesn't include stderr", err)
+	}
+
+	start := time.Now()
+	err = tools.run(context.Background(), 50*time.Millisecond, "sh", []string{"-c", "exec sleep 10"}, nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want a deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed out process ran for %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = tools.run(ctx, time.Second, "sh", []string{"-c", "true"}, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want canceled", err)
+	}
+}
+
+func TestToolRunnerLimitsProcesses(t *testing.T) {
+	tools := newToolRunner(toolLimits{maxProcesses: 2})
+
+	// fill the slots and check a third run waits for its context
+	tools.slots <- struct{}{}
+	tools.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := tools.run(ctx, time.Second, "sh", []string{"-c", "true"}, nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want it to give up waiting for a slot", err)
+	}
+	<-tools.slots
+	<-tools.slots
+
+	if err := tools.run(context.Background(), time.Second, "sh", []string{"-c", "true"}, nil, nil); err != nil {
+		t.Errorf("run after slots freed: %v", err)
+	}
+}
+
+func TestToolRunnerProbesDontWaitOnFFmpeg(t *testing.T) {
+	tools := newToolRunner(toolLimits{maxProcesses: 1, maxProbes: 1})
+
+	// every ffmpeg slot taken by an encode
+	tools.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// ffprobe may not be installed, all that matters is the run didn't wait for a slot
+	if err := tools.probe(ctx, []string{"-version"}, nil); errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("probe error = %v, want it to run beside ffmpeg", err)
+	}
+	<-tools.slots
+
+	tools.probeSlots <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := tools.probe(ctx, []string{"-version"}, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("probe error = %v, want it to wait for a probe slot", err)
+	}
+	<-tools.probeSlots
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{limit: 8}
+	b.Write([]byte("0123"))
+	b.Write([]byte("456789ab"))
+	if got := b.String(); got != "...456789ab" {
+		t.Errorf("tail = %q, want %q", got, "...456789ab")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// extractMetadata summarises a probe of the processed file for the video record
+func extractMetadata(probeData ffmpegData) database.VideoMetadata {
+	metadata := database.VideoMetadata{}
+
+	if seconds, err := strconv.ParseFloat(probeData.Format.Duration, 64); err == nil {
+		metadata.DurationSeconds = &seconds
+	}
+	if size, err := strconv.ParseInt(probeData.Format.Size, 10, 64); err == nil {
+		metadata.FileSize = &size
+	}
+	if bitrate, err := strconv.ParseInt(probeData.Format.BitRate, 10, 64); err == nil {
+		metadata.Bitrate = &bitrate
+	}
+
+	for _, stream := range probeData.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && metadata.VideoCodec == nil:
+			codec := stream.CodecName
+			width, height := stream.Width, stream.Height
+			rotation := streamRotation(stream)
+			metadata.VideoCodec = &codec
+			metadata.Width = &width
+			metadata.Height = &height
+			metadata.Rotation = &rotation
+
+			frameRate, ok := parseFrameRate(stream.AvgFrameRate)
+			if !ok {
+				frameRate, ok = parseFrameRate(stream.RFrameRate)
+			}
+			if ok {
+				metadata.FrameRate = &frameRate
+			}
+		case stream.CodecType == "audio" && metadata.AudioCodec == nil:
+			codec := stream.CodecName
+			metadata.AudioCodec = &codec
+		}
+	}
+
+	return metadata
+}
+
+// parseFrameRate reads ffprobe's "30000/1001" style rates, "0/0" means unknown
+func parseFrameRate(rate string) (float64, bool) {
+	num, den, found := strings.Cut(rate, "/")
+	if !found {
+		den = "1"
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, false
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 || n == 0 {
+		return 0, false
+	}
+	return math.Round(n/d*1000) / 1000, true
+}
+
+// streamRotation returns how far players rotate the coded frames clockwise: 0, 90, 180 or 270
+func streamRotation(stream ffprobeStream) int {
+	for _, sideData := range stream.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			// the display matrix angle is counter-clockwise
+			return normalizeRotation(-int(math.Round(sideData.Rotation)))
+		}
+	}
+	if rotate, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+		return normalizeRotation(rotate)
+	}
+	return 0
+}
+
+func normalizeRotation(degrees int) int {
+	return (degrees%360 + 360) % 360
+}
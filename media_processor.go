@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"image"
+)
+
+// MediaProcessor is everything the pipeline asks of a media toolchain, tests swap in a fake
+type MediaProcessor interface {
+	Probe(ctx context.Context, input string) (ffmpegData, error)
+	// NormalizeToMP4 returns the path of a faststart H.264/AAC MP4 made from filePath, the caller removes it
+	NormalizeToMP4(ctx context.Context, filePath string, probeData ffmpegData) (string, error)
+	ExtractFrame(ctx context.Context, filePath, outputPath, timestamp string) error
+	TranscodeHLS(ctx context.Context, filePath, outputDir string, width, height int, hasAudio bool) error
+	PackageDASH(ctx context.Context, filePath, outputDir string, width, height int, hasAudio bool) error
+	EncodeWebP(ctx context.Context, img image.Image) ([]byte, error)
+	// GenerateStoryboard writes the sprite sheets for layout into outputDir, named by storyboardSheetName
+	GenerateStoryboard(ctx context.Context, filePath, outputDir string, layout storyboardLayout) error
+	ExtractAudio(ctx context.Context, filePath, outputPath, format string) error
+	// DecodeAudioPCM writes raw 16-bit mono samples at pcmSampleRate
+	DecodeAudioPCM(ctx context.Context, filePath, outputPath string) error
+	// Keyframes lists the seconds at which the video stream has a keyframe
+	Keyframes(ctx context.Context, filePath string) ([]float64, error)
+	// CutClip writes the seconds from start to end as an MP4, re-encoding unless streamCopy is set
+	CutClip(ctx context.Context, filePath, outputPath string, start, end float64, streamCopy bool) error
+	// ApplyWatermark draws the image at imagePath over the video as an MP4
+	ApplyWatermark(ctx context.Context, filePath, outputPath, imagePath string, overlay watermarkOverlay) error
+}
+
+// ffmpegProcessor shells out to ffmpeg and ffprobe, MP4s are probed and remuxed in pure Go where possible
+type ffmpegProcessor struct {
+	tools *toolRunner
+}
+
+var _ MediaProcessor = ffmpegProcessor{}
+
+func (p ffmpegProcessor) Probe(ctx context.Context, input string) (ffmpegData, error) {
+	return probeVideo(ctx, p.tools, input)
+}
+
+func (p ffmpegProcessor) NormalizeToMP4(ctx context.Context, filePath string, probeData ffmpegData) (string, error) {
+	return normalizeToMP4(ctx, p.tools, filePath, probeData)
+}
+
+func (p ffmpegProcessor) ExtractFrame(ctx context.Context, filePath, outputPath, timestamp string) error {
+	return extractThumbnailFrame(ctx, p.tools, filePath, outputPath, timestamp)
+}
+
+func (p ffmpegProcessor) TranscodeHLS(ctx context.Context, filePath, outputDir string, width, height int, hasAudio bool) error {
+	return transcodeToHLS(ctx, p.tools, filePath, outputDir, width, height, hasAudio)
+}
+
+func (p ffmpegProcessor) PackageDASH(ctx context.Context, filePath, outputDir string, width, height int, hasAudio bool) error {
+	return packageDASH(ctx, p.tools, filePath, outputDir, width, height, hasAudio)
+}
+
+func (p ffmpegProcessor) EncodeWebP(ctx context.Context, img image.Image) ([]byte, error) {
+	return encodeWebP(ctx, p.tools, img)
+}
+
+func (p ffmpegProcessor) GenerateStoryboard(ctx context.Context, filePath, outputDir string, layout storyboardLayout) error {
+	return generateStoryboard(ctx, p.tools, filePath, outputDir, layout)
+}
+
+func (p ffmpegProcessor) ExtractAudio(ctx context.Context, filePath, outputPath, format string) error {
+	return extractAudio(ctx, p.tools, filePath, outputPath, format)
+}
+
+func (p ffmpegProcessor) DecodeAudioPCM(ctx context.Context, filePath, outputPath string) error {
+	return decodeAudioPCM(ctx, p.tools, filePath, outputPath)
+}
+
+func (p ffmpegProcessor) Keyframes(ctx context.Context, filePath string) ([]float64, error) {
+	return videoKeyframes(ctx, p.tools, filePath)
+}
+
+func (p ffmpegProcessor) CutClip(ctx context.Context, filePath, outputPath string, start, end float64, streamCopy bool) error {
+	return cutClip(ctx, p.tools, filePath, outputPath, start, end, streamCopy)
+}
+
+func (p ffmpegProcessor) ApplyWatermark(ctx context.Context, filePath, outputPath, imagePath string, overlay watermarkOverlay) error {
+	return applyWatermark(ctx, p.tools, filePath, outputPath, imagePath, overlay)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeMediaProcessor stands in for ffmpeg in tests. Probe answers come from probes keyed
+// by input path, and any step can be overridden with a func to script failures.
+type fakeMediaProcessor struct {
+	probes map[string]ffmpegData
+	// delay makes every call wait this long first, or until its context is done
+	delay time.Duration
+
+	probe     func(ctx context.Context, input string) (ffmpegData, error)
+	normalize func(ctx context.Context, filePath string, probeData ffmpegData) (string, error)
+	// keyframes are what Keyframes reports, just the first frame when nil
+	keyframes []float64
+
+	mu    sync.Mutex
+	calls []string
+}
+
+var _ MediaProcessor = (*fakeMediaProcessor)(nil)
+
+func (f *fakeMediaProcessor) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeMediaProcessor) callCount(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, c := range f.calls {
+		if c == call {
+			count++
+		}
+	}
+	return count
+}
+
+// wait simulates a slow tool, returning the context's error if it gives up first
+func (f *fakeMediaProcessor) wait(ctx context.Context) error {
+	if f.delay == 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeMediaProcessor) Probe(ctx context.Context, input string) (ffmpegData, error) {
+	f.record("probe")
+	if err := f.wait(ctx); err != nil {
+		return ffmpegData{}, err
+	}
+	if f.probe != nil {
+		return f.probe(ctx, input)
+	}
+	f.mu.Lock()
+	probeData, ok := f.probes[input]
+	f.mu.Unlock()
+	if !ok {
+		return ffmpegData{}, fmt.Errorf("fake ffprobe: %s: Invalid data found when processing input", input)
+	}
+	return probeData, nil
+}
+
+func (f *fakeMediaProcessor) NormalizeToMP4(ctx context.Context, filePath string, probeData ffmpegData) (string, error) {
+	f.record("normalize")
+	if err := f.wait(ctx); err != nil {
+		return "", err
+	}
+	if f.normalize != nil {
+		return f.normalize(ctx, filePath, probeData)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	outputPath := filePath + ".processing"
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		return "", err
+	}
+	// the normalized file probes like its source unless the test says otherwise
+	f.mu.Lock()
+	if _, ok := f.probes[outputPath]; !ok && f.probes != nil {
+		f.probes[outputPath] = probeData
+	}
+	f.mu.Unlock()
+	return outputPath, nil
+}
+
+func (f *fakeMediaProcessor) ExtractFrame(ctx context.Context, filePath, outputPath, timestamp string) error {
+	f.record("extract_frame")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	return fmt.Errorf("fake ffmpeg: no frames in %s", filePath)
+}
+
+func (f *fakeMediaProcessor) TranscodeHLS(ctx context.Context, filePath, outputDir string, width, height int, hasAudio bool) error {
+	f.record("hls")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, hlsMasterPlaylist), []byte("#EXTM3U\n"), 0644)
+}
+
+func (f *fakeMediaProcessor) PackageDASH(ctx context.Context, filePath, outputDir string, width, height int, hasAudio bool) error {
+	f.record("dash")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, dashManifest), []byte("<MPD/>"), 0644)
+}
+
+func (f *fakeMediaProcessor) EncodeWebP(ctx context.Context, img image.Image) ([]byte, error) {
+	f.record("webp")
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return []byte("RIFF\x00\x00\x00\x00WEBP"), nil
+}
+
+func (f *fakeMediaProcessor) GenerateStoryboard(ctx context.Context, filePath, outputDir string, layout storyboardLayout) error {
+	f.record("storyboard")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, storyboardSheetName(0)), []byte("\xff\xd8\xff"), 0644)
+}
+
+func (f *fakeMediaProcessor) ExtractAudio(ctx context.Context, filePath, outputPath, format string) error {
+	f.record("audio")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	return os.WriteFile(outputPath, []byte("fake "+format), 0644)
+}
+
+// DecodeAudioPCM writes a second of a 440Hz tone
+func (f *fakeMediaProcessor) DecodeAudioPCM(ctx context.Context, filePath, outputPath string) error {
+	f.record("pcm")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	pcm := make([]byte, 2*pcmSampleRate)
+	for i := 0; i < pcmSampleRate; i++ {
+		sample := int16(8000 * math.Sin(2*math.Pi*440*float64(i)/pcmSampleRate))
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(sample))
+	}
+	return os.WriteFile(outputPath, pcm, 0644)
+}
+
+func (f *fakeMediaProcessor) Keyframes(ctx context.Context, filePath string) ([]float64, error) {
+	f.record("keyframes")
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	if f.keyframes == nil {
+		return []float64{0}, nil
+	}
+	return f.keyframes, nil
+}
+
+// CutClip copies the file and gives the copy the probe of its source, shortened to the clip
+func (f *fakeMediaProcessor) CutClip(ctx context.Context, filePath, outputPath string, start, end float64, streamCopy bool) error {
+	if streamCopy {
+		f.record("clip-copy")
+	} else {
+		f.record("clip-encode")
+	}
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	probeData, ok := f.probes[filePath]
+	if ok {
+		probeData.Format.Duration = strconv.FormatFloat(end-start, 'f', -1, 64)
+		f.probes[outputPath] = probeData
+	}
+	f.mu.Unlock()
+	return os.WriteFile(outputPath, data, 0644)
+}
+
+// probeResult builds what ffprobe reports for an MP4 with one H.264 video and one AAC audio stream
+func probeResult(width, height int, duration string) ffmpegData {
+	probeData := ffmpegData{Streams: []ffprobeStream{
+		{Index: 0, CodecType: "video", CodecName: "h264", Width: width, Height: height, PixFmt: "yuv420p", AvgFrameRate: "30/1"},
+		{Index: 1, CodecType: "audio", CodecName: "aac"},
+	}}
+	probeData.Format.FormatName = isoBMFFFormatName
+	probeData.Format.Duration = duration
+	return probeData
+}
+
+// fakeTranscriber stands in for a speech model, it captions every 5 seconds of the WAV it's given
+// with the segment's number so results depend only on the audio's length
+type fakeTranscriber struct {
+	language string
+	err      error
+}
+
+var _ Transcriber = fakeTranscriber{}
+
+func (f fakeTranscriber) Transcribe(ctx context.Context, wavPath string) (transcript, error) {
+	if f.err != nil {
+		return transcript{}, f.err
+	}
+	wav, err := os.ReadFile(wavPath)
+	if err != nil {
+		return transcript{}, err
+	}
+	if len(wav) < 44 || string(wav[0:4]) != "RIFF" || string(wav[8:12]) != "WAVE" {
+		return transcript{}, fmt.Errorf("%s is not a WAV file", wavPath)
+	}
+	duration := float64(binary.LittleEndian.Uint32(wav[40:44])) / 2 / pcmSampleRate
+
+	vtt := "WEBVTT\n\n"
+	for i := 0; float64(i*5) < duration; i++ {
+		vtt += fmt.Sprintf("%s --> %s\nSegment %d\n\n", vttTimestamp(float64(i*5)), vttTimestamp(min(float64(i*5+5), duration)), i+1)
+	}
+	return transcript{language: f.language, vtt: []byte(vtt)}, nil
+}
+
+// ApplyWatermark copies the file along with its probe
+func (f *fakeMediaProcessor) ApplyWatermark(ctx context.Context, filePath, outputPath, imagePath string, overlay watermarkOverlay) error {
+	f.record("watermark")
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	if _, err := os.Stat(imagePath); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if probeData, ok := f.probes[filePath]; ok {
+		f.probes[outputPath] = probeData
+	}
+	f.mu.Unlock()
+	return os.WriteFile(outputPath, data, 0644)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type videoContainer struct {
+	// demuxer is the ffprobe format name that must recognise the file
+	demuxer   string
+	extension string
+}
+
+// videoContainers are the video media types we accept, everything is normalized to MP4 during processing
+var videoContainers = map[string]videoContainer{
+	"video/mp4":        {demuxer: "mp4", extension: "mp4"},
+	"video/quicktime":  {demuxer: "mov", extension: "mov"},
+	"video/webm":       {demuxer: "webm", extension: "webm"},
+	"video/x-matroska": {demuxer: "matroska", extension: "mkv"},
+	"video/x-msvideo":  {demuxer: "avi", extension: "avi"},
+}
+
+const supportedVideoFormats = "mp4, mov, webm, mkv or avi"
+
+var (
+	allowedVideoCodecs = []string{"h264", "hevc", "vp8", "vp9", "av1", "mpeg4", "prores"}
+	allowedAudioCodecs = []string{"aac", "mp3", "opus", "vorbis", "flac", "alac", "ac3", "pcm_s16le", "pcm_s24le"}
+)
+
+// sniffLength is how much of a file http.DetectContentType looks at
+const sniffLength = 512
+
+type mediaLimits struct {
+	maxDuration  time.Duration
+	maxDimension int
+}
+
+// mediaRejection is a client error found while validating an upload, reason is safe to show the user
+type mediaRejection struct {
+	status int
+	reason string
+}
+
+func (e *mediaRejection) Error() string {
+	return e.reason
+}
+
+func rejectUnsupported(format string, args ...any) error {
+	return &mediaRejection{status: http.StatusUnsupportedMediaType, reason: fmt.Sprintf(format, args...)}
+}
+
+func rejectInvalid(format string, args ...any) error {
+	return &mediaRejection{status: http.StatusUnprocessableEntity, reason: fmt.Sprintf(format, args...)}
+}
+
+func isMediaRejection(err error) bool {
+	var rejection *mediaRejection
+	return errors.As(err, &rejection)
+}
+
+// respondWithRejection answers with the rejection's status and reason, anything else is a 500
+func respondWithRejection(w http.ResponseWriter, msg string, err error) {
+	var rejection *mediaRejection
+	if errors.As(err, &rejection) {
+		respondWithError(w, rejection.status, rejection.reason, nil)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, msg, err)
+}
+
+func isSupportedVideoType(mediaType string) bool {
+	_, ok := videoContainers[mediaType]
+	return ok
+}
+
+// readSniffHead reads the first bytes of a file for content sniffing
+func readSniffHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// sniffVideoContainer tells apart the containers http.DetectContentType lumps together
+// (QuickTime vs MP4, Matroska vs WebM), it returns "" when head isn't a video it knows
+func sniffVideoContainer(head []byte) string {
+	if len(head) >= 12 {
+		switch string(head[4:8]) {
+		case "ftyp":
+			if string(head[8:12]) == "qt  " {
+				return "video/quicktime"
+			}
+			return "video/mp4"
+		case "moov", "mdat", "wide", "free", "skip", "pnot":
+			// QuickTime files from before the ftyp atom existed
+			return "video/quicktime"
+		}
+		if string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI " {
+			return "video/x-msvideo"
+		}
+	}
+	if bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")) {
+		// the EBML header names the DocType near the start
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		if bytes.Contains(head, []byte("matroska")) {
+			return "video/x-matroska"
+		}
+	}
+	return ""
+}
+
+func sniffMediaType(head []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// sniffVideoType checks the magic bytes of a video upload and returns its real media type
+func sniffVideoType(head []byte) (string, error) {
+	mediaType := sniffVideoContainer(head)
+	if mediaType == "" {
+		mediaType = sniffMediaType(head)
+	}
+	if !isSupportedVideoType(mediaType) {
+		return "", rejectUnsupported("File content is %s, expects %s", mediaType, supportedVideoFormats)
+	}
+	return mediaType, nil
+}
+
+// sniffImageType checks the magic bytes of a thumbnail upload and returns its real media type
+func sniffImageType(head []byte) (string, error) {
+	mediaType := sniffMediaType(head)
+	if mediaType != "image/jpeg" && mediaType != "image/png" && mediaType != "image/webp" {
+		return "", rejectUnsupported("File content is %s, expects png, jpeg or webp", mediaType)
+	}
+	return mediaType, nil
+}
+
+// validateSpooledVideo sniffs and validates a fully uploaded file on disk, returning its real media type
+func (cfg *apiConfig) validateSpooledVideo(ctx context.Context, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	head, err := readSniffHead(file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, err := sniffVideoType(head)
+	if err != nil {
+		return "", err
+	}
+	return mediaType, cfg.validateVideo(ctx, filePath, mediaType)
+}
+
+// validateStoredVideo does the same for an object that was uploaded straight to the store,
+// ffprobe reads it through a presigned URL so only the parts it needs are downloaded
+func (cfg *apiConfig) validateStoredVideo(ctx context.Context, key string) (string, error) {
+	body, err := cfg.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	head, err := readSniffHead(body)
+	body.Close()
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, err := sniffVideoType(head)
+	if err != nil {
+		return "", err
+	}
+	url, err := cfg.store.PresignGet(ctx, key, 15*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	return mediaType, cfg.validateVideo(ctx, url, mediaType)
+}
+
+// validateVideo runs ffprobe over input (a path or URL) and checks the result against our limits
+func (cfg *apiConfig) validateVideo(ctx context.Context, input, mediaType string) error {
+	probeData, err := cfg.media.Probe(ctx, input)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+			// giving up isn't the upload's fault
+			return err
+		}
+		return rejectInvalid("Couldn't read the video, the file may be corrupt or truncated")
+	}
+
+	container := videoContainers[mediaType]
+	if !slices.Contains(strings.Split(probeData.Format.FormatName, ","), container.demuxer) {
+		return rejectUnsupported("Container %q doesn't match the %s content", probeData.Format.FormatName, mediaType)
+	}
+
+	hasVideo := false
+	for _, stream := range probeData.Streams {
+		switch stream.CodecType {
+		case "video":
+			if stream.Disposition.AttachedPic == 1 {
+				// cover art, not a video track
+				continue
+			}
+			if !slices.Contains(allowedVideoCodecs, stream.CodecName) {
+				return rejectUnsupported("Video codec %q isn't supported, expects one of %s", stream.CodecName, strings.Join(allowedVideoCodecs, ", "))
+			}
+			longSide := max(stream.Width, stream.Height)
+			if longSide > cfg.mediaLimits.maxDimension {
+				return rejectInvalid("Resolution %dx%d is larger than the %dpx limit", stream.Width, stream.Height, cfg.mediaLimits.maxDimension)
+			}
+			hasVideo = true
+		case "audio":
+			if !slices.Contains(allowedAudioCodecs, stream.CodecName) {
+				return rejectUnsupported("Audio codec %q isn't supported, expects one of %s", stream.CodecName, strings.Join(allowedAudioCodecs, ", "))
+			}
+		}
+	}
+	if !hasVideo {
+		return rejectInvalid("File has no video stream")
+	}
+
+	seconds, err := strconv.ParseFloat(probeData.Format.Duration, 64)
+	if err != nil || seconds <= 0 {
+		return rejectInvalid("Couldn't determine the video's duration")
+	}
+	duration := time.Duration(seconds * float64(time.Second))
+	if duration > cfg.mediaLimits.maxDuration {
+		return rejectInvalid("Video is %s long, the limit is %s", duration.Round(time.Second), cfg.mediaLimits.maxDuration)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mp4"
+)
+
+// isoBMFFFormatName is what ffprobe calls every MP4/QuickTime flavoured file
+const isoBMFFFormatName = "mov,mp4,m4a,3gp,3g2,mj2"
+
+var (
+	errUnknownMP4Codec = errors.New("codec not known to the mp4 parser")
+	// errMP4NeedsFFprobe covers files whose duration and frame rate aren't in the moov box,
+	// fragmented files keep their samples in moof boxes the parser doesn't read
+	errMP4NeedsFFprobe = errors.New("duration not known to the mp4 parser")
+)
+
+// mp4VideoCodecs maps sample entry types to ffprobe codec names
+var mp4VideoCodecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"av01": "av1",
+	"vp09": "vp9",
+	"vp08": "vp8",
+	"mp4v": "mpeg4",
+	"apch": "prores",
+	"apcn": "prores",
+	"apcs": "prores",
+	"apco": "prores",
+	"ap4h": "prores",
+	"ap4x": "prores",
+}
+
+var mp4AudioCodecs = map[string]string{
+	"Opus": "opus",
+	"ac-3": "ac3",
+	"alac": "alac",
+	"fLaC": "flac",
+}
+
+// probeMP4 reads MP4 and QuickTime files with the pure Go parser and reports them the way ffprobe would,
+// files it can't fully describe are left to ffprobe
+func probeMP4(filePath string) (ffmpegData, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ffmpegData{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return ffmpegData{}, err
+	}
+
+	info, err := mp4.Probe(file, stat.Size())
+	if err != nil {
+		return ffmpegData{}, err
+	}
+	return ffmpegDataFromMP4(info)
+}
+
+func ffmpegDataFromMP4(info *mp4.Info) (ffmpegData, error) {
+	if info.Fragmented || info.Duration <= 0 {
+		return ffmpegData{}, errMP4NeedsFFprobe
+	}
+
+	data := ffmpegData{}
+	seconds := info.Duration.Seconds()
+	data.Format.FormatName = isoBMFFFormatName
+	data.Format.Tags.MajorBrand = info.MajorBrand
+	data.Format.Size = strconv.FormatInt(info.Size, 10)
+	data.Format.Duration = strconv.FormatFloat(seconds, 'f', 6, 64)
+	data.Format.BitRate = strconv.FormatInt(int64(float64(info.Size*8)/seconds), 10)
+
+	for _, track := range info.Tracks {
+		stream := ffprobeStream{Index: len(data.Streams)}
+		if track.Duration > 0 {
+			stream.Duration = strconv.FormatFloat(track.Duration.Seconds(), 'f', 6, 64)
+		}
+
+		switch track.Handler {
+		case "vide":
+			codec, ok := mp4VideoCodecs[track.Codec]
+			if !ok {
+				return ffmpegData{}, fmt.Errorf("%w: %q", errUnknownMP4Codec, track.Codec)
+			}
+			stream.CodecType = "video"
+			stream.CodecName = codec
+			stream.Width, stream.Height = track.Width, track.Height
+			if track.PixelAspect[0] > 0 && track.PixelAspect[1] > 0 {
+				stream.SampleAspectRatio = fmt.Sprintf("%d:%d", track.PixelAspect[0], track.PixelAspect[1])
+			}
+			if track.Rotation != 0 {
+				stream.Tags.Rotate = strconv.Itoa(track.Rotation)
+			}
+			if track.Samples > 0 && track.Duration > 0 {
+				stream.AvgFrameRate = fmt.Sprintf("%d/%d", uint64(track.Samples)*1_000_000, track.Duration.Microseconds())
+			}
+			// Baseline, Main, Extended and High are all 8-bit 4:2:0
+			switch track.AVCProfile {
+			case 66, 77, 88, 100:
+				stream.PixFmt = "yuv420p"
+			}
+		case "soun":
+			codec, ok := mp4AudioCodecs[track.Codec]
+			if track.Codec == "mp4a" {
+				switch track.ObjectType {
+				case 0x40, 0x66, 0x67, 0x68:
+					codec, ok = "aac", true
+				case 0x69, 0x6B:
+					codec, ok = "mp3", true
+				}
+			}
+			if !ok {
+				return ffmpegData{}, fmt.Errorf("%w: %q", errUnknownMP4Codec, track.Codec)
+			}
+			stream.CodecType = "audio"
+			stream.CodecName = codec
+			stream.SampleRate = strconv.Itoa(track.SampleRate)
+			stream.Channels = track.Channels
+		default:
+			// timecode, metadata and hint tracks
+			stream.CodecType = "data"
+		}
+		data.Streams = append(data.Streams, stream)
+	}
+
+	if len(data.Streams) == 0 {
+		return ffmpegData{}, errors.New("no tracks found")
+	}
+	return data, nil
+}
+
+// isPlayableMP4 is true when the file already holds exactly what normalizeToMP4 produces,
+// one H.264 video and at most one AAC audio track in an MP4, so only moov may need moving
+func isPlayableMP4(probeData ffmpegData) bool {
+	if !slices.Contains(strings.Split(probeData.Format.FormatName, ","), "mp4") || probeData.Format.Tags.MajorBrand == "qt  " {
+		return false
+	}
+	videos, audios := 0, 0
+	for _, stream := range probeData.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && stream.CodecName == "h264" &&
+			(stream.PixFmt == "yuv420p" || stream.PixFmt == "yuvj420p"):
+			videos++
+		case stream.CodecType == "audio" && stream.CodecName == "aac":
+			audios++
+		default:
+			return false
+		}
+	}
+	return videos == 1 && audios <= 1
+}
+
+// fastStartMP4 writes a faststart copy of an MP4 in pure Go, a hard link when it already is one
+func fastStartMP4(filePath, outputPath string) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	info, err := mp4.Probe(src, stat.Size())
+	if err != nil {
+		return err
+	}
+	if info.FastStart {
+		if err := os.Link(filePath, outputPath); err == nil {
+			return nil
+		}
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := bufio.NewWriterSize(out, 1<<20)
+	if info.FastStart {
+		_, err = io.Copy(writer, src)
+	} else {
+		err = mp4.Relocate(src, stat.Size(), writer)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return out.Close()
+}
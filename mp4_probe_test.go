@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mp4"
+)
+
+func TestFFmpegDataFromMP4(t *testing.T) {
+	track := mp4.Track{Handler: "vide", Codec: "avc1", Duration: 10 * time.Second, Samples: 300, Width: 1920, Height: 1080, AVCProfile: 100}
+	tests := []struct {
+		name    string
+		info    mp4.Info
+		wantErr error
+	}{
+		{name: "progressive", info: mp4.Info{Duration: 10 * time.Second, Size: 1 << 20, Tracks: []mp4.Track{track}}},
+		{name: "fragmented", info: mp4.Info{Fragmented: true, Tracks: []mp4.Track{{Handler: "vide", Codec: "avc1", Width: 1920, Height: 1080}}}, wantErr: errMP4NeedsFFprobe},
+		{name: "fragmented with a duration", info: mp4.Info{Fragmented: true, Duration: 10 * time.Second, Tracks: []mp4.Track{track}}, wantErr: errMP4NeedsFFprobe},
+		{name: "no duration", info: mp4.Info{Tracks: []mp4.Track{track}}, wantErr: errMP4NeedsFFprobe},
+		{name: "unknown codec", info: mp4.Info{Duration: 10 * time.Second, Tracks: []mp4.Track{{Handler: "vide", Codec: "xvid"}}}, wantErr: errUnknownMP4Codec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ffmpegDataFromMP4(&tt.info)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("ffmpegDataFromMP4() error = %v, want %v so ffprobe takes over", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Format.Duration != "10.000000" || len(data.Streams) != 1 || data.Streams[0].AvgFrameRate == "" {
+				t.Errorf("ffmpegDataFromMP4() = %+v, want the duration and frame rate", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	storageBackendS3     = "s3"
+	storageBackendLocal  = "local"
+	storageBackendMemory = "memory"
+)
+
+// names recorded in the database for the stores objects live in
+const (
+	objectStoreName = "objects"
+	assetStoreName  = "assets"
+)
+
+func (cfg *apiConfig) configureStorage() error {
+	localBaseURL := fmt.Sprintf("http://localhost:%s/objects", cfg.port)
+
+	switch cfg.storageBackend {
+	case storageBackendS3:
+		cfg.s3Bucket = os.Getenv("S3_BUCKET")
+		if cfg.s3Bucket == "" {
+			return errors.New("S3_BUCKET environment variable is not set")
+		}
+		cfg.s3Region = os.Getenv("S3_REGION")
+		if cfg.s3Region == "" {
+			return errors.New("S3_REGION environment variable is not set")
+		}
+		cfg.s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if cfg.s3CfDistribution == "" {
+			return errors.New("S3_CF_DISTRO environment variable is not set")
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(cfg.s3Region))
+		if err != nil {
+			return fmt.Errorf("unable to load default AWS config: %w", err)
+		}
+		cfg.store = storage.NewS3Store(s3.NewFromConfig(awsCfg), cfg.s3Bucket)
+		cfg.objectBaseURL = strings.TrimSuffix(cfg.s3CfDistribution, "/")
+	case storageBackendLocal:
+		localRoot := os.Getenv("STORAGE_LOCAL_ROOT")
+		if localRoot == "" {
+			localRoot = "./objects"
+		}
+		localStore, err := storage.NewLocalStore(localRoot, localBaseURL)
+		if err != nil {
+			return err
+		}
+		cfg.store = localStore
+		cfg.objectBaseURL = localBaseURL
+	case storageBackendMemory:
+		cfg.store = storage.NewMemoryStore(localBaseURL)
+		cfg.objectBaseURL = localBaseURL
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q, expects s3, local or memory", cfg.storageBackend)
+	}
+
+	assetStore, err := storage.NewLocalStore(cfg.assetsRoot, fmt.Sprintf("http://localhost:%s/assets", cfg.port))
+	if err != nil {
+		return err
+	}
+	cfg.assetStore = assetStore
+
+	return nil
+}
+
+func (cfg *apiConfig) objectURL(key string) string {
+	return fmt.Sprintf("%s/%s", cfg.objectBaseURL, key)
+}
+
+func (cfg *apiConfig) assetURL(key string) string {
+	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, key)
+}
+
+func (cfg *apiConfig) storeByName(name string) (storage.ObjectStore, error) {
+	switch name {
+	case objectStoreName:
+		return cfg.store, nil
+	case assetStoreName:
+		return cfg.assetStore, nil
+	}
+	return nil, fmt.Errorf("unknown object store %q", name)
+}
+
+// currentVideoRefs lists the objects a video's URLs point at right now
+func (cfg *apiConfig) currentVideoRefs(video database.Video) []database.ObjectRef {
+	refs := []database.ObjectRef{}
+	if video.VideoURL != nil {
+		if ref, ok := cfg.objectRefFromURL(*video.VideoURL); ok {
+			refs = append(refs, ref, database.ObjectRef{
+				Store:  ref.Store,
+				Key:    videoArtifactPrefix(ref.Key),
+				Prefix: true,
+			})
+		}
+	}
+	if video.ThumbnailURL != nil {
+		if ref, ok := cfg.objectRefFromURL(*video.ThumbnailURL); ok {
+			// responsive variants share a directory, older single-file thumbnails don't
+			if dir, ok := thumbnailVariantsDir(ref); ok {
+				ref = database.ObjectRef{Store: ref.Store, Key: dir, Prefix: true}
+			}
+			refs = append(refs, ref)
+		}
+	}
+	for _, url := range []*string{video.PlaylistURL, video.DashManifestURL, video.StoryboardURL, video.AudioURL, video.WaveformURL, video.WaveformImageURL} {
+		if url == nil {
+			continue
+		}
+		if ref, ok := cfg.objectRefFromURL(*url); ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// videoArtifactPrefix is where everything derived from a video object (HLS renditions etc.) is stored
+func videoArtifactPrefix(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/"
+}
+
+// objectRefFromURL maps a URL handed out by objectURL or assetURL back to the stored object
+func (cfg *apiConfig) objectRefFromURL(url string) (database.ObjectRef, bool) {
+	if key, ok := strings.CutPrefix(url, cfg.objectURL("")); ok && key != "" {
+		return database.ObjectRef{Store: objectStoreName, Key: key}, true
+	}
+	if key, ok := strings.CutPrefix(url, cfg.assetURL("")); ok && key != "" {
+		return database.ObjectRef{Store: assetStoreName, Key: key}, true
+	}
+	return database.ObjectRef{}, false
+}
+
+// uploadDirectory stores every file under dir in the object store, keyed by its path relative to dir
+func (cfg *apiConfig) uploadDirectory(ctx context.Context, dir, keyPrefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := keyPrefix + filepath.ToSlash(rel)
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return cfg.store.Put(ctx, key, file, storage.ContentTypeForKey(key))
+	})
+}
+
+// handlerObjectGet serves objects for the local and memory backends, S3 objects go through CloudFront
+func (cfg *apiConfig) handlerObjectGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	info, err := cfg.store.Head(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Object not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read object", err)
+		return
+	}
+
+	body, err := cfg.store.Get(r.Context(), key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read object", err)
+		return
+	}
+	defer body.Close()
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.LastModified, seeker)
+		return
+	}
+	w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	io.Copy(w, body)
+}
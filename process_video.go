@@ -2,143 +2,231 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"math"
-	"os/exec"
+	"os"
+	"strconv"
+	"strings"
 )
 
+// ffmpegData is the part of `ffprobe -show_format -show_streams` output we use
 type ffmpegData struct {
-	Streams []struct {
-		Index              int    `json:"index"`
-		CodecName          string `json:"codec_name,omitempty"`
-		CodecLongName      string `json:"codec_long_name,omitempty"`
-		Profile            string `json:"profile,omitempty"`
-		CodecType          string `json:"codec_type"`
-		CodecTagString     string `json:"codec_tag_string"`
-		CodecTag           string `json:"codec_tag"`
-		Width              int    `json:"width,omitempty"`
-		Height             int    `json:"height,omitempty"`
-		CodedWidth         int    `json:"coded_width,omitempty"`
-		CodedHeight        int    `json:"coded_height,omitempty"`
-		ClosedCaptions     int    `json:"closed_captions,omitempty"`
-		FilmGrain          int    `json:"film_grain,omitempty"`
-		HasBFrames         int    `json:"has_b_frames,omitempty"`
-		SampleAspectRatio  string `json:"sample_aspect_ratio,omitempty"`
-		DisplayAspectRatio string `json:"display_aspect_ratio,omitempty"`
-		PixFmt             string `json:"pix_fmt,omitempty"`
-		Level              int    `json:"level,omitempty"`
-		ColorRange         string `json:"color_range,omitempty"`
-		ColorSpace         string `json:"color_space,omitempty"`
-		ColorTransfer      string `json:"color_transfer,omitempty"`
-		ColorPrimaries     string `json:"color_primaries,omitempty"`
-		ChromaLocation     string `json:"chroma_location,omitempty"`
-		FieldOrder         string `json:"field_order,omitempty"`
-		Refs               int    `json:"refs,omitempty"`
-		IsAvc              string `json:"is_avc,omitempty"`
-		NalLengthSize      string `json:"nal_length_size,omitempty"`
-		ID                 string `json:"id"`
-		RFrameRate         string `json:"r_frame_rate"`
-		AvgFrameRate       string `json:"avg_frame_rate"`
-		TimeBase           string `json:"time_base"`
-		StartPts           int    `json:"start_pts"`
-		StartTime          string `json:"start_time"`
-		DurationTs         int    `json:"duration_ts"`
-		Duration           string `json:"duration"`
-		BitRate            string `json:"bit_rate,omitempty"`
-		BitsPerRawSample   string `json:"bits_per_raw_sample,omitempty"`
-		NbFrames           string `json:"nb_frames"`
-		ExtradataSize      int    `json:"extradata_size"`
-		Disposition        struct {
-			Default         int `json:"default"`
-			Dub             int `json:"dub"`
-			Original        int `json:"original"`
-			Comment         int `json:"comment"`
-			Lyrics          int `json:"lyrics"`
-			Karaoke         int `json:"karaoke"`
-			Forced          int `json:"forced"`
-			HearingImpaired int `json:"hearing_impaired"`
-			VisualImpaired  int `json:"visual_impaired"`
-			CleanEffects    int `json:"clean_effects"`
-			AttachedPic     int `json:"attached_pic"`
-			TimedThumbnails int `json:"timed_thumbnails"`
-			NonDiegetic     int `json:"non_diegetic"`
-			Captions        int `json:"captions"`
-			Descriptions    int `json:"descriptions"`
-			Metadata        int `json:"metadata"`
-			Dependent       int `json:"dependent"`
-			StillImage      int `json:"still_image"`
-		} `json:"disposition"`
-		Tags struct {
-			Language    string `json:"language"`
-			HandlerName string `json:"handler_name"`
-			VendorID    string `json:"vendor_id"`
-			Encoder     string `json:"encoder"`
-			Timecode    string `json:"timecode"`
-		} `json:"tags,omitempty"`
-		SampleFmt      string `json:"sample_fmt,omitempty"`
-		SampleRate     string `json:"sample_rate,omitempty"`
-		Channels       int    `json:"channels,omitempty"`
-		ChannelLayout  string `json:"channel_layout,omitempty"`
-		BitsPerSample  int    `json:"bits_per_sample,omitempty"`
-		InitialPadding int    `json:"initial_padding,omitempty"`
-		Tags0          struct {
-			Language    string `json:"language"`
-			HandlerName string `json:"handler_name"`
-			VendorID    string `json:"vendor_id"`
-		} `json:"tags,omitempty"`
-		Tags1 struct {
-			Language    string `json:"language"`
-			HandlerName string `json:"handler_name"`
-			Timecode    string `json:"timecode"`
-		} `json:"tags,omitempty"`
-	} `json:"streams"`
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+		Tags       struct {
+			MajorBrand string `json:"major_brand"`
+		} `json:"tags"`
+	} `json:"format"`
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	ffmpegCmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	buf := bytes.Buffer{}
+type ffprobeStream struct {
+	Index              int    `json:"index"`
+	CodecName          string `json:"codec_name,omitempty"`
+	CodecType          string `json:"codec_type"`
+	Width              int    `json:"width,omitempty"`
+	Height             int    `json:"height,omitempty"`
+	SampleAspectRatio  string `json:"sample_aspect_ratio,omitempty"`
+	DisplayAspectRatio string `json:"display_aspect_ratio,omitempty"`
+	PixFmt             string `json:"pix_fmt,omitempty"`
+	RFrameRate         string `json:"r_frame_rate"`
+	AvgFrameRate       string `json:"avg_frame_rate"`
+	Duration           string `json:"duration"`
+	BitRate            string `json:"bit_rate,omitempty"`
+	SampleRate         string `json:"sample_rate,omitempty"`
+	Channels           int    `json:"channels,omitempty"`
+	Disposition        struct {
+		Default     int `json:"default"`
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+	Tags struct {
+		Language string `json:"language"`
+		// older ffmpeg versions report rotation as a tag, newer ones as side data
+		Rotate string `json:"rotate"`
+	} `json:"tags,omitempty"`
+	SideDataList []ffprobeSideData `json:"side_data_list,omitempty"`
+}
+
+type ffprobeSideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
 
-	ffmpegCmd.Stdout = &buf
+// probeVideo reads MP4 and QuickTime files in pure Go and only runs ffprobe for anything else
+func probeVideo(ctx context.Context, tools *toolRunner, filePath string) (ffmpegData, error) {
+	if readData, err := probeMP4(filePath); err == nil {
+		return readData, nil
+	}
+	return ffprobeVideo(ctx, tools, filePath)
+}
 
-	err := ffmpegCmd.Run()
+func ffprobeVideo(ctx context.Context, tools *toolRunner, filePath string) (ffmpegData, error) {
+	buf := bytes.Buffer{}
+
+	err := tools.probe(ctx, []string{"-v", "error", "-print_format", "json", "-show_format", "-show_streams", filePath}, &buf)
 	if err != nil {
-		return "", fmt.Errorf("Error running `ffprobe -v error -print_format json -show_streams %v:`\n%v", filePath, err)
+		return ffmpegData{}, fmt.Errorf("probing %v: %w", filePath, err)
 	}
 
 	var readData ffmpegData
 	if err := json.Unmarshal(buf.Bytes(), &readData); err != nil {
-		return "", err
+		return ffmpegData{}, err
 	}
+	if len(readData.Streams) == 0 {
+		return ffmpegData{}, fmt.Errorf("no streams found in %v", filePath)
+	}
+	return readData, nil
+}
 
-	width := float64(readData.Streams[0].Width)
-	height := float64(readData.Streams[0].Height)
+// aspectRatios are the buckets classifyAspectRatio knows, anything else is "other"
+var aspectRatios = []struct {
+	name  string
+	ratio float64
+}{
+	{"16:9", 16.0 / 9.0},
+	{"9:16", 9.0 / 16.0},
+	{"4:3", 4.0 / 3.0},
+	{"3:4", 3.0 / 4.0},
+	{"1:1", 1},
+	{"21:9", 21.0 / 9.0},
+	{"4:5", 4.0 / 5.0},
+}
+
+// aspectRatioTolerance is how far off (relative) a video may be and still land in a bucket,
+// enough to cover odd encoder sizes and the 2.35/2.39 cinema ratios marketed as 21:9
+const aspectRatioTolerance = 0.03
 
-	sixteenByNine := math.Round((16.0 / 9.0) * float64(height))
-	if isWithinRange(sixteenByNine, width-5, width+5) {
-		return "16:9", nil
+func getVideoAspectRatio(ctx context.Context, media MediaProcessor, filePath string) (string, error) {
+	readData, err := media.Probe(ctx, filePath)
+	if err != nil {
+		return "", err
 	}
-	nineBySixteen := math.Round((9.0 / 16.0) * float64(height))
-	if isWithinRange(nineBySixteen, width-5, width+5) {
-		return "9:16", nil
+	return classifyAspectRatio(readData)
+}
+
+// classifyAspectRatio buckets the shape the first video stream is displayed at
+func classifyAspectRatio(probeData ffmpegData) (string, error) {
+	width, height, err := displayDimensions(probeData)
+	if err != nil {
+		return "", err
 	}
 
+	ratio := width / height
+	for _, bucket := range aspectRatios {
+		if math.Abs(ratio-bucket.ratio)/bucket.ratio <= aspectRatioTolerance {
+			return bucket.name, nil
+		}
+	}
 	return "other", nil
 }
 
-func isWithinRange(value, min, max float64) bool {
-	return value >= min && value <= max
+// firstVideoStream skips audio and cover art, which may come before the video
+func firstVideoStream(probeData ffmpegData) (ffprobeStream, bool) {
+	for _, stream := range probeData.Streams {
+		if stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && stream.Width > 0 && stream.Height > 0 {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
+// displayDimensions is the size the first video stream is shown at: non-square pixels
+// stretched out and rotation metadata applied
+func displayDimensions(probeData ffmpegData) (float64, float64, error) {
+	stream, ok := firstVideoStream(probeData)
+	if !ok {
+		return 0, 0, errors.New("no video stream found")
+	}
+
+	width, height := float64(stream.Width), float64(stream.Height)
+	if dar, ok := parseRatio(stream.DisplayAspectRatio); ok {
+		width = height * dar
+	} else if sar, ok := parseRatio(stream.SampleAspectRatio); ok {
+		width = width * sar
+	}
+
+	if rotation := streamRotation(stream); rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	return width, height, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+// parseRatio reads ffprobe's "16:9" style ratios, "0:1" and "N/A" mean unknown
+func parseRatio(ratio string) (float64, bool) {
+	num, den, found := strings.Cut(ratio, ":")
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return n / d, true
+}
+
+// normalizeToMP4 produces a faststart H.264/AAC MP4 from any source we accept. A file that
+// already is one only gets its moov moved, anything else has ffmpeg copy the streams that are
+// browser friendly and re-encode the rest.
+func normalizeToMP4(ctx context.Context, tools *toolRunner, filePath string, probeData ffmpegData) (string, error) {
 	outputFilePath := fmt.Sprintf("%s.processing", filePath)
 
-	ffmpegCmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
+	if isPlayableMP4(probeData) {
+		err := fastStartMP4(filePath, outputFilePath)
+		if err == nil {
+			return outputFilePath, nil
+		}
+		log.Printf("Couldn't move moov to the front of %s in Go, falling back to ffmpeg: %v", filePath, err)
+	}
+
+	// only the main video and audio tracks, phones add data tracks the mp4 muxer can't take
+	args := []string{"-y", "-i", filePath, "-map", "0:V:0", "-map", "0:a:0?"}
+	args = append(args, mp4CodecArgs(probeData)...)
+	args = append(args, "-movflags", "faststart", "-f", "mp4", outputFilePath)
 
-	err := ffmpegCmd.Run()
+	err := tools.ffmpeg(ctx, args, nil, nil)
 	if err != nil {
-		return "", err
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("converting %v to mp4: %w", filePath, err)
 	}
 
 	return outputFilePath, nil
 }
+
+func mp4CodecArgs(probeData ffmpegData) []string {
+	videoCopy, audioCopy := false, true
+	videoFound, audioFound := false, false
+	for _, stream := range probeData.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && !videoFound:
+			videoFound = true
+			videoCopy = stream.CodecName == "h264" && (stream.PixFmt == "yuv420p" || stream.PixFmt == "yuvj420p")
+		case stream.CodecType == "audio" && !audioFound:
+			audioFound = true
+			audioCopy = stream.CodecName == "aac"
+		}
+	}
+
+	args := []string{}
+	if videoCopy {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "medium", "-crf", "23", "-pix_fmt", "yuv420p")
+	}
+	if audioCopy {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	return args
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestGetAspectRatio(t *testing.T) {
+	media := &fakeMediaProcessor{probes: map[string]ffmpegData{
+		"./samples/boots-video-horizontal.mp4": probeResult(1920, 1080, "30.0"),
+		"./samples/boots-video-vertical.mp4":   probeResult(1080, 1920, "30.0"),
+		"./samples/odd-size.mp4":               probeResult(1001, 333, "30.0"),
+	}}
+
 	tests := []struct {
 		name       string
 		inputVideo string
 		want       string
+		wantErr    bool
 	}{
 		{
 			name:       "Test 1: 16:9 Video",
@@ -20,13 +29,26 @@ func TestGetAspectRatio(t *testing.T) {
 			inputVideo: "./samples/boots-video-vertical.mp4",
 			want:       "9:16",
 		},
+		{
+			name:       "Test 3: Odd dimensions",
+			inputVideo: "./samples/odd-size.mp4",
+			want:       "other",
+		},
+		{
+			name:       "Test 4: Probe failure",
+			inputVideo: "./samples/corrupt.mp4",
+			wantErr:    true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			actual, err := getVideoAspectRatio(tt.inputVideo)
+			actual, err := getVideoAspectRatio(context.Background(), media, tt.inputVideo)
 			expected := tt.want
 
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
 			if actual != expected {
 				t.Errorf("got: %v; want: %v\n Error: %v", actual, expected, err)
 			}
@@ -34,3 +56,86 @@ func TestGetAspectRatio(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAspectRatioTimeout(t *testing.T) {
+	media := &fakeMediaProcessor{delay: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := getVideoAspectRatio(ctx, media, "./samples/boots-video-horizontal.mp4")
+	if err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func videoStream(width, height int) ffprobeStream {
+	return ffprobeStream{CodecType: "video", CodecName: "h264", Width: width, Height: height}
+}
+
+func TestClassifyAspectRatio(t *testing.T) {
+	audio := ffprobeStream{CodecType: "audio", CodecName: "aac"}
+
+	coverArt := videoStream(600, 600)
+	coverArt.Disposition.AttachedPic = 1
+
+	anamorphic := videoStream(720, 576)
+	anamorphic.SampleAspectRatio = "64:45"
+
+	withDAR := videoStream(720, 480)
+	withDAR.SampleAspectRatio = "8:9"
+	withDAR.DisplayAspectRatio = "4:3"
+
+	unknownDAR := videoStream(1920, 1080)
+	unknownDAR.SampleAspectRatio = "0:1"
+	unknownDAR.DisplayAspectRatio = "0:1"
+
+	rotatedSideData := videoStream(1920, 1080)
+	rotatedSideData.SideDataList = []ffprobeSideData{{SideDataType: "Display Matrix", Rotation: -90}}
+
+	rotatedTag := videoStream(1440, 1080)
+	rotatedTag.Tags.Rotate = "270"
+
+	upsideDown := videoStream(1920, 1080)
+	upsideDown.Tags.Rotate = "180"
+
+	tests := []struct {
+		name    string
+		streams []ffprobeStream
+		want    string
+		wantErr bool
+	}{
+		{name: "16:9", streams: []ffprobeStream{videoStream(1920, 1080)}, want: "16:9"},
+		{name: "9:16", streams: []ffprobeStream{videoStream(1080, 1920)}, want: "9:16"},
+		{name: "odd encoder size still 16:9", streams: []ffprobeStream{videoStream(1280, 718)}, want: "16:9"},
+		{name: "4:3", streams: []ffprobeStream{videoStream(640, 480)}, want: "4:3"},
+		{name: "3:4", streams: []ffprobeStream{videoStream(1080, 1440)}, want: "3:4"},
+		{name: "1:1", streams: []ffprobeStream{videoStream(1080, 1080)}, want: "1:1"},
+		{name: "21:9", streams: []ffprobeStream{videoStream(2560, 1080)}, want: "21:9"},
+		{name: "2.39 scope is 21:9", streams: []ffprobeStream{videoStream(1920, 804)}, want: "21:9"},
+		{name: "4:5", streams: []ffprobeStream{videoStream(1080, 1350)}, want: "4:5"},
+		{name: "other", streams: []ffprobeStream{videoStream(1000, 300)}, want: "other"},
+		{name: "audio first", streams: []ffprobeStream{audio, videoStream(1920, 1080)}, want: "16:9"},
+		{name: "cover art skipped", streams: []ffprobeStream{coverArt, videoStream(1080, 1920)}, want: "9:16"},
+		{name: "sample aspect ratio", streams: []ffprobeStream{anamorphic}, want: "16:9"},
+		{name: "display aspect ratio wins", streams: []ffprobeStream{withDAR}, want: "4:3"},
+		{name: "unknown ratios ignored", streams: []ffprobeStream{unknownDAR}, want: "16:9"},
+		{name: "display matrix rotation", streams: []ffprobeStream{rotatedSideData}, want: "9:16"},
+		{name: "rotate tag", streams: []ffprobeStream{rotatedTag}, want: "3:4"},
+		{name: "upside down keeps its shape", streams: []ffprobeStream{upsideDown}, want: "16:9"},
+		{name: "no video stream", streams: []ffprobeStream{audio}, wantErr: true},
+		{name: "only cover art", streams: []ffprobeStream{audio, coverArt}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := classifyAspectRatio(ffmpegData{Streams: tt.streams})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("classifyAspectRatio() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("classifyAspectRatio() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
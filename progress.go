@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Progress stages, in the order a video goes through them
+const (
+	stageUpload     = "upload"
+	stageQueued     = "queued"
+	stageProcessing = "processing"
+	stageStoring    = "storing"
+	stageReady      = "ready"
+	stageFailed     = "failed"
+)
+
+// progressPublishInterval throttles byte counters, a fast upload would otherwise publish per read
+const progressPublishInterval = 250 * time.Millisecond
+
+type progressEvent struct {
+	Stage string `json:"stage"`
+	// Step names the part of the stage being worked on, e.g. "hls" while processing
+	Step    string  `json:"step,omitempty"`
+	Percent float64 `json:"percent"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	Total   int64   `json:"total,omitempty"`
+	Message string  `json:"message,omitempty"`
+}
+
+func (e progressEvent) final() bool {
+	return e.Stage == stageReady || e.Stage == stageFailed
+}
+
+// progressHub fans progress out to the clients watching a video. It only knows about work
+// done by this process, and it keeps the latest event so late subscribers see the current state.
+type progressHub struct {
+	mu          sync.Mutex
+	latest      map[uuid.UUID]progressEvent
+	subscribers map[uuid.UUID]map[chan progressEvent]struct{}
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		latest:      map[uuid.UUID]progressEvent{},
+		subscribers: map[uuid.UUID]map[chan progressEvent]struct{}{},
+	}
+}
+
+func (h *progressHub) publish(videoID uuid.UUID, event progressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if event.final() {
+		// nothing left to catch up on once the video settles
+		delete(h.latest, videoID)
+	} else {
+		h.latest[videoID] = event
+	}
+	for ch := range h.subscribers[videoID] {
+		select {
+		case ch <- event:
+		default:
+			// a slow client misses intermediate events rather than holding up the pipeline
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+	}
+}
+
+// subscribe returns the latest event if there is one, a channel of the events after it
+// and a function to stop listening
+func (h *progressHub) subscribe(videoID uuid.UUID) (*progressEvent, <-chan progressEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan progressEvent, 16)
+	if h.subscribers[videoID] == nil {
+		h.subscribers[videoID] = map[chan progressEvent]struct{}{}
+	}
+	h.subscribers[videoID][ch] = struct{}{}
+
+	var latest *progressEvent
+	if event, ok := h.latest[videoID]; ok {
+		latest = &event
+	}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[videoID], ch)
+		if len(h.subscribers[videoID]) == 0 {
+			delete(h.subscribers, videoID)
+		}
+	}
+	return latest, ch, unsubscribe
+}
+
+// progressReader publishes how many bytes of a known total have been read through it.
+// It seeks when r does, object stores rewind and measure bodies that way.
+type progressReader struct {
+	r        io.Reader
+	offset   int64
+	read     int64
+	total    int64
+	report   func(read, total int64)
+	lastSent time.Time
+}
+
+func newProgressReader(r io.Reader, offset, total int64, report func(read, total int64)) *progressReader {
+	return &progressReader{r: r, offset: offset, read: offset, total: total, report: report}
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := p.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("progress reader: underlying reader can't seek")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	p.read = p.offset + pos
+	return pos, nil
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if time.Since(p.lastSent) >= progressPublishInterval || err == io.EOF {
+		p.lastSent = time.Now()
+		p.report(p.read, p.total)
+	}
+	return n, err
+}
+
+// reportUploadBody publishes the bytes of the request body as the handler reads them,
+// offset is how much of the file earlier requests already delivered
+func (cfg *apiConfig) reportUploadBody(r *http.Request, videoID uuid.UUID, offset, total int64) {
+	reader := newProgressReader(r.Body, offset, total, func(read, total int64) {
+		cfg.progress.publish(videoID, bytesEvent(stageUpload, read, total))
+	})
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, r.Body}
+}
+
+// rejectedEvent tells watchers an upload was turned away, with the reason if it was the file's fault
+func rejectedEvent(err error) progressEvent {
+	var rejection *mediaRejection
+	if errors.As(err, &rejection) {
+		return progressEvent{Stage: stageFailed, Message: rejection.reason}
+	}
+	return progressEvent{Stage: stageFailed, Message: "Upload failed"}
+}
+
+func bytesEvent(stage string, read, total int64) progressEvent {
+	event := progressEvent{Stage: stage, Bytes: read, Total: total}
+	if total > 0 {
+		event.Percent = min(100, float64(read)*100/float64(total))
+	}
+	return event
+}
+
+type ffmpegProgressKey struct{}
+
+// withFFmpegProgress asks the ffmpeg runs made with ctx to report how much of the input they've processed
+func withFFmpegProgress(ctx context.Context, report func(done time.Duration)) context.Context {
+	return context.WithValue(ctx, ffmpegProgressKey{}, report)
+}
+
+func ffmpegProgressFrom(ctx context.Context) func(done time.Duration) {
+	report, _ := ctx.Value(ffmpegProgressKey{}).(func(done time.Duration))
+	return report
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type rendition struct {
+	name         string
+	height       int
+	videoBitrate string
+	maxRate      string
+	bufSize      string
+	audioBitrate string
+}
+
+// renditionLadder is ordered from the highest rendition down, heights refer to the short side of the frame
+var renditionLadder = []rendition{
+	{name: "1080p", height: 1080, videoBitrate: "5000k", maxRate: "5350k", bufSize: "7500k", audioBitrate: "192k"},
+	{name: "720p", height: 720, videoBitrate: "2800k", maxRate: "2996k", bufSize: "4200k", audioBitrate: "128k"},
+	{name: "480p", height: 480, videoBitrate: "1400k", maxRate: "1498k", bufSize: "2100k", audioBitrate: "128k"},
+	{name: "360p", height: 360, videoBitrate: "800k", maxRate: "856k", bufSize: "1200k", audioBitrate: "96k"},
+}
+
+// renditionsFor caps the ladder at the source resolution so we never upscale,
+// a source smaller than every rung still gets a single rendition at its own size
+func renditionsFor(width, height int) []rendition {
+	shortSide := min(width, height)
+	renditions := []rendition{}
+	for _, r := range renditionLadder {
+		if r.height <= shortSide {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		smallest := renditionLadder[len(renditionLadder)-1]
+		smallest.height = shortSide - shortSide%2
+		smallest.name = fmt.Sprintf("%dp", smallest.height)
+		renditions = append(renditions, smallest)
+	}
+	return renditions
+}
+
+// renditionVideoArgs splits the source video into one scaled H.264 output per rendition,
+// output i of the returned args is mapped as video stream i
+func renditionVideoArgs(renditions []rendition, portrait bool) []string {
+	splitOutputs := ""
+	for i := range renditions {
+		splitOutputs += fmt.Sprintf("[v%d]", i)
+	}
+	filters := []string{fmt.Sprintf("[0:v]split=%d%s", len(renditions), splitOutputs)}
+	for i, r := range renditions {
+		scale := fmt.Sprintf("scale=-2:%d", r.height)
+		if portrait {
+			scale = fmt.Sprintf("scale=%d:-2", r.height)
+		}
+		filters = append(filters, fmt.Sprintf("[v%d]%s[v%dout]", i, scale, i))
+	}
+
+	args := []string{"-filter_complex", strings.Join(filters, ";")}
+	for i, r := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), r.videoBitrate,
+			fmt.Sprintf("-maxrate:v:%d", i), r.maxRate,
+			fmt.Sprintf("-bufsize:v:%d", i), r.bufSize,
+		)
+	}
+	// fixed GOPs so every rendition has segment boundaries in the same places
+	return append(args,
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		"-g", "48",
+		"-keyint_min", "48",
+		"-sc_threshold", "0",
+	)
+}
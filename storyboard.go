@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	storyboardTrack     = "storyboard.vtt"
+	storyboardTileWidth = 160
+	// 100 tiles a sheet keeps a sheet around 100KB and an hour of video at 5s intervals to 8 requests
+	storyboardColumns = 10
+	storyboardRows    = 10
+)
+
+// storyboardLayout describes how preview frames are sampled and tiled into sprite sheets
+type storyboardLayout struct {
+	// interval is the seconds between sampled frames
+	interval   float64
+	tileWidth  int
+	tileHeight int
+	columns    int
+	rows       int
+}
+
+// newStoryboardLayout sizes tiles to the video's display aspect ratio
+func newStoryboardLayout(width, height int, interval float64) storyboardLayout {
+	tileHeight := storyboardTileWidth
+	if width > 0 && height > 0 {
+		tileHeight = max(2, int(math.Round(float64(storyboardTileWidth*height)/float64(width))))
+	}
+	return storyboardLayout{
+		interval:   interval,
+		tileWidth:  storyboardTileWidth,
+		tileHeight: tileHeight,
+		columns:    storyboardColumns,
+		rows:       storyboardRows,
+	}
+}
+
+func (l storyboardLayout) tilesPerSheet() int {
+	return l.columns * l.rows
+}
+
+// storyboardSheetName matches the names ffmpeg gives the sheets, counting from 0
+func storyboardSheetName(sheet int) string {
+	return fmt.Sprintf("sprite_%03d.jpg", sheet+1)
+}
+
+// generateStoryboard has ffmpeg sample a frame every interval and tile the frames into JPEG sprite sheets,
+// the last sheet is padded when the frames run out
+func generateStoryboard(ctx context.Context, tools *toolRunner, filePath, outputDir string, layout storyboardLayout) error {
+	filter := fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d",
+		layout.interval, layout.tileWidth, layout.tileHeight, layout.columns, layout.rows)
+	args := []string{
+		"-y",
+		"-i", filePath,
+		"-map", "0:V:0",
+		"-vf", filter,
+		"-q:v", "5",
+		filepath.Join(outputDir, "sprite_%03d.jpg"),
+	}
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("generating a storyboard for %v: %w", filePath, err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, storyboardSheetName(0))); err != nil {
+		return fmt.Errorf("no storyboard sheets written for %v", filePath)
+	}
+	return nil
+}
+
+// storyboardVTT maps every interval of the video to its tile, using media fragment URIs relative to the
+// track so it works wherever the files are served from. Only the sheets that were written get cues.
+func storyboardVTT(layout storyboardLayout, duration float64, sheets int) []byte {
+	b := strings.Builder{}
+	b.WriteString("WEBVTT\n\n")
+
+	frames := min(int(math.Ceil(duration/layout.interval)), sheets*layout.tilesPerSheet())
+	for i := 0; i < frames; i++ {
+		start := float64(i) * layout.interval
+		end := min(start+layout.interval, duration)
+		tile := i % layout.tilesPerSheet()
+		x := (tile % layout.columns) * layout.tileWidth
+		y := (tile / layout.columns) * layout.tileHeight
+
+		fmt.Fprintf(&b, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			vttTimestamp(start), vttTimestamp(end),
+			storyboardSheetName(i/layout.tilesPerSheet()), x, y, layout.tileWidth, layout.tileHeight)
+	}
+	return []byte(b.String())
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp, hh:mm:ss.ttt
+func vttTimestamp(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3_600_000, millis/60_000%60, millis/1000%60, millis%1000)
+}
+
+// writeStoryboard renders the sprite sheets and their WebVTT track into outputDir
+func (cfg *apiConfig) writeStoryboard(ctx context.Context, filePath, outputDir string, layout storyboardLayout, duration float64) error {
+	err := cfg.media.GenerateStoryboard(ctx, filePath, outputDir, layout)
+	if err != nil {
+		return err
+	}
+
+	sheets := 0
+	for {
+		if _, err := os.Stat(filepath.Join(outputDir, storyboardSheetName(sheets))); err != nil {
+			break
+		}
+		sheets++
+	}
+	return os.WriteFile(filepath.Join(outputDir, storyboardTrack), storyboardVTT(layout, duration, sheets), 0644)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoryboardVTT(t *testing.T) {
+	layout := storyboardLayout{interval: 5, tileWidth: 160, tileHeight: 90, columns: 2, rows: 2}
+
+	got := string(storyboardVTT(layout, 22.5, 2))
+	want := `WEBVTT
+
+00:00:00.000 --> 00:00:05.000
+sprite_001.jpg#xywh=0,0,160,90
+
+00:00:05.000 --> 00:00:10.000
+sprite_001.jpg#xywh=160,0,160,90
+
+00:00:10.000 --> 00:00:15.000
+sprite_001.jpg#xywh=0,90,160,90
+
+00:00:15.000 --> 00:00:20.000
+sprite_001.jpg#xywh=160,90,160,90
+
+00:00:20.000 --> 00:00:22.500
+sprite_002.jpg#xywh=0,0,160,90
+
+`
+	if got != want {
+		t.Errorf("storyboardVTT() =\n%s\nwant\n%s", got, want)
+	}
+
+	// cues stop at the sheets ffmpeg actually wrote
+	got = string(storyboardVTT(layout, 22.5, 1))
+	if cues := strings.Count(got, "-->"); cues != 4 {
+		t.Errorf("%d cues with one sheet, want 4", cues)
+	}
+}
+
+func TestNewStoryboardLayout(t *testing.T) {
+	tests := []struct {
+		width, height int
+		wantHeight    int
+	}{
+		{1920, 1080, 90},
+		{1080, 1920, 284},
+		{1000, 1000, 160},
+		{0, 0, 160},
+	}
+	for _, tt := range tests {
+		layout := newStoryboardLayout(tt.width, tt.height, 5)
+		if layout.tileWidth != storyboardTileWidth || layout.tileHeight != tt.wantHeight {
+			t.Errorf("newStoryboardLayout(%d, %d) tiles are %dx%d, want %dx%d",
+				tt.width, tt.height, layout.tileWidth, layout.tileHeight, storyboardTileWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestVTTTimestamp(t *testing.T) {
+	tests := map[float64]string{
+		0:        "00:00:00.000",
+		1.5:      "00:00:01.500",
+		61.0004:  "00:01:01.000",
+		3723.456: "01:02:03.456",
+	}
+	for seconds, want := range tests {
+		if got := vttTimestamp(seconds); got != want {
+			t.Errorf("vttTimestamp(%v) = %q, want %q", seconds, got, want)
+		}
+	}
+}
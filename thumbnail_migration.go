@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+type thumbnailMigrationReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Scanned  int      `json:"scanned"`
+	Migrated int      `json:"migrated"`
+	Objects  int      `json:"objects"`
+	Skipped  int      `json:"skipped"`
+	Failed   []string `json:"failed"`
+}
+
+// migrateThumbnails moves thumbnails still in the local assets directory into the object store
+// and points the videos at their new URLs. Running it again only picks up what's left.
+func (cfg *apiConfig) migrateThumbnails(ctx context.Context, dryRun bool) (thumbnailMigrationReport, error) {
+	report := thumbnailMigrationReport{DryRun: dryRun, Failed: []string{}}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return report, err
+	}
+
+	for _, video := range videos {
+		if video.ThumbnailURL == nil {
+			continue
+		}
+		ref, ok := cfg.objectRefFromURL(*video.ThumbnailURL)
+		if !ok || ref.Store != assetStoreName {
+			continue
+		}
+		report.Scanned++
+
+		objects, migrated, err := cfg.migrateVideoThumbnail(ctx, video, ref, dryRun)
+		if err != nil {
+			log.Printf("Couldn't migrate the thumbnail of video %s: %v", video.ID, err)
+			report.Failed = append(report.Failed, video.ID.String())
+			continue
+		}
+		report.Objects += objects
+		if migrated {
+			report.Migrated++
+		} else if !dryRun {
+			report.Skipped++
+		}
+	}
+
+	return report, nil
+}
+
+func (cfg *apiConfig) migrateVideoThumbnail(ctx context.Context, video database.Video, ref database.ObjectRef, dryRun bool) (int, bool, error) {
+	// every thumbnail gets a directory of its own, a video's prefix must never cover another's files
+	keys := []string{ref.Key}
+	oldDir, newDir := "", thumbnailPrefix+newThumbnailDir()
+	if dir, ok := thumbnailVariantsDir(ref); ok {
+		// responsive variants, move the whole directory
+		ref = database.ObjectRef{Store: assetStoreName, Key: dir, Prefix: true}
+		objects, err := cfg.assetStore.List(ctx, ref.Key)
+		if err != nil {
+			return 0, false, err
+		}
+		keys = keys[:0]
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		oldDir, newDir = dir, thumbnailPrefix+dir
+	}
+	if dryRun {
+		return len(keys), false, nil
+	}
+
+	newRef := database.ObjectRef{Store: objectStoreName, Key: newDir, Prefix: true}
+	err := cfg.db.CreateVideoObject(video.ID, newRef)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, key := range keys {
+		err := cfg.copyAssetToObjectStore(ctx, key, newDir+strings.TrimPrefix(key, oldDir))
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	// the user may have uploaded a new thumbnail meanwhile, the copies then get cleaned up with the video
+	current, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		return 0, false, err
+	}
+	if current.ThumbnailURL == nil || *current.ThumbnailURL != *video.ThumbnailURL {
+		return len(keys), false, nil
+	}
+
+	oldBaseURL, newBaseURL := cfg.assetURL(oldDir), cfg.objectURL(newDir)
+	thumbnailURL := strings.Replace(*current.ThumbnailURL, oldBaseURL, newBaseURL, 1)
+	current.ThumbnailURL = &thumbnailURL
+	for mediaType, srcset := range current.ThumbnailSrcset {
+		current.ThumbnailSrcset[mediaType] = strings.ReplaceAll(srcset, oldBaseURL, newBaseURL)
+	}
+	err = cfg.db.UpdateVideo(current)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// anything left behind here is an orphan the garbage collector will find
+	err = cfg.db.DeleteVideoObjectsByRef(ref)
+	if err != nil {
+		log.Printf("Couldn't forget migrated thumbnail %s: %v", ref.Key, err)
+	} else if err := cfg.deleteObject(ctx, ref); err != nil {
+		log.Printf("Couldn't delete migrated thumbnail %s: %v", ref.Key, err)
+	}
+
+	return len(keys), true, nil
+}
+
+func (cfg *apiConfig) copyAssetToObjectStore(ctx context.Context, assetKey, objectKey string) error {
+	body, err := cfg.assetStore.Get(ctx, assetKey)
+	if err != nil {
+		return fmt.Errorf("unable to read asset %s: %w", assetKey, err)
+	}
+	defer body.Close()
+
+	return cfg.store.Put(ctx, objectKey, body, storage.ContentTypeForKey(assetKey))
+}
+
+func (cfg *apiConfig) handlerAdminMigrateThumbnails(w http.ResponseWriter, r *http.Request) {
+	if !cfg.isAdminRequest(r) {
+		respondWithError(w, http.StatusForbidden, "Admin access required", nil)
+		return
+	}
+
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		dryRun = value == "true" || value == "1"
+	}
+
+	report, err := cfg.migrateThumbnails(r.Context(), dryRun)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't migrate thumbnails", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestMigrateThumbnails(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	legacy, token := newTestVideo(t, cfg)
+
+	setThumbnail := func(video database.Video, url string, srcset database.Srcset) database.Video {
+		t.Helper()
+		video.ThumbnailURL = &url
+		video.ThumbnailSrcset = srcset
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			t.Fatal(err)
+		}
+		return video
+	}
+	newVideo := func(title string) database.Video {
+		t.Helper()
+		video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: title, UserID: legacy.UserID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return video
+	}
+
+	// a single file from before responsive variants
+	cfg.assetStore.Put(ctx, "legacy.png", bytes.NewReader([]byte("png")), "image/png")
+	legacy = setThumbnail(legacy, cfg.assetURL("legacy.png"), nil)
+
+	// responsive variants still in the assets directory
+	variantsDir := strings.Repeat("v", thumbnailDirLength) + "/"
+	cfg.assetStore.Put(ctx, variantsDir+"320w.jpeg", bytes.NewReader([]byte("jpeg")), "image/jpeg")
+	cfg.assetStore.Put(ctx, variantsDir+"640w.jpeg", bytes.NewReader([]byte("jpeg")), "image/jpeg")
+	variants := setThumbnail(newVideo("Variants"), cfg.assetURL(variantsDir+"640w.jpeg"), database.Srcset{
+		"image/jpeg": cfg.assetURL(variantsDir+"320w.jpeg") + " 320w, " + cfg.assetURL(variantsDir+"640w.jpeg") + " 640w",
+	})
+
+	// already in the object store
+	storedKey := thumbnailPrefix + strings.Repeat("s", thumbnailDirLength) + "/320w.jpeg"
+	cfg.store.Put(ctx, storedKey, bytes.NewReader([]byte("jpeg")), "image/jpeg")
+	setThumbnail(newVideo("Stored"), cfg.objectURL(storedKey), nil)
+
+	report, err := cfg.migrateThumbnails(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 2 || report.Objects != 3 || report.Migrated != 0 {
+		t.Errorf("dry run report = %+v, want 2 videos with 3 objects left in place", report)
+	}
+	if objects, _ := cfg.store.List(ctx, thumbnailPrefix); len(objects) != 1 {
+		t.Fatalf("objects after a dry run = %v, want only the stored thumbnail", objects)
+	}
+
+	report, err = cfg.migrateThumbnails(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 2 || report.Objects != 3 || report.Migrated != 2 || len(report.Failed) != 0 {
+		t.Errorf("report = %+v, want both videos migrated", report)
+	}
+	if objects, _ := cfg.assetStore.List(ctx, ""); len(objects) != 0 {
+		t.Errorf("assets after migrating = %v, want none", objects)
+	}
+
+	legacy, _ = cfg.db.GetVideo(legacy.ID)
+	legacyRef, _ := cfg.objectRefFromURL(*legacy.ThumbnailURL)
+	legacyDir, ok := thumbnailVariantsDir(legacyRef)
+	if !ok || legacyRef.Store != objectStoreName || !strings.HasSuffix(legacyRef.Key, "/legacy.png") {
+		t.Fatalf("legacy thumbnail = %s, want it in a directory of its own", *legacy.ThumbnailURL)
+	}
+	variants, _ = cfg.db.GetVideo(variants.ID)
+	if *variants.ThumbnailURL != cfg.objectURL(thumbnailPrefix+variantsDir+"640w.jpeg") || strings.Contains(variants.ThumbnailSrcset["image/jpeg"], cfg.assetURL("")) {
+		t.Errorf("variants = %s, %v, want them under %s", *variants.ThumbnailURL, variants.ThumbnailSrcset, thumbnailPrefix+variantsDir)
+	}
+
+	if report, _ := cfg.migrateThumbnails(ctx, false); report.Scanned != 0 {
+		t.Errorf("second run report = %+v, want nothing left", report)
+	}
+
+	// deleting the migrated video only takes its own thumbnail along
+	req := httptest.NewRequest(http.MethodDelete, "/api/videos/"+legacy.ID.String(), nil)
+	req.SetPathValue("videoID", legacy.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoMetaDelete(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+	if objects, _ := cfg.store.List(ctx, legacyDir); len(objects) != 0 {
+		t.Errorf("legacy thumbnail after deleting its video = %v", objects)
+	}
+	for _, key := range []string{thumbnailPrefix + variantsDir + "320w.jpeg", thumbnailPrefix + variantsDir + "640w.jpeg", storedKey} {
+		if _, err := cfg.store.Get(ctx, key); err != nil {
+			t.Errorf("other video's thumbnail %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// thumbnailPrefix is where thumbnails live in the object store, next to the videos
+const thumbnailPrefix = "thumbnails/"
+
+// thumbnailDirLength is the length of the random directory storeThumbnail puts a thumbnail's variants in
+var thumbnailDirLength = base64.RawURLEncoding.EncodedLen(32)
+
+func newThumbnailDir() string {
+	randomName := make([]byte, 32)
+	rand.Read(randomName)
+	return base64.RawURLEncoding.EncodeToString(randomName) + "/"
+}
+
+// thumbnailVariantsDir returns the directory of responsive variants a thumbnail belongs to, false for a
+// single-file thumbnail. Only the thumbnails/<random>/<file> keys storeThumbnail creates count, or
+// <random>/<file> in the assets directory for variants from before the move to the object store.
+func thumbnailVariantsDir(ref database.ObjectRef) (string, bool) {
+	key := ref.Key
+	if ref.Store == objectStoreName {
+		var ok bool
+		if key, ok = strings.CutPrefix(key, thumbnailPrefix); !ok {
+			return "", false
+		}
+	}
+	dir, file, ok := strings.Cut(key, "/")
+	if !ok || len(dir) != thumbnailDirLength || file == "" || strings.Contains(file, "/") {
+		return "", false
+	}
+	return strings.TrimSuffix(ref.Key, file), true
+}
+
+// storeThumbnail re-encodes a thumbnail into its responsive variants, all stored under one random prefix.
+// It returns the largest JPEG as the plain thumbnail URL alongside the srcset for each format.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, videoID uuid.UUID, img image.Image) (string, database.Srcset, error) {
+	variants, err := thumbnailVariants(ctx, cfg.media, img)
+	if err != nil {
+		return "", nil, err
+	}
+
+	prefix := thumbnailPrefix + newThumbnailDir()
+
+	// record the prefix first so a failure halfway through still gets cleaned up
+	err = cfg.db.CreateVideoObject(videoID, database.ObjectRef{Store: objectStoreName, Key: prefix, Prefix: true})
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to record the uploaded thumbnail: %w", err)
+	}
+
+	thumbnailURL := ""
+	entries := map[string][]string{}
+	for _, variant := range variants {
+		fileExtension := strings.Replace(variant.mediaType, "image/", "", 1)
+		key := fmt.Sprintf("%s%dw.%s", prefix, variant.width, fileExtension)
+
+		err := cfg.store.Put(ctx, key, bytes.NewReader(variant.data), variant.mediaType)
+		if err != nil {
+			return "", nil, err
+		}
+
+		url := cfg.objectURL(key)
+		entries[variant.mediaType] = append(entries[variant.mediaType], fmt.Sprintf("%s %dw", url, variant.width))
+		if variant.mediaType == "image/jpeg" {
+			// variants come smallest first
+			thumbnailURL = url
+		}
+	}
+
+	srcset := database.Srcset{}
+	for mediaType, urls := range entries {
+		srcset[mediaType] = strings.Join(urls, ", ")
+	}
+	return thumbnailURL, srcset, nil
+}
+
+// extractThumbnailFrame grabs a single frame as a PNG.
+// Without a timestamp ffmpeg's thumbnail filter picks the most representative frame of each batch.
+func extractThumbnailFrame(ctx context.Context, tools *toolRunner, filePath, outputPath, timestamp string) error {
+	args := []string{"-y"}
+	if timestamp != "" {
+		args = append(args, "-ss", timestamp, "-i", filePath)
+	} else {
+		args = append(args, "-i", filePath, "-vf", "thumbnail=100")
+	}
+	args = append(args, "-frames:v", "1", "-update", "1", "-c:v", "png", outputPath)
+
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("extracting a thumbnail from %v: %w", filePath, err)
+	}
+
+	// seeking past the end of a short video succeeds without writing anything
+	info, err := os.Stat(outputPath)
+	if err != nil || info.Size() == 0 {
+		return fmt.Errorf("no frame extracted from %v at %q", filePath, timestamp)
+	}
+	return nil
+}
+
+// generateThumbnail extracts a frame from the processed source and stores it like an uploaded thumbnail
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, videoID uuid.UUID, sourcePath string) (string, database.Srcset, error) {
+	outputDir, err := os.MkdirTemp("", "tubely-thumbnail")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	outputPath := filepath.Join(outputDir, "thumbnail.png")
+
+	err = cfg.media.ExtractFrame(ctx, sourcePath, outputPath, cfg.autoThumbnailTimestamp)
+	if err != nil && cfg.autoThumbnailTimestamp != "" {
+		// the timestamp may be past the end of the video, fall back to picking a frame
+		err = cfg.media.ExtractFrame(ctx, sourcePath, outputPath, "")
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return "", nil, err
+	}
+	img, err := decodeThumbnail(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return cfg.storeThumbnail(ctx, videoID, img)
+}
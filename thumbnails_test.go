@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestThumbnailVariantsDir(t *testing.T) {
+	dir := strings.Repeat("a", thumbnailDirLength) + "/"
+	tests := []struct {
+		name string
+		ref  database.ObjectRef
+		want string
+	}{
+		{name: "variant", ref: database.ObjectRef{Store: objectStoreName, Key: thumbnailPrefix + dir + "640w.jpeg"}, want: thumbnailPrefix + dir},
+		{name: "unmigrated variant", ref: database.ObjectRef{Store: assetStoreName, Key: dir + "640w.jpeg"}, want: dir},
+		{name: "single file", ref: database.ObjectRef{Store: assetStoreName, Key: "legacy.png"}},
+		{name: "single file under thumbnails", ref: database.ObjectRef{Store: objectStoreName, Key: thumbnailPrefix + "legacy.png"}},
+		{name: "shared folder", ref: database.ObjectRef{Store: objectStoreName, Key: thumbnailPrefix + "shared/legacy.png"}},
+		{name: "outside thumbnails", ref: database.ObjectRef{Store: objectStoreName, Key: "landscape/" + dir + "640w.jpeg"}},
+		{name: "nested", ref: database.ObjectRef{Store: objectStoreName, Key: thumbnailPrefix + dir + "more/640w.jpeg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := thumbnailVariantsDir(tt.ref)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("thumbnailVariantsDir(%v) = %q, %v, want %q", tt.ref, got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	transcriberWhisper = "whisper"
+	// undeterminedLanguage is the ISO 639 code for a track whose language isn't known
+	undeterminedLanguage = "und"
+)
+
+// Transcriber turns the speech in a video into captions, tests swap in a fake
+type Transcriber interface {
+	// Transcribe reads a 16-bit mono WAV file at pcmSampleRate
+	Transcribe(ctx context.Context, wavPath string) (transcript, error)
+}
+
+type transcript struct {
+	// language is what was spoken as a tag normalizeCaptionLanguage accepts, or undeterminedLanguage
+	language string
+	vtt      []byte
+}
+
+// whisperTranscriber runs a whisper.cpp style command line, e.g. whisper-cli from whisper.cpp
+type whisperTranscriber struct {
+	tools  *toolRunner
+	binary string
+	model  string
+	// language is passed to -l, "auto" has the model detect it
+	language string
+}
+
+var _ Transcriber = whisperTranscriber{}
+
+func (w whisperTranscriber) Transcribe(ctx context.Context, wavPath string) (transcript, error) {
+	outputDir, err := os.MkdirTemp("", "tubely-transcript")
+	if err != nil {
+		return transcript{}, err
+	}
+	defer os.RemoveAll(outputDir)
+	outputBase := filepath.Join(outputDir, "transcript")
+
+	args := []string{
+		"-m", w.model,
+		"-f", wavPath,
+		"-l", w.language,
+		"-ovtt",
+		"-oj",
+		"-of", outputBase,
+		"-np",
+	}
+	err = w.tools.run(ctx, w.tools.limits.processTimeout, w.binary, args, nil, nil)
+	if err != nil {
+		return transcript{}, fmt.Errorf("transcribing %v: %w", wavPath, err)
+	}
+
+	data, err := os.ReadFile(outputBase + ".vtt")
+	if err != nil {
+		return transcript{}, fmt.Errorf("transcript missing after transcribing: %w", err)
+	}
+	vtt, err := toWebVTT(data)
+	if err != nil {
+		return transcript{}, fmt.Errorf("transcriber wrote invalid captions: %w", err)
+	}
+
+	language := w.language
+	if language == "auto" {
+		language = whisperDetectedLanguage(outputBase + ".json")
+	}
+	if normalized, ok := normalizeCaptionLanguage(language); ok {
+		language = normalized
+	} else {
+		language = undeterminedLanguage
+	}
+	return transcript{language: language, vtt: vtt}, nil
+}
+
+// whisperDetectedLanguage reads the language from whisper.cpp's JSON output, empty if it isn't there
+func whisperDetectedLanguage(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	output := struct {
+		Result struct {
+			Language string `json:"language"`
+		} `json:"result"`
+	}{}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return ""
+	}
+	return output.Result.Language
+}
+
+// writeWAV wraps the raw samples written by decodeAudioPCM in a WAV header, which is what speech models read
+func writeWAV(pcmPath, wavPath string) error {
+	pcm, err := os.Open(pcmPath)
+	if err != nil {
+		return err
+	}
+	defer pcm.Close()
+	info, err := pcm.Stat()
+	if err != nil {
+		return err
+	}
+
+	wav, err := os.Create(wavPath)
+	if err != nil {
+		return err
+	}
+	defer wav.Close()
+
+	const bitsPerSample, channels = 16, 1
+	dataSize := uint32(info.Size())
+	w := bufio.NewWriter(wav)
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(channels), uint32(pcmSampleRate),
+		uint32(pcmSampleRate * channels * bitsPerSample / 8), uint16(channels * bitsPerSample / 8), uint16(bitsPerSample),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(w, pcm); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return wav.Close()
+}
+
+// storeTranscript transcribes decoded audio and stores the result as the video's auto-generated captions
+func (cfg *apiConfig) storeTranscript(ctx context.Context, video database.Video, pcmPath string) error {
+	cfg.progress.publish(video.ID, progressEvent{Stage: stageProcessing, Step: "transcribe"})
+
+	wavPath := pcmPath + ".wav"
+	if err := writeWAV(pcmPath, wavPath); err != nil {
+		return err
+	}
+	defer os.Remove(wavPath)
+
+	result, err := cfg.transcriber.Transcribe(ctx, wavPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.storeCaption(ctx, video.ID, result.language, result.language+" (auto-generated)", true, result.vtt)
+	if err != nil {
+		return err
+	}
+
+	// a new upload can be in another language, its old transcript shouldn't linger
+	captions, err := cfg.db.GetCaptions(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, caption := range captions {
+		if !caption.AutoGenerated || caption.Language == result.language {
+			continue
+		}
+		if err := cfg.db.DeleteCaption(caption.ID); err != nil {
+			return err
+		}
+		cfg.deleteCaptionObject(ctx, caption)
+	}
+	return cfg.publishHLSSubtitles(ctx, video)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteWAV(t *testing.T) {
+	dir := t.TempDir()
+	pcmPath := filepath.Join(dir, "audio.pcm")
+	if err := os.WriteFile(pcmPath, []byte{1, 0, 2, 0, 3, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wavPath := filepath.Join(dir, "audio.wav")
+	if err := writeWAV(pcmPath, wavPath); err != nil {
+		t.Fatal(err)
+	}
+	wav, err := os.ReadFile(wavPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wav) != 50 || string(wav[0:4]) != "RIFF" || string(wav[8:16]) != "WAVEfmt " || string(wav[36:40]) != "data" {
+		t.Fatalf("not a WAV file: % x", wav)
+	}
+	if size := binary.LittleEndian.Uint32(wav[4:8]); size != 42 {
+		t.Errorf("RIFF size = %d, want 42", size)
+	}
+	if rate := binary.LittleEndian.Uint32(wav[24:28]); rate != pcmSampleRate {
+		t.Errorf("sample rate = %d, want %d", rate, pcmSampleRate)
+	}
+	if size := binary.LittleEndian.Uint32(wav[40:44]); size != 6 {
+		t.Errorf("data size = %d, want 6", size)
+	}
+}
+
+// fakeWhisper writes the outputs whisper.cpp would next to the -of path it's given
+const fakeWhisper = `
+while [ "$#" -gt 0 ]; do
+	if [ "$1" = "-of" ]; then out="$2"; fi
+	shift
+done
+printf 'WEBVTT\n\n00:00:00.000 --> 00:00:01.500\n Hola\n\n' > "$out.vtt"
+printf '{"result": {"language": "es"}, "transcription": []}' > "$out.json"
+`
+
+func TestWhisperTranscriber(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "whisper")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"+fakeWhisper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tools := newToolRunner(toolLimits{processTimeout: 10 * time.Second, maxProcesses: 1})
+
+	tests := []struct {
+		name         string
+		language     string
+		wantLanguage string
+	}{
+		{name: "detected", language: "auto", wantLanguage: "es"},
+		{name: "configured", language: "en", wantLanguage: "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whisper := whisperTranscriber{tools: tools, binary: script, model: "model.bin", language: tt.language}
+			result, err := whisper.Transcribe(context.Background(), "audio.wav")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.language != tt.wantLanguage {
+				t.Errorf("language = %q, want %q", result.language, tt.wantLanguage)
+			}
+			if !strings.Contains(string(result.vtt), "00:00:00.000 --> 00:00:01.500\n Hola") {
+				t.Errorf("vtt = %q, want the transcript", result.vtt)
+			}
+		})
+	}
+
+	failing := whisperTranscriber{tools: tools, binary: "false", model: "model.bin", language: "auto"}
+	var toolErr *toolError
+	if _, err := failing.Transcribe(context.Background(), "audio.wav"); !errors.As(err, &toolErr) {
+		t.Errorf("err = %v, want a tool error", err)
+	}
+}
+
+func TestProcessVideoUploadTranscribes(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "source.upload")
+	if err := os.WriteFile(sourcePath, testMP4, 0644); err != nil {
+		t.Fatal(err)
+	}
+	media := &fakeMediaProcessor{probes: map[string]ffmpegData{sourcePath: probeResult(1920, 1080, "1.0")}}
+	cfg := newTestConfig(t, media)
+	video, _ := newTestVideo(t, cfg)
+
+	process := func(language string) {
+		t.Helper()
+		cfg.transcriber = fakeTranscriber{language: language}
+		if _, err := cfg.processVideoUpload(context.Background(), video, sourcePath, "video/mp4"); err != nil {
+			t.Fatalf("processVideoUpload() error = %v", err)
+		}
+	}
+
+	process("en")
+	captions, err := cfg.db.GetCaptions(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captions) != 1 || captions[0].Language != "en" || !captions[0].AutoGenerated {
+		t.Fatalf("captions = %+v, want one auto-generated en track", captions)
+	}
+	track, err := cfg.getObjectText(context.Background(), captions[0].ObjectKey)
+	if err != nil || track != "WEBVTT\n\n00:00:00.000 --> 00:00:01.000\nSegment 1\n\n" {
+		t.Errorf("stored transcript = %q, %v", track, err)
+	}
+	if media.callCount("pcm") != 1 {
+		t.Errorf("decoded the audio %d times, want once", media.callCount("pcm"))
+	}
+
+	// reprocessing replaces the transcript, even when the language changes
+	process("fr")
+	captions, _ = cfg.db.GetCaptions(video.ID)
+	if len(captions) != 1 || captions[0].Language != "fr" {
+		t.Errorf("captions after reprocessing = %+v, want only the fr track", captions)
+	}
+
+	// a failed transcription doesn't fail the video
+	cfg.transcriber = fakeTranscriber{err: errors.New("model missing")}
+	if _, err := cfg.processVideoUpload(context.Background(), video, sourcePath, "video/mp4"); err != nil {
+		t.Errorf("processVideoUpload() with a failing transcriber error = %v", err)
+	}
+}
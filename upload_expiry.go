@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// runUploadExpiry periodically drops resumable and direct uploads that were never finished
+func (cfg *apiConfig) runUploadExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cfg.expireTusUploads()
+		cfg.abortStaleMultipartUploads(ctx, cfg.uploadExpiry)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	pendingDeletionBatchSize = 100
+	pendingDeletionMaxDelay  = 6 * time.Hour
+)
+
+// videoObjectRefs lists everything stored for a video: objects recorded at upload time
+// (including ones replaced by later uploads) plus whatever its URLs currently point at.
+func (cfg *apiConfig) videoObjectRefs(video database.Video) ([]database.ObjectRef, error) {
+	tracked, err := cfg.db.GetVideoObjects(video.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[database.ObjectRef]bool{}
+	refs := []database.ObjectRef{}
+	addRef := func(ref database.ObjectRef) {
+		if seen[ref] {
+			return
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+
+	for _, obj := range tracked {
+		addRef(obj.ObjectRef)
+	}
+	for _, ref := range cfg.currentVideoRefs(video) {
+		addRef(ref)
+	}
+	return refs, nil
+}
+
+// deletePendingObjects attempts every queued deletion, anything that fails stays queued with a backoff
+func (cfg *apiConfig) deletePendingObjects(ctx context.Context, pending []database.PendingDeletion) int {
+	failed := 0
+	for _, deletion := range pending {
+		err := cfg.deleteObject(ctx, deletion.ObjectRef)
+		if err != nil {
+			failed++
+			log.Printf("Couldn't delete %s object %s (attempt %d): %v", deletion.Store, deletion.Key, deletion.Attempts+1, err)
+			nextAttempt := time.Now().Add(pendingDeletionBackoff(deletion.Attempts + 1))
+			if err := cfg.db.MarkPendingDeletionFailed(deletion.ID, err.Error(), nextAttempt); err != nil {
+				log.Printf("Couldn't reschedule deletion of %s: %v", deletion.Key, err)
+			}
+			continue
+		}
+		if err := cfg.db.DeletePendingDeletion(deletion.ID); err != nil {
+			log.Printf("Couldn't clear pending deletion of %s: %v", deletion.Key, err)
+		}
+	}
+	return failed
+}
+
+func (cfg *apiConfig) deleteObject(ctx context.Context, ref database.ObjectRef) error {
+	store, err := cfg.storeByName(ref.Store)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{ref.Key}
+	if ref.Prefix {
+		objects, err := store.List(ctx, ref.Key)
+		if err != nil {
+			return err
+		}
+		keys = keys[:0]
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+	}
+
+	for _, key := range keys {
+		err = store.Delete(ctx, key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPendingDeletions retries object deletions that failed after their video row was already removed
+func (cfg *apiConfig) runPendingDeletions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pending, err := cfg.db.GetDuePendingDeletions(time.Now(), pendingDeletionBatchSize)
+		if err != nil {
+			log.Printf("Couldn't load pending deletions: %v", err)
+		} else if len(pending) > 0 {
+			failed := cfg.deletePendingObjects(ctx, pending)
+			log.Printf("Retried %d pending object deletions, %d still failing", len(pending), failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pendingDeletionBackoff(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < pendingDeletionMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, pendingDeletionMaxDelay)
+}
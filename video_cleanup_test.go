@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// failingDeleteStore fails every Delete with err while it's set
+type failingDeleteStore struct {
+	storage.ObjectStore
+	err error
+}
+
+func (s *failingDeleteStore) Delete(ctx context.Context, key string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.ObjectStore.Delete(ctx, key)
+}
+
+func TestPendingDeletionRetry(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	store := &failingDeleteStore{ObjectStore: cfg.store, err: errors.New("connection refused")}
+	cfg.store = store
+	video, token := newTestVideo(t, cfg)
+
+	for _, key := range []string{"landscape/video.mp4", "landscape/video/hls/master.m3u8"} {
+		cfg.store.Put(ctx, key, bytes.NewReader([]byte("data")), "")
+	}
+	videoURL := cfg.objectURL("landscape/video.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	// the video goes even though its files can't be deleted yet
+	req := httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String(), nil)
+	req.SetPathValue("videoID", video.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoMetaDelete(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+	if deleted, _ := cfg.db.GetVideo(video.ID); deleted.ID == video.ID {
+		t.Error("video row still there")
+	}
+
+	// failed deletions back off before they're due again
+	if due, _ := cfg.db.GetDuePendingDeletions(time.Now(), pendingDeletionBatchSize); len(due) != 0 {
+		t.Errorf("due right after failing = %+v, want none", due)
+	}
+	due, err := cfg.db.GetDuePendingDeletions(time.Now().Add(pendingDeletionBackoff(1)), pendingDeletionBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 {
+		t.Fatalf("due after the backoff = %+v, want the video and its artifacts", due)
+	}
+	for _, deletion := range due {
+		if deletion.Attempts != 1 || deletion.LastError == nil {
+			t.Errorf("deletion = %+v, want one failed attempt recorded", deletion)
+		}
+	}
+
+	store.err = nil
+	if failed := cfg.deletePendingObjects(ctx, due); failed != 0 {
+		t.Errorf("failed = %d, want every retry to succeed", failed)
+	}
+	if objects, _ := cfg.store.List(ctx, ""); len(objects) != 0 {
+		t.Errorf("objects after the retry = %v, want none", objects)
+	}
+	if refs, _ := cfg.db.GetPendingDeletionRefs(); len(refs) != 0 {
+		t.Errorf("pending deletions after the retry = %v, want none", refs)
+	}
+}
+
+func TestPendingDeletionBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		50: pendingDeletionMaxDelay,
+	} {
+		if got := pendingDeletionBackoff(attempts); got != want {
+			t.Errorf("pendingDeletionBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobPollInterval = 5 * time.Second
+	jobMaxBackoff   = 30 * time.Minute
+)
+
+var errVideoGone = errors.New("video was deleted before processing finished")
+
+// spoolUpload copies an upload somewhere that survives restarts so a worker can pick it up later
+func (cfg *apiConfig) spoolUpload(src io.Reader) (string, error) {
+	randomName := make([]byte, 16)
+	rand.Read(randomName)
+	spoolPath := filepath.Join(cfg.spoolDir, hex.EncodeToString(randomName)+".upload")
+
+	spoolFile, err := os.Create(spoolPath)
+	if err != nil {
+		return "", err
+	}
+	defer spoolFile.Close()
+
+	if _, err := io.Copy(spoolFile, src); err != nil {
+		os.Remove(spoolPath)
+		return "", err
+	}
+	if err := spoolFile.Sync(); err != nil {
+		os.Remove(spoolPath)
+		return "", err
+	}
+	return spoolPath, nil
+}
+
+func (cfg *apiConfig) enqueueVideoJob(params database.CreateJobParams) (database.Job, error) {
+	params.MaxAttempts = cfg.jobMaxAttempts
+	job, err := cfg.db.CreateJob(params)
+	if err != nil {
+		return database.Job{}, err
+	}
+	cfg.jobQueued(params.VideoID)
+	return job, nil
+}
+
+// jobQueued tells the video's watchers and an idle worker about a job that was just created
+func (cfg *apiConfig) jobQueued(videoID uuid.UUID) {
+	cfg.progress.publish(videoID, progressEvent{Stage: stageQueued})
+
+	// wake an idle worker instead of waiting for the next poll
+	select {
+	case cfg.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+func (cfg *apiConfig) startVideoWorkers(ctx context.Context, workers int) error {
+	requeued, err := cfg.db.RequeueInterruptedJobs()
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d video jobs interrupted by a restart", requeued)
+	}
+
+	for i := 0; i < workers; i++ {
+		go cfg.runVideoWorker(ctx, i)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runVideoWorker(ctx context.Context, workerID int) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job, err := cfg.db.ClaimNextJob(time.Now())
+			if err != nil {
+				log.Printf("Worker %d couldn't claim a job: %v", workerID, err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			cfg.runVideoJob(ctx, *job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cfg.jobWake:
+		}
+	}
+}
+
+func (cfg *apiConfig) runVideoJob(ctx context.Context, job database.Job) {
+	log.Printf("Processing video %s (job %s, attempt %d of %d)", job.VideoID, job.ID, job.Attempts, job.MaxAttempts)
+
+	err := cfg.processVideoJob(ctx, job)
+	if err == nil {
+		if err := cfg.db.MarkJobReady(job.ID); err != nil {
+			log.Printf("Couldn't mark job %s ready: %v", job.ID, err)
+		}
+		cfg.removeJobSource(ctx, job)
+		cfg.progress.publish(job.VideoID, progressEvent{Stage: stageReady, Percent: 100})
+		log.Printf("Video %s is ready", job.VideoID)
+		return
+	}
+
+	// the full error names server paths and has ffmpeg's output, only the log gets it
+	message := jobFailureMessage(err)
+	if errors.Is(err, errVideoGone) || job.Attempts >= job.MaxAttempts {
+		log.Printf("Video job %s failed for good: %v", job.ID, err)
+		if err := cfg.db.MarkJobFailed(job.ID, message); err != nil {
+			log.Printf("Couldn't mark job %s failed: %v", job.ID, err)
+		}
+		cfg.progress.publish(job.VideoID, progressEvent{Stage: stageFailed, Message: message})
+		cfg.removeJobSource(ctx, job)
+		return
+	}
+
+	nextRun := time.Now().Add(jobRetryBackoff(job.Attempts))
+	log.Printf("Video job %s failed, retrying at %s: %v", job.ID, nextRun.Format(time.RFC3339), err)
+	if err := cfg.db.RetryJob(job.ID, message, nextRun); err != nil {
+		log.Printf("Couldn't requeue job %s: %v", job.ID, err)
+	}
+	cfg.progress.publish(job.VideoID, progressEvent{Stage: stageQueued, Message: "Processing failed, retrying at " + nextRun.Format(time.Kitchen)})
+}
+
+// jobFailureMessage describes why a job failed in words fit for the video's owner
+func jobFailureMessage(err error) string {
+	var rejection *mediaRejection
+	var toolErr *toolError
+	switch {
+	case errors.As(err, &rejection):
+		return rejection.reason
+	case errors.Is(err, errVideoGone):
+		return "The video was deleted while it was being processed"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Processing took too long"
+	case errors.As(err, &toolErr):
+		return "Couldn't process the video, the file may be corrupt or use an unsupported format"
+	default:
+		return "Processing failed"
+	}
+}
+
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job database.Job) error {
+	if cfg.jobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.jobTimeout)
+		defer cancel()
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return errVideoGone
+	}
+
+	sourcePath := job.SourcePath
+	if job.SourceKey != "" {
+		// uploaded straight to the bucket, pull a local copy for ffmpeg
+		body, err := cfg.store.Get(ctx, job.SourceKey)
+		if err != nil {
+			return fmt.Errorf("unable to download uploaded source %s: %w", job.SourceKey, err)
+		}
+		defer body.Close()
+
+		sourcePath, err = cfg.spoolUpload(body)
+		if err != nil {
+			return fmt.Errorf("unable to download uploaded source %s: %w", job.SourceKey, err)
+		}
+		defer os.Remove(sourcePath)
+	}
+	if _, err := os.Stat(sourcePath); err != nil {
+		return fmt.Errorf("uploaded source is missing: %w", err)
+	}
+
+	mediaType := job.MediaType
+	if isClipJob(job) {
+		stepCtx := cfg.processingStep(ctx, video.ID, "clip", *job.ClipEnd-*job.ClipStart)
+		clipPath, err := cfg.cutClipFile(stepCtx, sourcePath, *job.ClipStart, *job.ClipEnd)
+		if err != nil {
+			return fmt.Errorf("unable to cut the clip: %w", err)
+		}
+		defer os.Remove(clipPath)
+		sourcePath, mediaType = clipPath, "video/mp4"
+	}
+
+	video.Watermarked = job.SourceWatermarked
+	_, err = cfg.processVideoUpload(ctx, video, sourcePath, mediaType)
+	return err
+}
+
+func (cfg *apiConfig) removeJobSource(ctx context.Context, job database.Job) {
+	if job.SourcePath != "" {
+		os.Remove(job.SourcePath)
+	}
+	// a clip's source object is its parent's video, not an upload of its own
+	if job.SourceKey != "" && !isClipJob(job) {
+		err := cfg.deleteObject(ctx, database.ObjectRef{Store: objectStoreName, Key: job.SourceKey})
+		if err != nil {
+			// unreferenced, the garbage collector picks it up later
+			log.Printf("Couldn't delete uploaded source %s: %v", job.SourceKey, err)
+		}
+	}
+}
+
+func jobRetryBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < jobMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, jobMaxBackoff)
+}
+
+func isClipJob(job database.Job) bool {
+	return job.ClipStart != nil && job.ClipEnd != nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestJobFailureMessage(t *testing.T) {
+	ffmpegErr := &toolError{Tool: "ffmpeg", Args: []string{"-i", "/var/tmp/tubely-spool/abc"}, ExitCode: 1, Stderr: "/var/tmp/tubely-spool/abc: Invalid data", Err: errors.New("exit status 1")}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "tool", err: fmt.Errorf("transcoding /var/tmp/tubely-spool/abc: %w", ffmpegErr), want: "Couldn't process the video, the file may be corrupt or use an unsupported format"},
+		{name: "rejection", err: fmt.Errorf("unable to probe: %w", rejectInvalid("Video is too long")), want: "Video is too long"},
+		{name: "timeout", err: fmt.Errorf("waiting to run ffmpeg: %w", context.DeadlineExceeded), want: "Processing took too long"},
+		{name: "deleted", err: errVideoGone, want: "The video was deleted while it was being processed"},
+		{name: "anything else", err: errors.New("unable to upload /var/tmp/tubely-spool/abc"), want: "Processing failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobFailureMessage(tt.err); got != tt.want {
+				t.Errorf("jobFailureMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunVideoJobHidesErrors(t *testing.T) {
+	media := &fakeMediaProcessor{
+		probe: func(ctx context.Context, input string) (ffmpegData, error) {
+			return ffmpegData{}, &toolError{Tool: "ffprobe", Args: []string{input}, ExitCode: 1, Stderr: input + ": Invalid data", Err: errors.New("exit status 1")}
+		},
+	}
+	cfg := newTestConfig(t, media)
+	video, _ := newTestVideo(t, cfg)
+	sourcePath := filepath.Join(cfg.spoolDir, "source.upload")
+	if err := os.WriteFile(sourcePath, testMP4, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := cfg.enqueueVideoJob(database.CreateJobParams{VideoID: video.ID, SourcePath: sourcePath, MediaType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, events, unsubscribe := cfg.progress.subscribe(video.ID)
+	defer unsubscribe()
+
+	job.Attempts = job.MaxAttempts
+	cfg.runVideoJob(context.Background(), job)
+
+	stored, err := cfg.db.GetLatestJobForVideo(video.ID)
+	if err != nil || stored == nil || stored.Error == nil {
+		t.Fatalf("job = %+v, %v, want a recorded failure", stored, err)
+	}
+	select {
+	case event := <-events:
+		for _, message := range []string{*stored.Error, event.Message} {
+			if message == "" || strings.Contains(message, cfg.spoolDir) || strings.Contains(message, "ffprobe") {
+				t.Errorf("failure message %q leaks details", message)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no failure event")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// processVideoUpload takes an uploaded source file through the processing steps,
+// stores every output and points the video row at them. video.Watermarked marks a source that already
+// carries a watermark, so it isn't burned in twice.
+func (cfg *apiConfig) processVideoUpload(ctx context.Context, video database.Video, sourcePath, mediaType string) (database.Video, error) {
+	probeData, err := cfg.media.Probe(ctx, sourcePath)
+	if err != nil {
+		return video, fmt.Errorf("unable to probe video: %w", err)
+	}
+
+	aspectRatio, err := classifyAspectRatio(probeData)
+	if err != nil {
+		return video, fmt.Errorf("unable to retrieve aspect ratio from video: %w", err)
+	}
+	ratioPrefix := aspectRatioPrefix(aspectRatio)
+
+	duration, _ := strconv.ParseFloat(probeData.Format.Duration, 64)
+
+	normalizedFile, err := cfg.media.NormalizeToMP4(cfg.processingStep(ctx, video.ID, "normalize", duration), sourcePath, probeData)
+	if err != nil {
+		return video, fmt.Errorf("unable to normalize the video to mp4: %w", err)
+	}
+	defer os.Remove(normalizedFile)
+
+	normalizedProbe, err := cfg.media.Probe(ctx, normalizedFile)
+	if err != nil {
+		return video, fmt.Errorf("unable to probe the normalized video: %w", err)
+	}
+
+	watermark, removeWatermark, err := cfg.watermarkFor(ctx, video.UserID)
+	if err != nil {
+		return video, fmt.Errorf("unable to load the watermark: %w", err)
+	}
+	defer removeWatermark()
+
+	// renditions are made from the source unless a watermark has to be in them too
+	cleanFile := normalizedFile
+	renditionSource, renditionProbe := sourcePath, probeData
+	video.UnwatermarkedURL = nil
+	if watermark != nil && !video.Watermarked {
+		watermarkedFile, watermarkedProbe, err := cfg.watermarkVideo(ctx, video, watermark, normalizedFile, normalizedProbe)
+		if err != nil {
+			return video, fmt.Errorf("unable to watermark the video: %w", err)
+		}
+		defer os.Remove(watermarkedFile)
+		normalizedFile, normalizedProbe = watermarkedFile, watermarkedProbe
+		renditionSource, renditionProbe = watermarkedFile, watermarkedProbe
+		video.Watermarked = true
+	} else {
+		watermark = nil
+	}
+
+	video.VideoMetadata = extractMetadata(normalizedProbe)
+	video.AspectRatio = &aspectRatio
+
+	normalizedFileReference, err := os.Open(normalizedFile)
+	if err != nil {
+		return video, fmt.Errorf("unable to open normalized video: %w", err)
+	}
+	defer normalizedFileReference.Close()
+
+	randomName := make([]byte, 32)
+	rand.Read(randomName)
+	randomVideoURL := base64.RawURLEncoding.EncodeToString(randomName)
+
+	key := fmt.Sprintf("%s/%s.mp4", ratioPrefix, randomVideoURL)
+
+	var normalizedSize int64
+	if info, err := normalizedFileReference.Stat(); err == nil {
+		normalizedSize = info.Size()
+	}
+	storing := newProgressReader(normalizedFileReference, 0, normalizedSize, func(read, total int64) {
+		event := bytesEvent(stageStoring, read, total)
+		event.Step = "video"
+		cfg.progress.publish(video.ID, event)
+	})
+	err = cfg.store.Put(ctx, key, storing, "video/mp4")
+	if err != nil {
+		return video, fmt.Errorf("unable to upload the video to object storage: %w", err)
+	}
+	err = cfg.db.CreateVideoObject(video.ID, database.ObjectRef{Store: objectStoreName, Key: key})
+	if err != nil {
+		return video, fmt.Errorf("unable to record the uploaded video: %w", err)
+	}
+
+	video.OriginalURL = nil
+	if cfg.archiveOriginals {
+		// kept under the video's artifact prefix so it's cleaned up along with it
+		originalKey := videoArtifactPrefix(key) + "original." + videoContainers[mediaType].extension
+		err := cfg.storeOriginal(ctx, sourcePath, originalKey, mediaType)
+		if err != nil {
+			return video, fmt.Errorf("unable to archive the original upload: %w", err)
+		}
+		originalURL := cfg.objectURL(originalKey)
+		video.OriginalURL = &originalURL
+	}
+
+	if watermark != nil && watermark.keepOriginal {
+		unwatermarkedKey := videoArtifactPrefix(key) + "unwatermarked.mp4"
+		err := cfg.storeOriginal(ctx, cleanFile, unwatermarkedKey, "video/mp4")
+		if err != nil {
+			return video, fmt.Errorf("unable to store the unwatermarked video: %w", err)
+		}
+		unwatermarkedURL := cfg.objectURL(unwatermarkedKey)
+		video.UnwatermarkedURL = &unwatermarkedURL
+	}
+
+	videoURL := cfg.objectURL(key)
+	video.VideoURL = &videoURL
+	video.PlaylistURL = nil
+
+	video.DashManifestURL = nil
+
+	if cfg.hlsEnabled || cfg.dashEnabled {
+		width, height, hasAudio, err := sourceDimensions(renditionProbe)
+		if err != nil {
+			return video, err
+		}
+		artifactPrefix := videoArtifactPrefix(key)
+
+		if cfg.hlsEnabled {
+			hlsPrefix := artifactPrefix + "hls/"
+			err = cfg.storeDerivedFiles(ctx, video, hlsPrefix, func(outputDir string) error {
+				return cfg.media.TranscodeHLS(cfg.processingStep(ctx, video.ID, "hls", duration), renditionSource, outputDir, width, height, hasAudio)
+			})
+			if err != nil {
+				return video, fmt.Errorf("unable to produce HLS renditions: %w", err)
+			}
+			playlistURL := cfg.objectURL(hlsPrefix + hlsMasterPlaylist)
+			video.PlaylistURL = &playlistURL
+
+			if err := cfg.publishHLSSubtitles(ctx, video); err != nil {
+				log.Printf("Couldn't add subtitles to the HLS playlist of video %s: %v", video.ID, err)
+			}
+		}
+
+		if cfg.dashEnabled {
+			dashPrefix := artifactPrefix + "dash/"
+			err = cfg.storeDerivedFiles(ctx, video, dashPrefix, func(outputDir string) error {
+				return cfg.media.PackageDASH(cfg.processingStep(ctx, video.ID, "dash", duration), renditionSource, outputDir, width, height, hasAudio)
+			})
+			if err != nil {
+				return video, fmt.Errorf("unable to produce DASH renditions: %w", err)
+			}
+			manifestURL := cfg.objectURL(dashPrefix + dashManifest)
+			video.DashManifestURL = &manifestURL
+		}
+	}
+
+	video.StoryboardURL = nil
+	if cfg.storyboardInterval > 0 {
+		storyboardURL, err := cfg.storeStoryboard(ctx, video, videoArtifactPrefix(key)+"storyboard/", normalizedFile, normalizedProbe)
+		if err != nil {
+			// previews are a nicety, the video plays without them
+			log.Printf("Couldn't generate a storyboard for video %s: %v", video.ID, err)
+		} else {
+			video.StoryboardURL = &storyboardURL
+		}
+	}
+
+	video.AudioURL, video.WaveformURL, video.WaveformImageURL = nil, nil, nil
+	if hasAudioStream(normalizedProbe) && (cfg.audioFormat != "" || cfg.waveformEnabled || cfg.transcriber != nil) {
+		outputs, err := cfg.storeAudio(ctx, video, videoArtifactPrefix(key)+"audio/", normalizedFile)
+		if err != nil {
+			log.Printf("Couldn't extract the audio of video %s: %v", video.ID, err)
+		} else {
+			video.AudioURL = outputs.audioURL
+			video.WaveformURL = outputs.waveformURL
+			video.WaveformImageURL = outputs.waveformImageURL
+		}
+	}
+
+	var generatedThumbnailURL *string
+	var generatedThumbnailSrcset database.Srcset
+	if cfg.autoThumbnailEnabled && video.ThumbnailURL == nil {
+		cfg.progress.publish(video.ID, progressEvent{Stage: stageProcessing, Step: "thumbnail"})
+		thumbnailURL, srcset, err := cfg.generateThumbnail(ctx, video.ID, sourcePath)
+		if err != nil {
+			// a missing thumbnail shouldn't cost the user their video
+			log.Printf("Couldn't generate a thumbnail for video %s: %v", video.ID, err)
+		} else {
+			generatedThumbnailURL = &thumbnailURL
+			generatedThumbnailSrcset = srcset
+		}
+	}
+
+	// the row may have changed while we were busy (a new thumbnail, a deletion), only touch our own fields
+	current, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		return video, err
+	}
+	if current.ID == uuid.Nil {
+		return video, errVideoGone
+	}
+	current.VideoURL = video.VideoURL
+	current.PlaylistURL = video.PlaylistURL
+	current.DashManifestURL = video.DashManifestURL
+	current.OriginalURL = video.OriginalURL
+	current.StoryboardURL = video.StoryboardURL
+	current.AudioURL = video.AudioURL
+	current.WaveformURL = video.WaveformURL
+	current.WaveformImageURL = video.WaveformImageURL
+	current.VideoMetadata = video.VideoMetadata
+	current.Watermarked = video.Watermarked
+	current.UnwatermarkedURL = video.UnwatermarkedURL
+	if current.ThumbnailURL == nil {
+		current.ThumbnailURL = generatedThumbnailURL
+		current.ThumbnailSrcset = generatedThumbnailSrcset
+	}
+
+	err = cfg.db.UpdateVideo(current)
+	if err != nil {
+		return current, fmt.Errorf("unable to update video url in database: %w", err)
+	}
+	return current, nil
+}
+
+// aspectRatioPrefix groups videos in the object store by orientation
+func aspectRatioPrefix(aspectRatio string) string {
+	switch aspectRatio {
+	case "16:9", "4:3", "21:9":
+		return "landscape"
+	case "9:16", "3:4", "4:5":
+		return "portrait"
+	case "1:1":
+		return "square"
+	default:
+		return "other"
+	}
+}
+
+// sourceDimensions reads the displayed size of the first video stream and whether there is any audio to carry over.
+// ffmpeg applies rotation metadata while decoding, so renditions are scaled from the rotated size.
+func sourceDimensions(probeData ffmpegData) (int, int, bool, error) {
+	stream, ok := firstVideoStream(probeData)
+	if !ok {
+		return 0, 0, false, fmt.Errorf("no video stream found")
+	}
+	width, height := stream.Width, stream.Height
+	if rotation := streamRotation(stream); rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	return width, height, hasAudioStream(probeData), nil
+}
+
+func hasAudioStream(probeData ffmpegData) bool {
+	for _, stream := range probeData.Streams {
+		if stream.CodecType == "audio" {
+			return true
+		}
+	}
+	return false
+}
+
+// storeDerivedFiles runs produce in a scratch directory and uploads whatever it wrote under keyPrefix
+func (cfg *apiConfig) storeDerivedFiles(ctx context.Context, video database.Video, keyPrefix string, produce func(outputDir string) error) error {
+	outputDir, err := os.MkdirTemp("", "tubely-derived")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	if err := produce(outputDir); err != nil {
+		return err
+	}
+
+	cfg.progress.publish(video.ID, progressEvent{Stage: stageStoring, Step: path.Base(keyPrefix)})
+	err = cfg.uploadDirectory(ctx, outputDir, keyPrefix)
+	if err != nil {
+		return fmt.Errorf("unable to upload %s: %w", keyPrefix, err)
+	}
+	err = cfg.db.CreateVideoObject(video.ID, database.ObjectRef{Store: objectStoreName, Key: keyPrefix, Prefix: true})
+	if err != nil {
+		return fmt.Errorf("unable to record %s: %w", keyPrefix, err)
+	}
+	return nil
+}
+
+// storeStoryboard samples the processed video into sprite sheets with a WebVTT track under keyPrefix
+// and returns the track's URL
+func (cfg *apiConfig) storeStoryboard(ctx context.Context, video database.Video, keyPrefix, filePath string, probeData ffmpegData) (string, error) {
+	duration, err := strconv.ParseFloat(probeData.Format.Duration, 64)
+	if err != nil || duration <= 0 {
+		return "", fmt.Errorf("unknown duration %q", probeData.Format.Duration)
+	}
+	width, height, _, err := sourceDimensions(probeData)
+	if err != nil {
+		return "", err
+	}
+	layout := newStoryboardLayout(width, height, cfg.storyboardInterval.Seconds())
+
+	err = cfg.storeDerivedFiles(ctx, video, keyPrefix, func(outputDir string) error {
+		return cfg.writeStoryboard(cfg.processingStep(ctx, video.ID, "storyboard", duration), filePath, outputDir, layout, duration)
+	})
+	if err != nil {
+		return "", err
+	}
+	return cfg.objectURL(keyPrefix + storyboardTrack), nil
+}
+
+func (cfg *apiConfig) storeOriginal(ctx context.Context, sourcePath, key, mediaType string) error {
+	original, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+
+	return cfg.store.Put(ctx, key, original, mediaType)
+}
+
+// processingStep announces a processing step and returns a context that has ffmpeg report how far
+// through the video's duration the step is
+func (cfg *apiConfig) processingStep(ctx context.Context, videoID uuid.UUID, step string, duration float64) context.Context {
+	cfg.progress.publish(videoID, progressEvent{Stage: stageProcessing, Step: step})
+	if duration <= 0 {
+		return ctx
+	}
+
+	var lastSent time.Time
+	return withFFmpegProgress(ctx, func(done time.Duration) {
+		if time.Since(lastSent) < progressPublishInterval {
+			return
+		}
+		lastSent = time.Now()
+		cfg.progress.publish(videoID, progressEvent{
+			Stage:   stageProcessing,
+			Step:    step,
+			Percent: min(100, done.Seconds()*100/duration),
+		})
+	})
+}
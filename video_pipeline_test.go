@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func TestProcessVideoUpload(t *testing.T) {
+	rotated := probeResult(1920, 1080, "12.5")
+	rotated.Streams[0].SideDataList = []ffprobeSideData{{SideDataType: "Display Matrix", Rotation: -90}}
+
+	tests := []struct {
+		name         string
+		probe        ffmpegData
+		wantPrefix   string
+		wantWidth    int
+		wantRotation int
+	}{
+		{
+			name:       "landscape",
+			probe:      probeResult(1920, 1080, "12.5"),
+			wantPrefix: "landscape/",
+			wantWidth:  1920,
+		},
+		{
+			name:         "rotated phone video",
+			probe:        rotated,
+			wantPrefix:   "portrait/",
+			wantWidth:    1920,
+			wantRotation: 90,
+		},
+		{
+			name:       "odd dimensions",
+			probe:      probeResult(1001, 333, "12.5"),
+			wantPrefix: "other/",
+			wantWidth:  1001,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourcePath := filepath.Join(t.TempDir(), "source.upload")
+			if err := os.WriteFile(sourcePath, testMP4, 0644); err != nil {
+				t.Fatal(err)
+			}
+			media := &fakeMediaProcessor{probes: map[string]ffmpegData{sourcePath: tt.probe}}
+			cfg := newTestConfig(t, media)
+			cfg.storyboardInterval = 5 * time.Second
+			cfg.audioFormat = audioFormatAAC
+			cfg.waveformEnabled = true
+			video, _ := newTestVideo(t, cfg)
+
+			video, err := cfg.processVideoUpload(context.Background(), video, sourcePath, "video/mp4")
+			if err != nil {
+				t.Fatalf("processVideoUpload() error = %v", err)
+			}
+
+			if video.VideoURL == nil || !strings.HasPrefix(*video.VideoURL, cfg.objectURL(tt.wantPrefix)) {
+				t.Errorf("video url = %v, want it under %s", video.VideoURL, tt.wantPrefix)
+			}
+			if video.Width == nil || *video.Width != tt.wantWidth {
+				t.Errorf("width = %v, want %d", video.Width, tt.wantWidth)
+			}
+			if video.Rotation == nil || *video.Rotation != tt.wantRotation {
+				t.Errorf("rotation = %v, want %d", video.Rotation, tt.wantRotation)
+			}
+			if video.DurationSeconds == nil || *video.DurationSeconds != 12.5 {
+				t.Errorf("duration = %v, want 12.5", video.DurationSeconds)
+			}
+			if video.StoryboardURL == nil || !strings.HasSuffix(*video.StoryboardURL, "/storyboard/"+storyboardTrack) {
+				t.Errorf("storyboard url = %v, want a %s next to the video", video.StoryboardURL, storyboardTrack)
+			}
+			if video.AudioURL == nil || !strings.HasSuffix(*video.AudioURL, "/audio/audio.m4a") {
+				t.Errorf("audio url = %v, want an m4a next to the video", video.AudioURL)
+			}
+			if video.WaveformURL == nil || video.WaveformImageURL == nil {
+				t.Errorf("waveform urls = %v and %v, want both", video.WaveformURL, video.WaveformImageURL)
+			}
+			if _, err := os.Stat(sourcePath + ".processing"); !os.IsNotExist(err) {
+				t.Errorf("normalized file was left behind")
+			}
+		})
+	}
+}
+
+func TestProcessVideoUploadTimeout(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "source.upload")
+	if err := os.WriteFile(sourcePath, testMP4, 0644); err != nil {
+		t.Fatal(err)
+	}
+	media := &fakeMediaProcessor{
+		probes: map[string]ffmpegData{sourcePath: probeResult(1920, 1080, "12.5")},
+		normalize: func(ctx context.Context, filePath string, probeData ffmpegData) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+	}
+	cfg := newTestConfig(t, media)
+	video, _ := newTestVideo(t, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := cfg.processVideoUpload(ctx, video, sourcePath, "video/mp4")
+	if err == nil || ctx.Err() == nil {
+		t.Fatalf("processVideoUpload() error = %v, want it to give up with the context", err)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoURL != nil {
+		t.Errorf("video url = %v after a failed run, want none", *stored.VideoURL)
+	}
+}
+
+// seekCheckingStore fails Puts of bodies it can't measure by seeking, as the S3 SDK does
+type seekCheckingStore struct {
+	storage.ObjectStore
+}
+
+func (s seekCheckingStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("body of %s can't seek", key)
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seeking to the end of %s: %w", key, err)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rewinding %s: %w", key, err)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes of %s after rewinding, want %d", len(data), key, size)
+	}
+	return s.ObjectStore.Put(ctx, key, bytes.NewReader(data), contentType)
+}
+
+func TestProcessVideoUploadSeekableBody(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "source.upload")
+	if err := os.WriteFile(sourcePath, testMP4, 0644); err != nil {
+		t.Fatal(err)
+	}
+	media := &fakeMediaProcessor{probes: map[string]ffmpegData{sourcePath: probeResult(1920, 1080, "12.5")}}
+	cfg := newTestConfig(t, media)
+	cfg.store = seekCheckingStore{cfg.store}
+	video, _ := newTestVideo(t, cfg)
+
+	video, err := cfg.processVideoUpload(context.Background(), video, sourcePath, "video/mp4")
+	if err != nil {
+		t.Fatalf("processVideoUpload() error = %v", err)
+	}
+	if video.VideoURL == nil {
+		t.Error("video url missing")
+	}
+}
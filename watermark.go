@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	watermarkPrefix      = "watermarks/"
+	watermarkUploadLimit = 5 << 20
+	// watermarkMaxPixels keeps logos small enough to overlay on every frame without slowing the encode down
+	watermarkMaxPixels = 4_000_000
+	watermarkMaxMargin = 1000
+)
+
+// watermarkPosition returns the overlay filter's x:y for a position, margin pixels in from the edges
+func watermarkPosition(position string, margin int) (string, bool) {
+	switch position {
+	case "top-left":
+		return fmt.Sprintf("%d:%d", margin, margin), true
+	case "top-right":
+		return fmt.Sprintf("W-w-%d:%d", margin, margin), true
+	case "bottom-left":
+		return fmt.Sprintf("%d:H-h-%d", margin, margin), true
+	case "bottom-right":
+		return fmt.Sprintf("W-w-%d:H-h-%d", margin, margin), true
+	case "center":
+		return "(W-w)/2:(H-h)/2", true
+	default:
+		return "", false
+	}
+}
+
+// watermarkSettings is where and how a logo is drawn, the server-wide settings come from the environment
+// and a user's own replace them for their videos
+type watermarkSettings struct {
+	position string
+	opacity  float64
+	// margin is the distance from the edges in pixels of the processed video
+	margin int
+	// scale is the logo's width as a fraction of the video's
+	scale        float64
+	keepOriginal bool
+}
+
+var defaultWatermarkSettings = watermarkSettings{position: "bottom-right", opacity: 0.8, margin: 24, scale: 0.15}
+
+// watermarkConfig is a watermark ready to be applied, imagePath is a local file
+type watermarkConfig struct {
+	imagePath string
+	watermarkSettings
+}
+
+// watermarkOverlay is a watermark fitted to one video
+type watermarkOverlay struct {
+	position string
+	opacity  float64
+	margin   int
+	// width of the logo in pixels, its height follows the aspect ratio
+	width int
+}
+
+func (s watermarkSettings) validate() error {
+	if _, ok := watermarkPosition(s.position, s.margin); !ok {
+		return errors.New("position must be top-left, top-right, bottom-left, bottom-right or center")
+	}
+	if math.IsNaN(s.opacity) || s.opacity <= 0 || s.opacity > 1 {
+		return errors.New("opacity must be above 0 and at most 1")
+	}
+	if s.margin < 0 || s.margin > watermarkMaxMargin {
+		return fmt.Errorf("margin must be between 0 and %d pixels", watermarkMaxMargin)
+	}
+	if math.IsNaN(s.scale) || s.scale <= 0 || s.scale > 1 {
+		return errors.New("scale must be above 0 and at most 1")
+	}
+	return nil
+}
+
+// overlayFor sizes the logo for a video displayed at videoWidth pixels wide
+func (s watermarkSettings) overlayFor(videoWidth int) watermarkOverlay {
+	// libx264 wants even dimensions, the logo's height is rounded to match
+	width := max(2, int(math.Round(float64(videoWidth)*s.scale/2))*2)
+	return watermarkOverlay{
+		position: s.position,
+		opacity:  s.opacity,
+		margin:   s.margin,
+		width:    width,
+	}
+}
+
+// watermarkFilter scales the logo from the second input, fades it to the overlay's opacity
+// and draws it on the first input's video as [v]
+func watermarkFilter(overlay watermarkOverlay) string {
+	position, ok := watermarkPosition(overlay.position, overlay.margin)
+	if !ok {
+		position, _ = watermarkPosition(defaultWatermarkSettings.position, overlay.margin)
+	}
+	return fmt.Sprintf(
+		"[1:v]scale=%d:-2,format=rgba,colorchannelmixer=aa=%s[wm];[0:v][wm]overlay=%s,format=yuv420p[v]",
+		overlay.width,
+		strconv.FormatFloat(overlay.opacity, 'f', -1, 64),
+		position,
+	)
+}
+
+// applyWatermark burns imagePath into the video of filePath, the audio is copied as is
+func applyWatermark(ctx context.Context, tools *toolRunner, filePath, outputPath, imagePath string, overlay watermarkOverlay) error {
+	args := []string{
+		"-y",
+		"-i", filePath,
+		"-i", imagePath,
+		"-filter_complex", watermarkFilter(overlay),
+		"-map", "[v]",
+		"-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "medium", "-crf", "23",
+		"-c:a", "copy",
+		"-movflags", "faststart",
+		"-f", "mp4", outputPath,
+	}
+	err := tools.ffmpeg(ctx, args, nil, nil)
+	if err != nil {
+		return fmt.Errorf("watermarking %v: %w", filePath, err)
+	}
+	return nil
+}
+
+// decodeWatermarkImage checks an uploaded or configured logo
+func decodeWatermarkImage(data []byte) (image.Image, error) {
+	if _, err := sniffImageType(data); err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not a supported image: %w", err)
+	}
+	if config.Width*config.Height > watermarkMaxPixels {
+		return nil, fmt.Errorf("image dimensions %dx%d are out of range, logos are at most %d pixels", config.Width, config.Height, watermarkMaxPixels)
+	}
+	return decodeThumbnail(data)
+}
+
+// storeWatermarkImage stores a user's logo as a PNG, which keeps its transparency for ffmpeg, and returns its key
+func (cfg *apiConfig) storeWatermarkImage(ctx context.Context, userID uuid.UUID, img image.Image) (string, error) {
+	data := bytes.Buffer{}
+	if err := png.Encode(&data, img); err != nil {
+		return "", err
+	}
+
+	randomName := make([]byte, 8)
+	rand.Read(randomName)
+	key := fmt.Sprintf("%s%s/%s.png", watermarkPrefix, userID, hex.EncodeToString(randomName))
+	err := cfg.store.Put(ctx, key, bytes.NewReader(data.Bytes()), "image/png")
+	if err != nil {
+		return "", fmt.Errorf("unable to store the watermark: %w", err)
+	}
+	return key, nil
+}
+
+func (cfg *apiConfig) deleteWatermarkImage(ctx context.Context, key string) {
+	err := cfg.deleteObject(ctx, database.ObjectRef{Store: objectStoreName, Key: key})
+	if err != nil {
+		// the garbage collector picks it up later
+		log.Printf("Couldn't delete watermark image %s: %v", key, err)
+	}
+}
+
+// watermarkFromEnv reads the server-wide watermark, the image is checked once here rather than on every upload
+func watermarkFromEnv(imagePath string) (*watermarkConfig, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading WATERMARK_IMAGE: %w", err)
+	}
+	if _, err := decodeWatermarkImage(data); err != nil {
+		return nil, fmt.Errorf("WATERMARK_IMAGE is invalid: %w", err)
+	}
+
+	settings := defaultWatermarkSettings
+	if position := os.Getenv("WATERMARK_POSITION"); position != "" {
+		settings.position = position
+	}
+	settings.opacity, err = getEnvFloat("WATERMARK_OPACITY", settings.opacity)
+	if err != nil {
+		return nil, err
+	}
+	settings.margin, err = getEnvInt("WATERMARK_MARGIN", settings.margin)
+	if err != nil {
+		return nil, err
+	}
+	settings.scale, err = getEnvFloat("WATERMARK_SCALE", settings.scale)
+	if err != nil {
+		return nil, err
+	}
+	settings.keepOriginal, err = getEnvBool("WATERMARK_KEEP_ORIGINAL", false)
+	if err != nil {
+		return nil, err
+	}
+	if err := settings.validate(); err != nil {
+		return nil, fmt.Errorf("WATERMARK settings are invalid: %w", err)
+	}
+	return &watermarkConfig{imagePath: imagePath, watermarkSettings: settings}, nil
+}
+
+// watermarkFor returns the watermark for a user's videos, nil if there is none. A user's own watermark
+// is copied out of the object store and the returned cleanup removes it.
+func (cfg *apiConfig) watermarkFor(ctx context.Context, userID uuid.UUID) (*watermarkConfig, func(), error) {
+	saved, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if saved == nil {
+		return cfg.watermark, func() {}, nil
+	}
+
+	body, err := cfg.store.Get(ctx, saved.ImageKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read watermark %s: %w", saved.ImageKey, err)
+	}
+	defer body.Close()
+	imageFile, err := os.CreateTemp(cfg.spoolDir, "tubely-watermark-*.png")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(imageFile.Name()) }
+	_, err = io.Copy(imageFile, body)
+	if closeErr := imageFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("unable to copy watermark %s: %w", saved.ImageKey, err)
+	}
+
+	return &watermarkConfig{
+		imagePath: imageFile.Name(),
+		watermarkSettings: watermarkSettings{
+			position:     saved.Position,
+			opacity:      saved.Opacity,
+			margin:       saved.Margin,
+			scale:        saved.Scale,
+			keepOriginal: saved.KeepOriginal,
+		},
+	}, cleanup, nil
+}
+
+// watermarkVideo burns the watermark into normalizedFile and returns the new file's path and probe,
+// the caller removes it
+func (cfg *apiConfig) watermarkVideo(ctx context.Context, video database.Video, watermark *watermarkConfig, normalizedFile string, normalizedProbe ffmpegData) (string, ffmpegData, error) {
+	width, _, _, err := sourceDimensions(normalizedProbe)
+	if err != nil {
+		return "", ffmpegData{}, err
+	}
+	duration, _ := strconv.ParseFloat(normalizedProbe.Format.Duration, 64)
+
+	outputPath := normalizedFile + ".watermarked.mp4"
+	err = cfg.media.ApplyWatermark(cfg.processingStep(ctx, video.ID, "watermark", duration), normalizedFile, outputPath, watermark.imagePath, watermark.overlayFor(width))
+	if err != nil {
+		os.Remove(outputPath)
+		return "", ffmpegData{}, err
+	}
+	probeData, err := cfg.media.Probe(ctx, outputPath)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", ffmpegData{}, fmt.Errorf("unable to probe the watermarked video: %w", err)
+	}
+	return outputPath, probeData, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestWatermarkFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings watermarkSettings
+		width    int
+		want     string
+	}{
+		{
+			name:     "bottom right",
+			settings: watermarkSettings{position: "bottom-right", opacity: 0.8, margin: 24, scale: 0.15},
+			width:    1920,
+			want:     "[1:v]scale=288:-2,format=rgba,colorchannelmixer=aa=0.8[wm];[0:v][wm]overlay=W-w-24:H-h-24,format=yuv420p[v]",
+		},
+		{
+			name:     "top left with an odd width",
+			settings: watermarkSettings{position: "top-left", opacity: 1, margin: 0, scale: 0.1},
+			width:    1001,
+			want:     "[1:v]scale=100:-2,format=rgba,colorchannelmixer=aa=1[wm];[0:v][wm]overlay=0:0,format=yuv420p[v]",
+		},
+		{
+			name:     "centered ignores the margin",
+			settings: watermarkSettings{position: "center", opacity: 0.25, margin: 50, scale: 0.5},
+			width:    640,
+			want:     "[1:v]scale=320:-2,format=rgba,colorchannelmixer=aa=0.25[wm];[0:v][wm]overlay=(W-w)/2:(H-h)/2,format=yuv420p[v]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.validate(); err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			if got := watermarkFilter(tt.settings.overlayFor(tt.width)); got != tt.want {
+				t.Errorf("watermarkFilter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []watermarkSettings{
+		{position: "middle", opacity: 0.8, margin: 24, scale: 0.15},
+		{position: "top-left", opacity: 0, margin: 24, scale: 0.15},
+		{position: "top-left", opacity: 0.8, margin: -1, scale: 0.15},
+		{position: "top-left", opacity: 0.8, margin: 24, scale: 1.5},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want an error", invalid)
+		}
+	}
+}
+
+func testLogo(t *testing.T) []byte {
+	t.Helper()
+	logo := bytes.Buffer{}
+	if err := png.Encode(&logo, image.NewNRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	return logo.Bytes()
+}
+
+func newWatermarkRequest(t *testing.T, token string, fields map[string]string, logo []byte) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if logo != nil {
+		part, err := form.CreateFormFile("image", "logo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(logo)
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPut, "/api/watermark", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestHandlerWatermark(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t, &fakeMediaProcessor{})
+	_, token := newTestVideo(t, cfg)
+
+	save := func(fields map[string]string, logo []byte, wantStatus int) database.Watermark {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerWatermarkSave(w, newWatermarkRequest(t, token, fields, logo))
+		if w.Code != wantStatus {
+			t.Fatalf("status = %d, want %d: %s", w.Code, wantStatus, w.Body)
+		}
+		watermark := database.Watermark{}
+		if wantStatus == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&watermark); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return watermark
+	}
+
+	save(map[string]string{"position": "top-left"}, nil, http.StatusBadRequest)
+	save(nil, []byte("not an image at all"), http.StatusUnsupportedMediaType)
+	save(map[string]string{"opacity": "2"}, testLogo(t), http.StatusBadRequest)
+
+	first := save(map[string]string{"opacity": "0.5"}, testLogo(t), http.StatusOK)
+	if first.Position != "bottom-right" || first.Opacity != 0.5 || first.Margin != 24 || !strings.HasPrefix(first.ImageURL, cfg.objectURL(watermarkPrefix)) {
+		t.Errorf("watermark = %+v, want the defaults with opacity 0.5", first)
+	}
+
+	// settings can change without sending the image again
+	moved := save(map[string]string{"position": "top-left", "keep_original": "true"}, nil, http.StatusOK)
+	if moved.Position != "top-left" || moved.Opacity != 0.5 || !moved.KeepOriginal || moved.ImageURL != first.ImageURL {
+		t.Errorf("watermark = %+v, want it moved with the same image", moved)
+	}
+
+	// a new image replaces the old object
+	replaced := save(nil, testLogo(t), http.StatusOK)
+	firstKey := strings.TrimPrefix(first.ImageURL, cfg.objectURL(""))
+	if replaced.ImageURL == first.ImageURL {
+		t.Errorf("image url = %s, want a new object", replaced.ImageURL)
+	}
+	if _, err := cfg.store.Get(ctx, firstKey); err == nil {
+		t.Errorf("old image %s still stored", firstKey)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/watermark", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerWatermarkDelete(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/watermark", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	cfg.handlerWatermarkGet(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("get status after delete = %d, want 404", w.Code)
+	}
+}
+
+func TestProcessVideoUploadWatermarks(t *testing.T) {
+	ctx := context.Background()
+	media := &fakeMediaProcessor{
+		probe: func(ctx context.Context, input string) (ffmpegData, error) {
+			return probeResult(1920, 1080, "10.0"), nil
+		},
+	}
+	cfg := newTestConfig(t, media)
+	parent, token := newTestVideo(t, cfg)
+
+	logoKey, err := cfg.storeWatermarkImage(ctx, parent.UserID, image.NewNRGBA(image.Rect(0, 0, 40, 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setWatermark := func(keepOriginal bool) {
+		t.Helper()
+		_, err := cfg.db.SaveWatermark(database.SaveWatermarkParams{
+			UserID:       parent.UserID,
+			ImageKey:     logoKey,
+			ImageURL:     cfg.objectURL(logoKey),
+			Position:     "bottom-right",
+			Opacity:      0.8,
+			Margin:       24,
+			Scale:        0.15,
+			KeepOriginal: keepOriginal,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	process := func(video database.Video) database.Video {
+		t.Helper()
+		cfg.store.Put(ctx, "uploads/"+video.ID.String(), bytes.NewReader(testMP4), "video/mp4")
+		job, err := cfg.db.CreateJob(database.CreateJobParams{VideoID: video.ID, SourceKey: "uploads/" + video.ID.String(), MediaType: "video/mp4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.processVideoJob(ctx, job); err != nil {
+			t.Fatalf("processVideoJob() error = %v", err)
+		}
+		video, _ = cfg.db.GetVideo(video.ID)
+		return video
+	}
+	clip := func() database.Video {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/videos/"+parent.ID.String()+"/clip", strings.NewReader(`{"start": 0, "end": 5}`))
+		req.SetPathValue("videoID", parent.ID.String())
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		cfg.handlerVideoClip(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("clip status = %d: %s", w.Code, w.Body)
+		}
+		resp := videoResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		job, err := cfg.db.GetLatestJobForVideo(resp.ID)
+		if err != nil || job == nil {
+			t.Fatalf("job = %+v, %v", job, err)
+		}
+		if err := cfg.processVideoJob(ctx, *job); err != nil {
+			t.Fatalf("processVideoJob() error = %v", err)
+		}
+		video, _ := cfg.db.GetVideo(resp.ID)
+		return video
+	}
+
+	setWatermark(true)
+	parent = process(parent)
+	if !parent.Watermarked || parent.UnwatermarkedURL == nil || media.callCount("watermark") != 1 {
+		t.Fatalf("video = %+v after %v, want it watermarked with a clean copy", parent, media.calls)
+	}
+	if _, err := cfg.store.Get(ctx, strings.TrimPrefix(*parent.UnwatermarkedURL, cfg.objectURL(""))); err != nil {
+		t.Errorf("clean copy not stored: %v", err)
+	}
+
+	// clips are cut from the clean copy and get their own watermark
+	first := clip()
+	if !first.Watermarked || media.callCount("watermark") != 2 {
+		t.Errorf("clip = %+v after %v, want it watermarked once", first, media.calls)
+	}
+
+	// without a clean copy the clip already carries the watermark
+	setWatermark(false)
+	parent = process(parent)
+	if parent.UnwatermarkedURL != nil || media.callCount("watermark") != 3 {
+		t.Fatalf("video = %+v, want it watermarked without a clean copy", parent)
+	}
+	second := clip()
+	if !second.Watermarked || media.callCount("watermark") != 3 {
+		t.Errorf("clip = %+v after %v, want the parent's watermark without another one", second, media.calls)
+	}
+
+	// without any watermark configured nothing is burned in
+	if err := cfg.db.DeleteWatermark(parent.UserID); err != nil {
+		t.Fatal(err)
+	}
+	parent = process(parent)
+	if parent.Watermarked || media.callCount("watermark") != 3 {
+		t.Errorf("video = %+v, want it left clean", parent)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	waveformData  = "waveform.json"
+	waveformImage = "waveform.png"
+	// waveformPoints is about how many min/max pairs a waveform has, whatever the length of the video
+	waveformPoints      = 2000
+	waveformImageHeight = 160
+)
+
+var waveformColor = color.RGBA{R: 0x7e, G: 0x57, B: 0xc2, A: 0xff}
+
+// waveform is the JSON format of BBC's audiowaveform, which players like peaks.js read directly.
+// Data holds a min and a max per point, scaled to 8 bits.
+type waveform struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// computeWaveform reduces samples 16-bit mono PCM samples from r to about waveformPoints min/max pairs
+func computeWaveform(r io.Reader, samples int64, sampleRate int) (waveform, error) {
+	samplesPerPoint := max(1, int(math.Ceil(float64(samples)/waveformPoints)))
+	w := waveform{
+		Version:         2,
+		Channels:        1,
+		SampleRate:      sampleRate,
+		SamplesPerPixel: samplesPerPoint,
+		Bits:            8,
+		Data:            []int8{},
+	}
+
+	reader := bufio.NewReader(r)
+	buf := make([]byte, 2)
+	low, high := int16(math.MaxInt16), int16(math.MinInt16)
+	inPoint := 0
+	for {
+		_, err := io.ReadFull(reader, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return waveform{}, err
+		}
+		sample := int16(binary.LittleEndian.Uint16(buf))
+		low, high = min(low, sample), max(high, sample)
+		inPoint++
+
+		if inPoint == samplesPerPoint {
+			w.Data = append(w.Data, int8(low>>8), int8(high>>8))
+			low, high = math.MaxInt16, math.MinInt16
+			inPoint = 0
+		}
+	}
+	if inPoint > 0 {
+		w.Data = append(w.Data, int8(low>>8), int8(high>>8))
+	}
+	w.Length = len(w.Data) / 2
+	return w, nil
+}
+
+// renderWaveform draws a point per pixel column as a bar from its min to its max
+func renderWaveform(w waveform) image.Image {
+	width := max(1, w.Length)
+	img := image.NewNRGBA(image.Rect(0, 0, width, waveformImageHeight))
+	mid := waveformImageHeight / 2
+
+	for x := 0; x < w.Length; x++ {
+		low, high := int(w.Data[2*x]), int(w.Data[2*x+1])
+		top := mid - high*mid/128
+		bottom := mid - low*mid/128
+		// silence still gets a line so the image doesn't look broken
+		for y := min(top, mid); y <= max(bottom, mid); y++ {
+			if y >= 0 && y < waveformImageHeight {
+				img.SetNRGBA(x, y, color.NRGBA(waveformColor))
+			}
+		}
+	}
+	return img
+}
+
+// writeWaveform computes the waveform of a PCM file made by decodeAudioPCM and writes its JSON and PNG into outputDir
+func writeWaveform(pcmPath, outputDir string) error {
+	pcm, err := os.Open(pcmPath)
+	if err != nil {
+		return err
+	}
+	defer pcm.Close()
+	info, err := pcm.Stat()
+	if err != nil {
+		return err
+	}
+
+	w, err := computeWaveform(pcm, info.Size()/2, pcmSampleRate)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, waveformData), data, 0644); err != nil {
+		return err
+	}
+
+	imageFile, err := os.Create(filepath.Join(outputDir, waveformImage))
+	if err != nil {
+		return err
+	}
+	defer imageFile.Close()
+	return png.Encode(imageFile, renderWaveform(w))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func pcmSamples(samples ...int16) *bytes.Reader {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, samples)
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestComputeWaveform(t *testing.T) {
+	w, err := computeWaveform(pcmSamples(0, 256, -512, 32767, -32768, 1000, 0), 7, pcmSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SamplesPerPixel != 1 || w.Length != 7 || len(w.Data) != 14 {
+		t.Fatalf("got %d samples per pixel and %d points, want 1 and 7", w.SamplesPerPixel, w.Length)
+	}
+	if w.Data[6] != 127 || w.Data[8] != -128 {
+		t.Errorf("full scale samples became %d and %d, want 127 and -128", w.Data[6], w.Data[8])
+	}
+
+	// long inputs are reduced to about waveformPoints points, keeping the extremes of each
+	samples := make([]int16, waveformPoints*3+1)
+	samples[4] = 16384
+	samples[5] = -16384
+	w, err = computeWaveform(pcmSamples(samples...), int64(len(samples)), pcmSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SamplesPerPixel != 4 || w.Length != (len(samples)+3)/4 {
+		t.Errorf("got %d samples per pixel and %d points, want 4 and %d", w.SamplesPerPixel, w.Length, (len(samples)+3)/4)
+	}
+	if w.Data[2] != -64 || w.Data[3] != 64 {
+		t.Errorf("second point is [%d, %d], want [-64, 64]", w.Data[2], w.Data[3])
+	}
+}
+
+func TestRenderWaveform(t *testing.T) {
+	w := waveform{Length: 3, Data: []int8{0, 0, -128, 127, -64, 0}}
+	img := renderWaveform(w)
+
+	if img.Bounds().Dx() != 3 || img.Bounds().Dy() != waveformImageHeight {
+		t.Fatalf("image is %v, want 3x%d", img.Bounds(), waveformImageHeight)
+	}
+	filled := func(x int) int {
+		count := 0
+		for y := 0; y < waveformImageHeight; y++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				count++
+			}
+		}
+		return count
+	}
+	// silence is a single line, full scale reaches both edges less the one row int8 can't, half scale down is a quarter
+	if filled(0) != 1 || filled(1) != waveformImageHeight-1 || filled(2) != waveformImageHeight/4+1 {
+		t.Errorf("columns filled %d, %d and %d pixels", filled(0), filled(1), filled(2))
+	}
+}